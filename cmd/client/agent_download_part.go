@@ -6,6 +6,7 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,6 +20,14 @@ func (c *client) DownloadPart(grpcRequest *pb.DownloadPartRequest, stream pb.DDS
 	url, offset, size, clientId, subtaskID := grpcRequest.Url, grpcRequest.Offset, grpcRequest.Size, grpcRequest.ClientId, grpcRequest.SubtaskId
 	slog.Info("Received download request", "URL", url, "Offset", offset, "Size", size, "ClientId", clientId, "subtaskID", subtaskID)
 
+	// the server hands out as many downloads as the agent advertised, a download above that is refused
+	ctx, release, err := c.startDownload(stream.Context(), grpcRequest.AttemptId)
+	if err != nil {
+		slog.Warn("Refusing download request", "subtaskID", subtaskID, "error", err)
+		return err
+	}
+	defer release()
+
 	// Parse .netrc file for credentials
 	username, password, err := httputil.GetDataFromNetrc(url)
 	if err != nil {
@@ -27,12 +36,16 @@ func (c *client) DownloadPart(grpcRequest *pb.DownloadPartRequest, stream pb.DDS
 	}
 
 	// Create HTTP request with Range header
-	req, err := http.NewRequest("GET", url, nil)
+	// the request is aborted when the server cancels the DownloadPart call or aborts the subtask
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		slog.Error("Failed to create HTTP request", "error", err)
 		return err
 	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+	if !grpcRequest.WholeFile {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+	}
+	setValidators(req, grpcRequest)
 	if username != "" && password != "" {
 		req.SetBasicAuth(username, password)
 	}
@@ -46,9 +59,15 @@ func (c *client) DownloadPart(grpcRequest *pb.DownloadPartRequest, stream pb.DDS
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
-		slog.Error("Unexpected HTTP status", "status", resp.Status)
-		return fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	if err := checkResponse(resp, grpcRequest); err != nil {
+		slog.Error("Rejecting origin response", "url", url, "status", resp.Status, "contentRange", resp.Header.Get("Content-Range"), "error", err)
+		return err
+	}
+
+	if grpcRequest.WholeFile {
+		// the origin does not support ranges, the whole file may not fit in memory
+		slog.Info("HTTP response OK, start streaming the whole file", "url", url, "status", resp.Status, "size", resp.ContentLength)
+		return streamFromServer(resp, stream)
 	}
 
 	slog.Info("HTTP response OK, start downloading", "url", url, "status", resp.Status, "offset", offset, "size", size)
@@ -88,6 +107,93 @@ func (c *client) DownloadPart(grpcRequest *pb.DownloadPartRequest, stream pb.DDS
 	return nil
 }
 
+// setValidators makes the origin refuse to serve another version of the file than the one the task started with.
+// A strong ETag goes in If-Match, the origin answers 412 when the file changed.
+// Otherwise a ranged request sends the Last-Modified date in If-Range, the origin then answers 200 with the new file,
+// which checkResponse tells apart by its validators.
+func setValidators(req *http.Request, grpcRequest *pb.DownloadPartRequest) {
+	etag, lastModified := grpcRequest.Etag, grpcRequest.LastModified
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		req.Header.Set("If-Match", etag)
+		return
+	}
+	if lastModified != "" && !grpcRequest.WholeFile {
+		req.Header.Set("If-Range", lastModified)
+	}
+}
+
+// checkResponse makes sure the origin sent the requested bytes.
+// A ranged request must be answered with a 206 and the exact range, a 200 would carry the whole file.
+// The server is told the reason of a rejection, so it can resolve the URL again, stop using ranges,
+// or restart the task when the file changed on the origin.
+func checkResponse(resp *http.Response, grpcRequest *pb.DownloadPartRequest) error {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return pb.NewAgentError(pb.AgentErrorReason_URL_REJECTED, "origin rejected the URL: %s", resp.Status)
+	case http.StatusPreconditionFailed:
+		return pb.NewAgentError(pb.AgentErrorReason_ORIGIN_CHANGED, "origin file changed: %s", resp.Status)
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		retryAfter := httputil.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return pb.NewThrottledError(retryAfter, "origin throttled the request: %s, retry after %v", resp.Status, retryAfter)
+	case http.StatusOK, http.StatusPartialContent:
+	default:
+		if httputil.IsPermanentStatus(resp.StatusCode) {
+			return pb.NewAgentError(pb.AgentErrorReason_REQUEST_REJECTED, "origin rejected the request: %s", resp.Status)
+		}
+		if resp.StatusCode >= 500 {
+			return pb.NewAgentError(pb.AgentErrorReason_ORIGIN_UNAVAILABLE, "origin failed: %s", resp.Status)
+		}
+		return &httputil.StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if changed := changedValidator(resp, grpcRequest); changed != "" {
+		return pb.NewAgentError(pb.AgentErrorReason_ORIGIN_CHANGED, "origin file changed: %s", changed)
+	}
+
+	if grpcRequest.WholeFile {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected HTTP status for a whole file: %s", resp.Status)
+		}
+		return nil
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return pb.NewAgentError(pb.AgentErrorReason_RANGE_MISMATCH, "origin ignored the range: %s", resp.Status)
+	}
+	start, end, _, err := httputil.ParseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return pb.NewAgentError(pb.AgentErrorReason_RANGE_MISMATCH, "%v", err)
+	}
+	wantEnd := grpcRequest.Offset + grpcRequest.Size - 1
+	if start != grpcRequest.Offset || end != wantEnd {
+		return pb.NewAgentError(pb.AgentErrorReason_RANGE_MISMATCH, "origin sent bytes %d-%d, requested %d-%d", start, end, grpcRequest.Offset, wantEnd)
+	}
+	return nil
+}
+
+// changedValidator describes how the validators of the response differ from the ones of the task,
+// or returns an empty string if they match. Validators missing on either side are not compared.
+func changedValidator(resp *http.Response, grpcRequest *pb.DownloadPartRequest) string {
+	if want, got := grpcRequest.Etag, resp.Header.Get("ETag"); want != "" && got != "" {
+		// the weak comparison, a changed file gets a new weak ETag too
+		if strings.TrimPrefix(want, "W/") != strings.TrimPrefix(got, "W/") {
+			return fmt.Sprintf("ETag %s, expected %s", got, want)
+		}
+		return ""
+	}
+	if want, got := grpcRequest.LastModified, resp.Header.Get("Last-Modified"); want != "" && got != "" {
+		wantTime, wantErr := http.ParseTime(want)
+		gotTime, gotErr := http.ParseTime(got)
+		if wantErr != nil || gotErr != nil {
+			if want != got {
+				return fmt.Sprintf("Last-Modified %s, expected %s", got, want)
+			}
+		} else if !gotTime.Equal(wantTime) {
+			return fmt.Sprintf("Last-Modified %s, expected %s", got, want)
+		}
+	}
+	return ""
+}
+
 // downloadFromServer reads the response body and sends progress updates to the server
 // It returns the downloaded data as a byte slice.
 // Upon success, it ensures that the downloaded data matches the expected size.
@@ -145,6 +251,74 @@ func downloadFromServer(resp *http.Response, stream pb.DDSONServiceClient_Downlo
 	return fullBuffer, nil
 }
 
+// streamFromServer sends the response body to the server while it is read, without buffering the whole file.
+// Progress updates are sent between the data, so the stream is only used from this goroutine.
+// The size of the body may be unknown, it is checked against Content-Length when the origin sends one.
+func streamFromServer(resp *http.Response, stream pb.DDSONServiceClient_DownloadPartServer) error {
+	startTime := time.Now()
+	reportTime := time.Now()
+	totalDownloaded := int64(0)
+	downloadedSinceLastUpdate := int64(0)
+
+	sendProgress := func() error {
+		downloadSpeed := 0
+		if elapsed := time.Since(startTime); elapsed.Seconds() > 0 {
+			downloadSpeed = int(float64(totalDownloaded) / elapsed.Seconds())
+		}
+		slog.Debug("Sending progress update to server", "downloaded", common.PrettyFormatSize(downloadedSinceLastUpdate), "speed", common.PrettyFormatSpeed(downloadSpeed))
+		err := stream.Send(&pb.DownloadStatus{
+			Status:          pb.DownloadStatusType_DOWNLOADING,
+			Speed:           int32(downloadSpeed),
+			DownloadedBytes: downloadedSinceLastUpdate,
+		})
+		downloadedSinceLastUpdate = 0
+		reportTime = time.Now()
+		return err
+	}
+
+	buffer := make([]byte, 1024*1024) // 1 MB chunk size
+	for {
+		n, readErr := io.ReadFull(resp.Body, buffer)
+		if n > 0 {
+			totalDownloaded += int64(n)
+			downloadedSinceLastUpdate += int64(n)
+			// update progress to the server every 2 seconds
+			if time.Since(reportTime) > 2*time.Second {
+				if err := sendProgress(); err != nil {
+					slog.Error("Failed to send progress update", "error", err)
+					return err
+				}
+			}
+			err := stream.Send(&pb.DownloadStatus{
+				Status: pb.DownloadStatusType_TRANSFERRING,
+				Data:   buffer[:n],
+			})
+			if err != nil {
+				slog.Error("Failed to send upload data", "error", err)
+				return err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			slog.Error("Failed to read response body", "error", readErr)
+			return readErr
+		}
+	}
+	if err := sendProgress(); err != nil {
+		slog.Error("Failed to send progress update", "error", err)
+		return err
+	}
+
+	if resp.ContentLength >= 0 && totalDownloaded != resp.ContentLength {
+		slog.Error("Read less data than expected", "downloaded", totalDownloaded, "expected", resp.ContentLength)
+		return fmt.Errorf("read less data than expected: downloaded: %d, expected: %d", totalDownloaded, resp.ContentLength)
+	}
+	slog.Info("Whole file streamed", "duration", time.Since(startTime), "size", common.PrettyFormatSize(totalDownloaded))
+	return nil
+}
+
 func reportProgress(stream pb.DDSONServiceClient_DownloadPartServer, wg *sync.WaitGroup, progressChannel chan int64) {
 	defer wg.Done()
 	startTime := time.Now()
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"internal/common"
+)
+
+// agentStateFile returns the file the identity of the agent is kept in, --state-file or one per port in the workspace,
+// so several agents can run on the same host.
+func agentStateFile() (string, error) {
+	if *stateFile != "" {
+		return *stateFile, nil
+	}
+	homeDir, err := common.OriginalUserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, "workspace_ddson", fmt.Sprintf("agent-%d.id", *servicePort)), nil
+}
+
+// loadAgentIdentity returns the identity kept in the state file, and creates it the first time the agent runs.
+// The server recognizes the agent by it after a restart or a reconnection.
+func loadAgentIdentity(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		identity := strings.TrimSpace(string(data))
+		if identity == "" {
+			return "", fmt.Errorf("empty agent identity in %s", path)
+		}
+		return identity, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read the agent identity: %w", err)
+	}
+
+	identity, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("failed to create the directory of the agent state file: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(identity+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to save the agent identity: %w", err)
+	}
+	slog.Info("New agent identity created", "identity", identity, "stateFile", path)
+	return identity, nil
+}
+
+// newUUID returns a random version 4 UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate the agent identity: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
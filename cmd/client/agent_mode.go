@@ -6,32 +6,55 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	// Third-party library
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
 
 	"internal/pb"
-	"internal/version"
 )
 
 type client struct {
 	pb.UnimplementedDDSONServiceClientServer
-	id    int32
-	state pb.ClientState
+	id       int32
+	identity string // persistent identity of the agent, see loadAgentIdentity
+	state    pb.ClientState
+
+	mtx       sync.Mutex
+	slots     int                          // downloads the agent runs at the same time, DownloadPart refuses a download above that
+	downloads map[int64]context.CancelFunc // running downloads by attempt ID, to abort them
+	draining  bool                         // new downloads are refused, the agent leaves once the running ones are done
+	stop      chan struct{}                // closed when the agent leaves, see leave
+	stopOnce  sync.Once
 }
 
-func newClient() *client {
+func newClient(identity string, maxConcurrency int) *client {
 	return &client{
-		id:    0,
-		state: pb.ClientState_IDLE,
+		id:        0,
+		identity:  identity,
+		state:     pb.ClientState_IDLE,
+		slots:     max(maxConcurrency, 1),
+		downloads: make(map[int64]context.CancelFunc),
+		stop:      make(chan struct{}),
 	}
 }
 
 func runAgent() {
-	// start grpc server and heartbeat thread
+	// the identity is loaded first, an agent that can not keep it would come back as a new agent after every restart
+	path, err := agentStateFile()
+	if err != nil {
+		slog.Error("Failed to locate the agent state file", "error", err)
+		os.Exit(1)
+	}
+	identity, err := loadAgentIdentity(path)
+	if err != nil {
+		slog.Error("Failed to load the agent identity", "stateFile", path, "error", err)
+		os.Exit(1)
+	}
+
+	// start grpc server and the session with the server
 	listenAddr := fmt.Sprintf(":%d", *servicePort)
 
 	lis, err := net.Listen("tcp", listenAddr)
@@ -45,92 +68,109 @@ func runAgent() {
 			Time:    10 * time.Second,
 			Timeout: 20 * time.Second,
 		}),
+		// the server keeps one connection to the agent, and checks it with pings between downloads
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
 		grpc.MaxRecvMsgSize(100*1024*1024),
 		grpc.MaxSendMsgSize(100*1024*1024), // 100 MB
 	)
-	client := newClient()
+	client := newClient(identity, *slots)
 	pb.RegisterDDSONServiceClientServer(s, client)
 
-	// heartbeat thread
-	go sendHeartBeatsToServer(&client.id)
+	// session thread, it returns once the server drained or shut down the agent
+	// the downloads are done or aborted by then, the last ones may still be sending their final status
+	go func() {
+		client.keepSession(client.runSession)
+		s.GracefulStop()
+	}()
 
-	slog.Info("Client agent listening", "address", lis.Addr())
+	slog.Info("Client agent listening", "address", lis.Addr(), "slots", client.slots, "identity", identity)
 	if err := s.Serve(lis); err != nil {
 		slog.Error("Failed to serve", "error", err)
 		os.Exit(1)
 	}
+	slog.Info("Agent stopped")
 }
 
-func sendHeartBeatsToServer(id *int32) {
-	for {
-		agent(id)
+// startDownload takes a slot for the download of the attempt, and returns its context, cancelled by abort.
+// The release function gives the slot back. It fails with AGENT_BUSY if all slots run a download or the agent is draining.
+func (c *client) startDownload(ctx context.Context, attemptID int64) (context.Context, func(), error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-		slog.Warn("Agent stopped, restarting in 5 seconds...")
-		time.Sleep(5 * time.Second)
+	if c.draining {
+		return nil, nil, pb.NewAgentError(pb.AgentErrorReason_AGENT_BUSY, "agent is draining, it takes no new download")
+	}
+	if len(c.downloads) >= c.slots {
+		return nil, nil, pb.NewAgentError(pb.AgentErrorReason_AGENT_BUSY, "agent is busy, all %d slots are running a download", c.slots)
 	}
+	ctx, cancel := context.WithCancel(ctx)
+	c.downloads[attemptID] = cancel
+	return ctx, func() {
+		cancel()
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		delete(c.downloads, attemptID)
+		if c.draining && len(c.downloads) == 0 {
+			c.leave()
+		}
+	}, nil
 }
 
-func agent(id *int32) {
-	slog.Info("Connecting to server", "address", *addr)
-	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		slog.Error("Failed to connect", "error", err)
-		return
+// abort cancels the download of the attempt, if it still runs.
+func (c *client) abort(attemptID int64) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	cancel, exists := c.downloads[attemptID]
+	if exists {
+		cancel()
 	}
-	defer conn.Close()
+	return exists
+}
+
+// drain refuses new downloads, the agent leaves once the running ones are done.
+func (c *client) drain() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-	client := pb.NewDDSONServiceClient(conn)
+	c.draining = true
+	slog.Info("Agent draining", "running", len(c.downloads))
+	if len(c.downloads) == 0 {
+		c.leave()
+	}
+}
 
-	// Start registration stream
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// shutdown aborts the running downloads, and leaves at once.
+func (c *client) shutdown() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-	response, err := client.Register(ctx, &pb.RegisterRequest{
-		Name:    *clientName,
-		Version: version.VersionString,
-		Port:    int32(*servicePort),
-	})
-	if err != nil {
-		slog.Error("Register failed", "error", err)
-		return
+	c.draining = true
+	for _, cancel := range c.downloads {
+		cancel()
 	}
+	c.leave()
+}
 
-	*id = response.Id
-	slog.Info("Registered successfully", "id", response.Id, "serverVersion", response.ServerVersion)
+// setSlots changes the downloads the agent runs at the same time, the running downloads go on.
+func (c *client) setSlots(slots int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-	sendHeartbeats(client, *id)
+	c.slots = max(slots, 1)
+	slog.Info("Agent slots changed", "slots", c.slots, "running", len(c.downloads))
 }
 
-func sendHeartbeats(client pb.DDSONServiceClient, id int32) {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-	errCount := 0
-
-	for {
-		<-ticker.C
-
-		slog.Log(context.Background(), slog.LevelDebug-1, "Sending heartbeat to server...")
-		resp, err := client.Heartbeat(context.Background(), &pb.HeartbeatRequest{
-			Name: *clientName,
-			Id:   id,
-		})
-		if err != nil {
-			errCount++
-			slog.Warn("Failed to send heartbeat", "count", errCount, "error", err)
-		} else if resp.Success {
-			if errCount > 0 {
-				errCount--
-			}
-			slog.Log(context.Background(), slog.LevelDebug-1, "Heartbeat successful", "count", errCount, "message", resp.Message)
-		} else {
-			// resp.Success is false
-			slog.Warn("Heartbeat rejected", "count", errCount, "message", resp.Message)
-			errCount++
-		}
+// load returns the running downloads, the slots, and whether the agent is draining.
+func (c *client) load() (int, int, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.downloads), c.slots, c.draining
+}
 
-		if errCount > 3 {
-			slog.Error("Too many errors, disconnecting...")
-			return
-		}
-	}
+func (c *client) leave() {
+	c.stopOnce.Do(func() { close(c.stop) })
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"internal/pb"
+)
+
+func TestStartDownload(t *testing.T) {
+	c := newClient("", 2)
+	ctx1, release1, err := c.startDownload(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("first download refused: %v", err)
+	}
+	_, release2, err := c.startDownload(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("second download refused: %v", err)
+	}
+	if _, _, err := c.startDownload(context.Background(), 3); pb.AgentErrorReasonOf(err) != pb.AgentErrorReason_AGENT_BUSY {
+		t.Fatalf("download above the slots = %v, want AGENT_BUSY", err)
+	}
+
+	// the server aborts the first download, its slot is free once it returns
+	if !c.abort(1) || ctx1.Err() == nil {
+		t.Fatalf("the aborted download goes on")
+	}
+	if c.abort(3) {
+		t.Fatalf("a download that never started was aborted")
+	}
+	release1()
+	if running, slots, _ := c.load(); running != 1 || slots != 2 {
+		t.Fatalf("%d downloads on %d slots once one is released, want 1 on 2", running, slots)
+	}
+
+	// a draining agent takes no new download, it leaves once the running one is done
+	c.drain()
+	if _, _, err := c.startDownload(context.Background(), 4); pb.AgentErrorReasonOf(err) != pb.AgentErrorReason_AGENT_BUSY {
+		t.Fatalf("download on a draining agent = %v, want AGENT_BUSY", err)
+	}
+	select {
+	case <-c.stop:
+		t.Fatalf("the agent left before its download was done")
+	default:
+	}
+	release2()
+	select {
+	case <-c.stop:
+	default:
+		t.Fatalf("the agent did not leave once drained")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	c := newClient("", 2)
+	ctx, release, err := c.startDownload(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("download refused: %v", err)
+	}
+	defer release()
+
+	c.shutdown()
+	if ctx.Err() == nil {
+		t.Fatalf("the download goes on once the agent is shut down")
+	}
+	select {
+	case <-c.stop:
+	default:
+		t.Fatalf("the agent did not leave once shut down")
+	}
+}
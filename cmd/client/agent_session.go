@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"internal/pb"
+	"internal/version"
+)
+
+const (
+	SESSION_MIN_BACKOFF     = 1 * time.Second // delay before the first reconnection to the server
+	SESSION_MAX_BACKOFF     = 1 * time.Minute // the delay doubles after every failed session, up to this
+	DEFAULT_REPORT_INTERVAL = 5 * time.Second // until the server sends its own
+)
+
+// errAgentStopped ends the session once the agent leaves, after a drain or a shutdown.
+var errAgentStopped = errors.New("agent stopped")
+
+// keepSession keeps a session with the server open, and opens a new one with backoff when it ends.
+// runSession is c.runSession, it returns once the session ends. keepSession returns once the agent leaves.
+func (c *client) keepSession(runSession func() (bool, error)) {
+	var backoff sessionBackoff
+	for {
+		registered, err := runSession()
+		if errors.Is(err, errAgentStopped) {
+			slog.Info("Agent left the server")
+			return
+		}
+		delay := backoff.next(registered)
+		slog.Warn("Session with the server ended, reconnecting", "in", delay.Round(time.Millisecond), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// sessionBackoff is the delay before the next session, it doubles after every failed session up to SESSION_MAX_BACKOFF.
+// Half of the delay is random, the agents of a restarted server do not all come back at once.
+type sessionBackoff struct {
+	backoff time.Duration // 0 before the first failed session
+}
+
+// next returns the delay before the next session, after a session that registered the agent or not.
+func (b *sessionBackoff) next(registered bool) time.Duration {
+	if registered || b.backoff == 0 {
+		// the server was up, the backoff starts again
+		b.backoff = SESSION_MIN_BACKOFF
+	}
+	delay := b.backoff/2 + rand.N(b.backoff/2)
+	b.backoff = min(b.backoff*2, SESSION_MAX_BACKOFF)
+	return delay
+}
+
+// runSession registers the agent on a new session, then reports its load and runs the commands of the server
+// until the session breaks or the agent leaves. It tells whether the agent was registered.
+func (c *client) runSession() (bool, error) {
+	slog.Info("Connecting to server", "address", *addr)
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return false, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	// the session ends when the agent leaves
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	stream, err := pb.NewDDSONServiceClient(conn).AgentSession(ctx)
+	if err != nil {
+		return false, c.sessionError(fmt.Errorf("failed to open the session: %w", err))
+	}
+	// the slots may have been changed by the server since the agent started
+	_, currentSlots, _ := c.load()
+	err = stream.Send(&pb.AgentMessage{Message: &pb.AgentMessage_Register{Register: &pb.RegisterRequest{
+		Name:           *clientName,
+		Version:        version.VersionString,
+		Port:           int32(*servicePort),
+		MaxConcurrency: int32(currentSlots),
+		Identity:       c.identity,
+	}}})
+	if err != nil {
+		return false, c.sessionError(fmt.Errorf("register failed: %w", err))
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return false, c.sessionError(fmt.Errorf("register failed: %w", err))
+	}
+	registered := first.GetRegistered()
+	if registered == nil {
+		return false, fmt.Errorf("register failed: unexpected answer %v", first)
+	}
+	c.id = registered.Id
+	slog.Info("Registered successfully", "id", registered.Id, "serverVersion", registered.ServerVersion)
+
+	// the reports are sent from their own goroutine, the commands are received here
+	intervals := make(chan time.Duration, 1)
+	go c.sendReports(ctx, stream, intervals)
+
+	for {
+		command, err := stream.Recv()
+		if err != nil {
+			return true, c.sessionError(err)
+		}
+		switch {
+		case command.GetAbort() != nil:
+			abort := command.GetAbort()
+			found := c.abort(abort.AttemptId)
+			slog.Info("Server aborted a download", "subtaskID", abort.SubtaskId, "attemptID", abort.AttemptId, "reason", abort.Reason, "running", found)
+		case command.GetDrain() != nil:
+			slog.Info("Server drains the agent")
+			c.drain()
+		case command.GetConfig() != nil:
+			config := command.GetConfig()
+			slog.Debug("Server sent the configuration", "reportIntervalSeconds", config.ReportIntervalSeconds, "maxConcurrency", config.MaxConcurrency)
+			if config.MaxConcurrency > 0 {
+				c.setSlots(int(config.MaxConcurrency))
+			}
+			if config.ReportIntervalSeconds > 0 {
+				select {
+				case <-intervals: // the previous interval was not applied yet, it is replaced
+				default:
+				}
+				intervals <- time.Duration(config.ReportIntervalSeconds) * time.Second
+			}
+		case command.GetShutdown() != nil:
+			slog.Warn("Server shuts down the agent", "reason", command.GetShutdown().Reason)
+			c.shutdown()
+		default:
+			slog.Warn("Unknown command from the server", "command", command)
+		}
+	}
+}
+
+// sessionError returns errAgentStopped if the session ended because the agent left, or err otherwise.
+func (c *client) sessionError(err error) error {
+	select {
+	case <-c.stop:
+		return errAgentStopped
+	default:
+		return err
+	}
+}
+
+// sendReports reports the load of the agent every interval, until ctx is done or the stream fails.
+// The server removes an agent that stops reporting, a failed send breaks the session.
+func (c *client) sendReports(ctx context.Context, stream pb.DDSONService_AgentSessionClient, intervals <-chan time.Duration) {
+	ticker := time.NewTicker(DEFAULT_REPORT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case interval := <-intervals:
+			ticker.Reset(interval)
+			continue
+		case <-ticker.C:
+		}
+
+		running, slots, draining := c.load()
+		slog.Log(context.Background(), slog.LevelDebug-1, "Sending report to server", "running", running, "slots", slots, "draining", draining)
+		err := stream.Send(&pb.AgentMessage{Message: &pb.AgentMessage_Report{Report: &pb.AgentReport{
+			Running:  int32(running),
+			Slots:    int32(slots),
+			Draining: draining,
+		}}})
+		if err != nil {
+			slog.Warn("Failed to send report", "error", err)
+			return
+		}
+	}
+}
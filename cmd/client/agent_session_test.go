@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions []bool          // whether every ended session registered the agent
+		want     []time.Duration // the backoff the delay after every session is drawn from, between half of it and it
+	}{
+		{name: "server down", sessions: []bool{false, false, false}, want: []time.Duration{SESSION_MIN_BACKOFF, 2 * SESSION_MIN_BACKOFF, 4 * SESSION_MIN_BACKOFF}},
+		{name: "server back", sessions: []bool{false, false, true, false}, want: []time.Duration{SESSION_MIN_BACKOFF, 2 * SESSION_MIN_BACKOFF, SESSION_MIN_BACKOFF, 2 * SESSION_MIN_BACKOFF}},
+		{name: "capped", sessions: make([]bool, 10), want: []time.Duration{9: SESSION_MAX_BACKOFF}},
+	}
+
+	for _, test := range tests {
+		var backoff sessionBackoff
+		for i, registered := range test.sessions {
+			delay := backoff.next(registered)
+			if want := test.want[i]; want != 0 && (delay < want/2 || delay >= want) {
+				t.Errorf("%s: delay %s after session %d, want from %s to %s", test.name, delay, i+1, want/2, want)
+			}
+		}
+	}
+}
+
+func TestKeepSession(t *testing.T) {
+	tests := []struct {
+		name      string
+		sessions  []error // the errors the sessions end with
+		leave     bool    // the agent leaves before the sessions end
+		wantCalls int
+	}{
+		{name: "drained", sessions: []error{errAgentStopped}, wantCalls: 1},
+		{name: "left while waiting to reconnect", sessions: []error{errors.New("connection refused")}, leave: true, wantCalls: 1},
+	}
+
+	for _, test := range tests {
+		c := newClient("", 1)
+		if test.leave {
+			c.leave()
+		}
+		calls := 0
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.keepSession(func() (bool, error) {
+				calls++
+				return false, test.sessions[min(calls, len(test.sessions))-1]
+			})
+		}()
+		select {
+		case <-done:
+		case <-time.After(SESSION_MIN_BACKOFF / 4):
+			t.Fatalf("%s: keepSession did not return once the agent left", test.name)
+		}
+		if calls != test.wantCalls {
+			t.Errorf("%s: %d sessions, want %d", test.name, calls, test.wantCalls)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"internal/pb"
+)
+
+func doCancelTask(taskID int32) error {
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewDDSONServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := client.CancelDownload(adminContext(ctx), &pb.CancelDownloadRequest{TaskId: taskID})
+	if err != nil {
+		return err
+	}
+	if !resp.GetSuccess() {
+		return fmt.Errorf("server refused to cancel task: %s", resp.GetMessage())
+	}
+
+	slog.Info("Task cancelled", "taskID", taskID, "message", resp.GetMessage())
+	return nil
+}
+
+func doPromoteTask(taskID int32) error {
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewDDSONServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := client.PromoteTask(adminContext(ctx), &pb.PromoteTaskRequest{TaskId: taskID})
+	if err != nil {
+		return err
+	}
+	if !resp.GetSuccess() {
+		return fmt.Errorf("server refused to promote task: %s", resp.GetMessage())
+	}
+
+	slog.Info("Task promoted", "taskID", taskID, "message", resp.GetMessage())
+	return nil
+}
+
+func doControlAgent(agentID int32, action pb.AgentAction, maxConcurrency int32) error {
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewDDSONServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resp, err := client.ControlAgent(adminContext(ctx), &pb.ControlAgentRequest{AgentId: agentID, Action: action, MaxConcurrency: maxConcurrency})
+	if err != nil {
+		return err
+	}
+	if !resp.GetSuccess() {
+		return fmt.Errorf("server refused to control agent: %s", resp.GetMessage())
+	}
+
+	slog.Info("Agent controlled", "agentID", agentID, "action", action, "message", resp.GetMessage())
+	return nil
+}
+
+// adminContext adds the admin token to the requests only admins of the server may send.
+func adminContext(ctx context.Context) context.Context {
+	if *adminToken == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "ddson-admin-token", *adminToken)
+}
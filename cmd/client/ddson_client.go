@@ -7,20 +7,23 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
 
 	"golang.org/x/term"
 
 	"internal/common"
 	"internal/logging"
+	"internal/pb"
 	"internal/version"
 )
 
 var (
 	addr         = flag.String("addr", "localhost:5510", "the address to connect to")
 	clientName   = flag.String("name", "", "the name of the client")
-	downloadUrl  = flag.String("url", "", "URL to download from")
 	output       = flag.String("output", "", "output file name")
 	servicePort  = flag.Int("port", 5510, "the port to listen on")
+	stateFile    = flag.String("state-file", "", "agent mode: the file the identity of the agent is kept in (default: ~/workspace_ddson/agent-PORT.id)")
+	slots        = flag.Int("slots", 1, "agent mode: the number of chunks the agent downloads at the same time, with --set-agent-slots: the new number for the agent (default: 1)")
 	debug        = flag.Bool("debug", false, "enable debug mode (default: false)")
 	verbose      = flag.Bool("verbose", false, "enable verbose logging (default: false)")
 	sha256       = flag.String("sha256", "", "SHA256 checksum of the file to download (optional, for verification)")
@@ -29,8 +32,27 @@ var (
 	stopDaemon   = flag.Bool("stop", false, "stop the daemon process (default: false)")
 	printVersion = flag.Bool("version", false, "print version information and exit")
 	logfile      = flag.String("logfile", "", "the log file to write logs to (default: empty)")
+	cancelTask   = flag.Int("cancel", -1, "cancel the download task with the given ID on the server. An admin of the server cancels it for everyone, see --admin-token, others only cancel their own request and the task goes on for its other requesters")
+	attachTask   = flag.Int("attach", 0, "reattach to the download task with the given ID on the server")
+	promoteTask  = flag.Int("promote", -1, "move the pending task with the given ID to the front of the queue on the server")
+	adminToken   = flag.String("admin-token", os.Getenv("DDSON_ADMIN_TOKEN"), "the admin token of the server, needed by --promote, --cancel of the tasks of others and the agent controls from another host than the server (default: $DDSON_ADMIN_TOKEN)")
+	drainAgent   = flag.Int("drain-agent", -1, "stop giving downloads to the agent with the given ID, it leaves once its downloads are done")
+	stopAgent    = flag.Int("shutdown-agent", -1, "make the agent with the given ID abort its downloads and exit")
+	resizeAgent  = flag.Int("set-agent-slots", -1, "change the number of chunks the agent with the given ID downloads at the same time to --slots")
+	priority     = flag.String("priority", "normal", "priority of the download: low, normal or high")
+	manifest     = flag.String("manifest", "", "download the files listed in the manifest as one batch, one \"URL [OUTPUT [SHA256]]\" or sha256sum line per file")
+	baseUrl      = flag.String("base-url", "", "URL the names of sha256sum lines in the manifest are relative to")
+	report       = flag.String("report", "", "the file to write the result of every file of the manifest to (default: MANIFEST.report.json)")
 )
 
+// --url and --mirror can be repeated, the first URL is the URL of the file and all the others are its mirrors
+var downloadUrls, mirrorUrls stringList
+
+func init() {
+	flag.Var(&downloadUrls, "url", "URL to download from, repeat it to add mirrors of the same file")
+	flag.Var(&mirrorUrls, "mirror", "another URL of the same file, the chunks are downloaded from all of them (repeatable)")
+}
+
 const (
 	pidfile        = "/var/run/ddson.pid"
 	defaultLogfile = "/var/log/ddson.log"
@@ -63,6 +85,15 @@ func main() {
 	logger = logging.NewCustomLogger(loglevel, useColor, *logfile)
 	slog.SetDefault(logger)
 
+	// the status command prints to stdout, it does not log its start so the output can be parsed
+	if flag.Arg(0) == "status" {
+		if err := doStatus(flag.Args()[1:]); err != nil {
+			slog.Error("Failed to get status", "server", *addr, "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	slog.Info("Starting ddson client", "args", os.Args, "version", version.VersionString)
 
 	switch {
@@ -84,11 +115,61 @@ func main() {
 		return
 	}
 
+	if *cancelTask >= 0 {
+		slog.Info("Cancelling task", "taskID", *cancelTask, "server", *addr)
+		err := doCancelTask(int32(*cancelTask))
+		if err != nil {
+			slog.Error("Failed to cancel task", "taskID", *cancelTask, "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *promoteTask >= 0 {
+		slog.Info("Promoting task", "taskID", *promoteTask, "server", *addr)
+		err := doPromoteTask(int32(*promoteTask))
+		if err != nil {
+			slog.Error("Failed to promote task", "taskID", *promoteTask, "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *drainAgent >= 0 || *stopAgent >= 0 || *resizeAgent >= 0 {
+		agentID, action := int32(*drainAgent), pb.AgentAction_AGENT_DRAIN
+		if *stopAgent >= 0 {
+			agentID, action = int32(*stopAgent), pb.AgentAction_AGENT_SHUTDOWN
+		} else if *resizeAgent >= 0 {
+			agentID, action = int32(*resizeAgent), pb.AgentAction_AGENT_SET_SLOTS
+		}
+		slog.Info("Controlling agent", "agentID", agentID, "action", action, "server", *addr)
+		err := doControlAgent(agentID, action, int32(*slots))
+		if err != nil {
+			slog.Error("Failed to control agent", "agentID", agentID, "action", action, "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	downloadUrl, mirrors := sourceUrls()
+
 	// TODO: include both mode in the same process
-	if *downloadUrl != "" {
+	if *manifest != "" {
+		// batch mode, --output is the directory of the files
+		downloadManifest(*manifest, *baseUrl, *output, *report)
+
+	} else if *attachTask > 0 && downloadUrl == "" {
+		// reattach mode, the server knows the URL of the task
+		if *output == "" {
+			*output = fmt.Sprintf("ddson_task_%d", *attachTask)
+		}
+		slog.Info("Reattaching to task", "taskID", *attachTask, "to", *output)
+		download("", nil)
+
+	} else if downloadUrl != "" {
 		// downloader mode
 		if *output == "" {
-			parsedURL, err := url.Parse(*downloadUrl)
+			parsedURL, err := url.Parse(downloadUrl)
 			if err != nil {
 				slog.Error("failed to parse URL", "error", err)
 				os.Exit(1)
@@ -99,8 +180,8 @@ func main() {
 			slog.Debug("Extracted file name from URL", "fileName", *output)
 		}
 
-		slog.Info("Downloading", "from", *downloadUrl, "to", *output)
-		download()
+		slog.Info("Downloading", "from", downloadUrl, "mirrors", mirrors, "to", *output)
+		download(downloadUrl, mirrors)
 
 	} else {
 
@@ -145,3 +226,34 @@ func doDaemonize(force bool) error {
 	slog.Info("Daemon process started successfully", "pidfile", pidfile, "logfile", logfile)
 	return nil
 }
+
+// stringList is a flag that can be repeated, it collects all the values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// sourceUrls returns the URL of the file to download, and its mirrors.
+func sourceUrls() (string, []string) {
+	urls := append(append([]string{}, downloadUrls...), mirrorUrls...)
+	if len(urls) == 0 {
+		return "", nil
+	}
+	return urls[0], urls[1:]
+}
+
+// downloadPriority returns the priority given by --priority.
+func downloadPriority() pb.Priority {
+	value, ok := pb.Priority_value["PRIORITY_"+strings.ToUpper(*priority)]
+	if !ok {
+		slog.Error("Invalid priority, expected low, normal or high", "priority", *priority)
+		os.Exit(1)
+	}
+	return pb.Priority(value)
+}
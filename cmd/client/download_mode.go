@@ -6,6 +6,9 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -16,15 +19,23 @@ import (
 	"internal/progressbar"
 )
 
-func download() {
-	supportPartialDownload, totalSize, err := httputil.CheckPartialDownloadSupport(*downloadUrl)
-	if err != nil {
-		slog.Error("Failed to check partial download support", "error", err)
-		os.Exit(1)
-	}
-	if !supportPartialDownload {
-		slog.Error("Server does not support partial downloads, please use other tools")
-		os.Exit(1)
+// download downloads the file from downloadUrl and its mirrors through the server,
+// or reattaches to the task given by --attach when downloadUrl is empty.
+func download(downloadUrl string, mirrors []string) {
+	// when reattaching to a task, or when the origin does not send the size, the size is reported by the server
+	var totalSize int64
+	if downloadUrl != "" {
+		supportPartialDownload, size, err := httputil.CheckPartialDownloadSupport(downloadUrl)
+		if err != nil {
+			slog.Error("Failed to check partial download support", "error", err)
+			os.Exit(1)
+		}
+		if !supportPartialDownload {
+			slog.Warn("Server does not support partial downloads, the file is downloaded by a single agent")
+		}
+		if size > 0 {
+			totalSize = size
+		}
 	}
 
 	// Establish a connection to the server
@@ -40,12 +51,16 @@ func download() {
 	// Create a DownloadRequest
 	req := &pb.DownloadRequest{
 		ClientId: int32(0), // TODO: currently client id is ignored. later will be used to identify the client
-		Url:      *downloadUrl,
+		Url:      downloadUrl,
+		Mirrors:  mirrors,
 		Checksum: *sha256,
+		TaskId:   int32(*attachTask),
+		Priority: downloadPriority(),
 	}
 
 	// Send the request and receive the stream
-	ctx, cancel := context.WithCancel(context.Background())
+	// on Ctrl-C the stream is closed, and the server cancels the task if nobody else is waiting for it
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	stream, err := client.Download(ctx, req)
@@ -54,12 +69,13 @@ func download() {
 		os.Exit(1)
 	}
 
-	// Open the output file
-	var file *os.File = nil
 	var received int64 = 0
 	var resp *pb.DownloadStatus
+	// the server streams the beginning of the file while it is still downloading the rest,
+	// the last download status is kept to show both
+	var downloading *pb.DownloadStatus
 	bottomLineFunc := func(percentage float64, width int) string {
-		return fmtProgress(resp, totalSize)
+		return fmtProgress(resp, downloading, totalSize, received)
 	}
 	progressBar, err := progressbar.New(progressbar.Basketball(), os.Stdout, bottomLineFunc)
 	if err != nil {
@@ -70,55 +86,100 @@ func download() {
 	}
 
 	// Process the responses from the server
+	received, err = receiveFile(stream, *output, func(status *pb.DownloadStatus, n int64) {
+		resp, received = status, n
+		if status.GetRestarted() {
+			totalSize = 0
+		}
+		if totalSize == 0 && status.GetTotalSize() > 0 {
+			totalSize = status.GetTotalSize()
+		}
+		if status.GetStatus() == pb.DownloadStatusType_DOWNLOADING {
+			downloading = status
+		}
+		printProgress(resp, downloading, totalSize, received, progressBar)
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			slog.Warn("Download interrupted, incomplete file removed", "file", *output)
+		} else {
+			slog.Error("Error receiving data, incomplete file removed", "file", *output, "error", err)
+		}
+		os.Exit(1)
+	}
+	if progressBar != nil {
+		progressBar.Update(1.0)
+	}
+
+	slog.Info("Download completed", "file", *output, "size", common.PrettyFormatSize(received))
+}
+
+// receiveFile writes the file streamed by the server to output, until the server closes the stream.
+// onStatus is called with every status received, and the number of bytes written so far.
+// The output file is created with the first status, and removed if the transfer fails.
+func receiveFile(stream pb.DDSONService_DownloadClient, output string, onStatus func(*pb.DownloadStatus, int64)) (int64, error) {
+	var file *os.File
+	var received int64
+	fail := func(err error) (int64, error) {
+		if file != nil {
+			file.Close()
+			os.Remove(output)
+		}
+		return received, err
+	}
+
 	for {
-		resp, err = stream.Recv()
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
 
 		// Create file after receiving the first response
-		if file == nil && err == nil {
-			file, err = os.Create(*output)
+		if file == nil {
+			file, err = os.Create(output)
 			if err != nil {
-				slog.Error("Failed to create output file", "error", err)
-				os.Exit(1)
+				return fail(fmt.Errorf("creating output file: %w", err))
 			}
-			defer file.Close()
 		}
 
-		if err != nil {
-			if err == io.EOF {
-				if progressBar != nil {
-					progressBar.Update(1.0)
-				} else {
-					slog.Info("Download completed")
-				}
-				break
+		if resp.GetRestarted() {
+			// the file changed on the origin while it was transferred, the server sends the new one from the start
+			slog.Warn("File changed on the origin, the download restarts", "file", output, "discarded", common.PrettyFormatSize(received))
+			if err := file.Truncate(0); err != nil {
+				return fail(fmt.Errorf("truncating output file: %w", err))
 			}
-			slog.Error("Error receiving data", "error", err)
-			os.Exit(1)
-		}
-
-		printProgress(resp, totalSize, progressBar)
-		switch resp.GetStatus() {
-		case pb.DownloadStatusType_DOWNLOADING:
-			if progressBar != nil {
-				progressBar.Update(float64(resp.GetTotalDownloadedBytes()) / float64(totalSize))
-			} else {
-				slog.Info(fmtProgress(resp, totalSize))
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return fail(fmt.Errorf("rewinding output file: %w", err))
 			}
-
-		case pb.DownloadStatusType_TRANSFERRING:
+			received = 0
+		}
+		if resp.GetStatus() == pb.DownloadStatusType_TRANSFERRING {
 			// Write data to the file
 			if _, err := file.Write(resp.GetData()); err != nil {
-				slog.Error("Failed to write data to file", "error", err)
-				os.Exit(1)
+				return fail(fmt.Errorf("writing output file: %w", err))
 			}
 			received += int64(len(resp.GetData()))
 		}
+		if resp.GetStatus() == pb.DownloadStatusType_PENDING && resp.GetTaskId() != 0 {
+			slog.Debug("Task status", "file", output, "taskID", resp.GetTaskId(), "message", resp.GetMessage())
+		}
+		onStatus(resp, received)
 	}
 
-	slog.Info("Download completed", "file", *output, "size", common.PrettyFormatSize(received))
+	if file == nil {
+		return received, nil
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(output)
+		return received, fmt.Errorf("closing output file: %w", err)
+	}
+	return received, nil
 }
 
-func printProgress(resp *pb.DownloadStatus, totalSize int64, progressBar *progressbar.ProgressBar) {
+func printProgress(resp *pb.DownloadStatus, downloading *pb.DownloadStatus, totalSize int64, received int64, progressBar *progressbar.ProgressBar) {
 	if resp == nil {
 		return
 	}
@@ -130,44 +191,84 @@ func printProgress(resp *pb.DownloadStatus, totalSize int64, progressBar *progre
 	case pb.DownloadStatusType_VALIDATING:
 		progress = 1.0
 	case pb.DownloadStatusType_TRANSFERRING:
-		progress = 1.0
+		if totalSize > 0 {
+			progress = float64(received) / float64(totalSize)
+		}
 	case pb.DownloadStatusType_DOWNLOADING:
-		progress = float64(resp.GetTotalDownloadedBytes()) / float64(totalSize)
+		// once the transfer has started, the bar follows it instead of the download
+		if totalSize > 0 && received > 0 {
+			progress = float64(received) / float64(totalSize)
+		} else if totalSize > 0 {
+			progress = float64(resp.GetTotalDownloadedBytes()) / float64(totalSize)
+		}
 	}
 
 	if progressBar != nil {
 		progressBar.Update(progress)
 	} else {
-		slog.Info(fmtProgress(resp, totalSize))
+		slog.Info(fmtProgress(resp, downloading, totalSize, received))
 	}
 }
 
-func fmtProgress(resp *pb.DownloadStatus, totalSize int64) string {
+func fmtProgress(resp *pb.DownloadStatus, downloading *pb.DownloadStatus, totalSize int64, received int64) string {
 	if resp == nil {
 		return "..."
 	}
 
 	switch resp.GetStatus() {
 	case pb.DownloadStatusType_PENDING:
-		return fmt.Sprintf("Pending... %d in queue, %d clients connected, message: %s", resp.GetNumberInQueue(), resp.GetClientCount(), resp.GetMessage())
+		return fmtPending(resp)
 
 	case pb.DownloadStatusType_VALIDATING:
 		return "Validating..."
 
 	case pb.DownloadStatusType_TRANSFERRING:
-		return fmt.Sprintf("Transferring... %s/%s", common.PrettyFormatSize(resp.GetTotalDownloadedBytes()), common.PrettyFormatSize(totalSize))
+		transferring := fmt.Sprintf("Transferring... %s/%s", common.PrettyFormatSize(received), common.PrettyFormatSize(totalSize))
+		if downloading != nil && downloading.GetTotalDownloadedBytes() < totalSize {
+			// the server is still downloading the rest of the file
+			return fmt.Sprintf("%s, downloaded: %s, speed: %s", transferring, common.PrettyFormatSize(downloading.GetTotalDownloadedBytes()), common.PrettyFormatSpeed(int(downloading.GetSpeed())))
+		}
+		return transferring
 
 	case pb.DownloadStatusType_DOWNLOADING:
 		downloadedBytes := resp.GetTotalDownloadedBytes()
 		downloadedBytesStr := common.PrettyFormatSize(downloadedBytes)
 		totalSizeStr := common.PrettyFormatSize(totalSize)
 		speed := common.PrettyFormatSpeed(int(resp.GetSpeed()))
+		if totalSize <= 0 {
+			// the size is not known before the download completes
+			return fmt.Sprintf("Downloading... %s, speed: %s", downloadedBytesStr, speed)
+		}
 		eta := common.PrettyFormatDuration(totalSize-downloadedBytes, resp.GetSpeed())
 		percentage :=
 			fmt.Sprintf("%.2f%%", float64(downloadedBytes)/float64(totalSize)*100)
+		if received > 0 {
+			return fmt.Sprintf("Downloading... [%s] %s/%s, speed: %s, ETA: %s, transferred: %s", percentage, downloadedBytesStr, totalSizeStr, speed, eta, common.PrettyFormatSize(received))
+		}
 		return fmt.Sprintf("Downloading... [%s] %s/%s, speed: %s, ETA: %s", percentage, downloadedBytesStr, totalSizeStr, speed, eta)
 
 	default:
 		return fmt.Sprintf("Status: %s", resp.GetStatus().String())
 	}
 }
+
+// fmtPending formats the position of the task in the queue, and when it is expected to start.
+func fmtPending(resp *pb.DownloadStatus) string {
+	pending := "Pending..."
+	if resp.GetTaskId() != 0 {
+		pending = fmt.Sprintf("Pending... task #%d", resp.GetTaskId())
+	}
+	if position := resp.GetNumberInQueue(); position > 0 {
+		pending = fmt.Sprintf("%s, position %d in queue", pending, position)
+		if wait := resp.GetEstimatedWaitSeconds(); wait > 0 {
+			pending = fmt.Sprintf("%s, starts in ~%s", pending, time.Duration(wait)*time.Second)
+		}
+	} else if resp.GetTaskId() != 0 {
+		pending += ", starting"
+	}
+	pending = fmt.Sprintf("%s, %d agents connected", pending, resp.GetClientCount())
+	if resp.GetMessage() != "" {
+		pending = fmt.Sprintf("%s, message: %s", pending, resp.GetMessage())
+	}
+	return pending
+}
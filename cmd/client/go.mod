@@ -17,6 +17,7 @@ replace internal/progressbar => ../../internal/progressbar
 require (
 	golang.org/x/term v0.32.0
 	google.golang.org/grpc v1.72.1
+	google.golang.org/protobuf v1.36.6
 	internal/common v0.0.0
 	internal/httputil v0.0.0
 	internal/logging v0.0.0-00010101000000-000000000000
@@ -31,6 +32,5 @@ require (
 	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250218202821-56aae31c358a // indirect
-	google.golang.org/protobuf v1.36.6 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 )
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"internal/common"
+	"internal/pb"
+	"internal/progressbar"
+)
+
+// manifestEntry is a file listed in a manifest.
+type manifestEntry struct {
+	url      string
+	output   string
+	checksum string // empty if the manifest gives none
+}
+
+// parseManifest reads the files of a manifest, one per line, in one of two forms:
+//
+//	URL [OUTPUT [SHA256]]
+//	SHA256  NAME
+//
+// The second form is the output of sha256sum, the URL of NAME is resolved against baseUrl.
+// Without OUTPUT, the file is named after the last element of the URL.
+// Outputs are relative paths, absolute ones and ones leaving the directory with .. are rejected.
+// Empty lines and lines starting with # are skipped.
+func parseManifest(r io.Reader, baseUrl string) ([]manifestEntry, error) {
+	entries := make([]manifestEntry, 0)
+	outputs := make(map[string]int)
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var entry manifestEntry
+		fields := strings.Fields(line)
+		if isSha256(fields[0]) && len(fields) >= 2 {
+			// sha256sum: the name starts after two separators, " *" for files read in binary mode
+			name := strings.TrimPrefix(strings.TrimLeft(line[64:], " \t"), "*")
+			if baseUrl == "" {
+				return nil, fmt.Errorf("line %d: a sha256sum line needs a base URL to download %s from", lineNumber, name)
+			}
+			fileUrl, err := url.JoinPath(baseUrl, name)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			entry = manifestEntry{url: fileUrl, output: name, checksum: strings.ToLower(fields[0])}
+		} else {
+			if len(fields) > 3 {
+				return nil, fmt.Errorf("line %d: expected URL [OUTPUT [SHA256]], got %d fields", lineNumber, len(fields))
+			}
+			entry.url = fields[0]
+			parsedUrl, err := url.Parse(entry.url)
+			if err != nil || parsedUrl.Scheme == "" || parsedUrl.Host == "" {
+				return nil, fmt.Errorf("line %d: invalid URL %q", lineNumber, entry.url)
+			}
+			entry.output = path.Base(parsedUrl.Path)
+			if len(fields) >= 2 {
+				entry.output = fields[1]
+			}
+			if len(fields) == 3 {
+				if !isSha256(fields[2]) {
+					return nil, fmt.Errorf("line %d: invalid SHA256 checksum %q", lineNumber, fields[2])
+				}
+				entry.checksum = strings.ToLower(fields[2])
+			}
+		}
+
+		if entry.output == "" || entry.output == "." || entry.output == "/" {
+			return nil, fmt.Errorf("line %d: no output file name for %s", lineNumber, entry.url)
+		}
+		// the manifest may come from anywhere, its files stay inside the output directory
+		if !filepath.IsLocal(entry.output) {
+			return nil, fmt.Errorf("line %d: output %s is not a relative path inside the output directory", lineNumber, entry.output)
+		}
+		entry.output = filepath.Clean(entry.output)
+		if previous, exists := outputs[entry.output]; exists {
+			return nil, fmt.Errorf("line %d: %s is already the output of line %d", lineNumber, entry.output, previous)
+		}
+		outputs[entry.output] = lineNumber
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func isSha256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// batchResult is the outcome of one file of a batch, as written in the report.
+type batchResult struct {
+	URL      string `json:"url"`
+	Output   string `json:"output"`
+	SHA256   string `json:"sha256,omitempty"`
+	TaskID   int32  `json:"taskId,omitempty"`
+	Status   string `json:"status"` // "completed" or "failed"
+	Error    string `json:"error,omitempty"`
+	Size     int64  `json:"size"`
+	Duration string `json:"duration"`
+}
+
+type batchReport struct {
+	BatchID  string        `json:"batchId"`
+	Manifest string        `json:"manifest"`
+	Files    []batchResult `json:"files"`
+}
+
+// downloadManifest downloads all the files of the manifest as one batch.
+// Output paths are relative to outputDir, if it is not empty.
+// A report with the result of every file is written to reportPath, the process fails if any file failed.
+func downloadManifest(manifestPath string, baseUrl string, outputDir string, reportPath string) {
+	manifestFile, err := os.Open(manifestPath)
+	if err != nil {
+		slog.Error("Failed to open manifest", "error", err)
+		os.Exit(1)
+	}
+	entries, err := parseManifest(manifestFile, baseUrl)
+	manifestFile.Close()
+	if err != nil {
+		slog.Error("Failed to parse manifest", "manifest", manifestPath, "error", err)
+		os.Exit(1)
+	}
+	if len(entries) == 0 {
+		slog.Warn("No files in manifest", "manifest", manifestPath)
+		return
+	}
+	if outputDir != "" {
+		for i := range entries {
+			entries[i].output = filepath.Join(outputDir, entries[i].output)
+		}
+	}
+
+	// Establish a connection to the server
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		slog.Error("Failed to connect to server", "error", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	client := pb.NewDDSONServiceClient(conn)
+
+	// on Ctrl-C the streams are closed, and the server cancels the tasks nobody else is waiting for
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	batchId := newBatchId()
+	priority := downloadPriority()
+	slog.Info("Downloading batch", "batchID", batchId, "manifest", manifestPath, "files", len(entries))
+
+	progress := newBatchProgress(len(entries))
+	progressBar, err := progressbar.New(progressbar.Basketball(), os.Stdout, func(percentage float64, width int) string {
+		return progress.String()
+	})
+	if err != nil {
+		slog.Error("Failed to create progress bar", "error", err)
+	} else {
+		progressBar.Start()
+	}
+
+	// all files are submitted at once, the server schedules the batch as one unit
+	results := make([]batchResult, len(entries))
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = downloadEntry(ctx, client, batchId, priority, entry, func(status *pb.DownloadStatus, received int64) {
+				progress.update(i, status, received)
+				if progressBar != nil {
+					progressBar.Update(progress.fraction())
+				}
+			})
+			progress.finish(i, results[i].Status == "completed")
+		}()
+	}
+	wg.Wait()
+	if progressBar != nil {
+		progressBar.Update(progress.fraction())
+		progressBar.Done()
+	}
+
+	if reportPath == "" {
+		reportPath = manifestPath + ".report.json"
+	}
+	if err := writeReport(reportPath, batchReport{BatchID: batchId, Manifest: manifestPath, Files: results}); err != nil {
+		slog.Error("Failed to write report", "report", reportPath, "error", err)
+	} else {
+		slog.Info("Report written", "report", reportPath)
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Status != "completed" {
+			failed++
+			slog.Error("File failed", "url", result.URL, "output", result.Output, "error", result.Error)
+		}
+	}
+	if failed > 0 {
+		slog.Error("Batch failed", "batchID", batchId, "failed", failed, "files", len(results))
+		os.Exit(1)
+	}
+	slog.Info("Batch completed", "batchID", batchId, "files", len(results))
+}
+
+// downloadEntry downloads one file of the batch.
+func downloadEntry(ctx context.Context, client pb.DDSONServiceClient, batchId string, priority pb.Priority, entry manifestEntry, onStatus func(*pb.DownloadStatus, int64)) (result batchResult) {
+	startTime := time.Now()
+	result = batchResult{URL: entry.url, Output: entry.output, SHA256: entry.checksum, Status: "failed"}
+	defer func() {
+		result.Duration = time.Since(startTime).Round(time.Millisecond).String()
+	}()
+
+	if dir := filepath.Dir(entry.output); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	stream, err := client.Download(ctx, &pb.DownloadRequest{
+		Url:      entry.url,
+		Checksum: entry.checksum,
+		BatchId:  batchId,
+		Priority: priority,
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	received, err := receiveFile(stream, entry.output, func(status *pb.DownloadStatus, received int64) {
+		if status.GetTaskId() != 0 {
+			result.TaskID = status.GetTaskId()
+		}
+		onStatus(status, received)
+	})
+	result.Size = received
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = "completed"
+	slog.Debug("File downloaded", "url", entry.url, "output", entry.output, "size", common.PrettyFormatSize(received))
+	return result
+}
+
+func writeReport(reportPath string, report batchReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(reportPath, append(data, '\n'), 0644)
+}
+
+func newBatchId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// batchProgress aggregates the progress of the files of a batch for one progress bar.
+// It is updated from the goroutines of the files, and read by the progress bar.
+type batchProgress struct {
+	mtx   sync.Mutex
+	files []fileProgress
+}
+
+type fileProgress struct {
+	totalSize  int64 // 0 until the server reports it
+	received   int64
+	downloaded int64 // bytes downloaded by the agents, as reported by the last DOWNLOADING status
+	speed      int32 // download speed of the last DOWNLOADING status
+	finished   bool
+	failed     bool
+}
+
+func newBatchProgress(count int) *batchProgress {
+	return &batchProgress{files: make([]fileProgress, count)}
+}
+
+func (p *batchProgress) update(i int, status *pb.DownloadStatus, received int64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	file := &p.files[i]
+	file.received = received
+	if status.GetTotalSize() > 0 {
+		file.totalSize = status.GetTotalSize()
+	}
+	if status.GetStatus() == pb.DownloadStatusType_DOWNLOADING {
+		file.downloaded = status.GetTotalDownloadedBytes()
+		file.speed = status.GetSpeed()
+	}
+}
+
+func (p *batchProgress) finish(i int, completed bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.files[i].finished = true
+	p.files[i].failed = !completed
+	p.files[i].speed = 0
+}
+
+// fraction returns the part of the known size of the batch that is transferred.
+func (p *batchProgress) fraction() float64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	var received, totalSize int64
+	for _, file := range p.files {
+		received += file.received
+		totalSize += max(file.totalSize, file.received)
+	}
+	if totalSize == 0 {
+		return 0
+	}
+	return float64(received) / float64(totalSize)
+}
+
+func (p *batchProgress) String() string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	var completed, failed int
+	var received, totalSize, downloaded int64
+	var speed int
+	for _, file := range p.files {
+		if file.finished && file.failed {
+			failed++
+		} else if file.finished {
+			completed++
+		}
+		received += file.received
+		totalSize += max(file.totalSize, file.received)
+		downloaded += max(file.downloaded, file.received)
+		if !file.finished {
+			speed += int(file.speed)
+		}
+	}
+	return fmt.Sprintf("Batch: %d/%d files completed, %d failed, downloaded: %s, transferred: %s/%s, speed: %s",
+		completed, len(p.files), failed,
+		common.PrettyFormatSize(downloaded), common.PrettyFormatSize(received), common.PrettyFormatSize(totalSize),
+		common.PrettyFormatSpeed(speed))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const sum = "d56846f924aa48365eecfb3dac3b228494f42c959e620f167cbf0d37b12df1d0"
+
+func TestParseManifest(t *testing.T) {
+	manifest := `
+# toolchains
+https://example.com/dl/go.tar.gz
+https://example.com/dl/node.tar.xz node/node.tar.xz
+https://example.com/dl/jdk.zip jdk.zip ` + strings.ToUpper(sum) + `
+` + sum + `  cmake.sh
+` + sum + ` *tools/ninja linux.zip
+`
+	entries, err := parseManifest(strings.NewReader(manifest), "https://mirror.example.com/releases/")
+	if err != nil {
+		t.Fatalf("parseManifest: %v", err)
+	}
+
+	want := []manifestEntry{
+		{url: "https://example.com/dl/go.tar.gz", output: "go.tar.gz"},
+		{url: "https://example.com/dl/node.tar.xz", output: "node/node.tar.xz"},
+		{url: "https://example.com/dl/jdk.zip", output: "jdk.zip", checksum: sum},
+		{url: "https://mirror.example.com/releases/cmake.sh", output: "cmake.sh", checksum: sum},
+		{url: "https://mirror.example.com/releases/tools/ninja%20linux.zip", output: "tools/ninja linux.zip", checksum: sum},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry #%d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestParseManifestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		baseUrl  string
+	}{
+		{"no base URL", sum + "  cmake.sh", ""},
+		{"not a URL", "cmake.sh", ""},
+		{"bad checksum", "https://example.com/a.zip a.zip 1234", ""},
+		{"too many fields", "https://example.com/a.zip a.zip " + sum + " extra", ""},
+		{"duplicate output", "https://example.com/a.zip\nhttps://example.org/a.zip", ""},
+		{"no file name", "https://example.com/", ""},
+		{"absolute output", "https://example.com/a.zip /etc/a.zip", ""},
+		{"output outside the directory", "https://example.com/a.zip tools/../../a.zip", ""},
+		{"sha256sum name outside the directory", sum + "  ../a.zip", "https://example.com/"},
+		{"duplicate cleaned output", "https://example.com/a.zip tools/a.zip\nhttps://example.org/a.zip tools/./a.zip", ""},
+	}
+	for _, test := range tests {
+		if _, err := parseManifest(strings.NewReader(test.manifest), test.baseUrl); err == nil {
+			t.Errorf("%s: parseManifest succeeded, want an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"internal/common"
+	"internal/pb"
+)
+
+// doStatus implements the status command:
+//
+//	ddson_client [--addr ADDR] status [--json] [--task ID]
+//
+// It prints the queue, the agents and the aggregate throughput of the server,
+// or a single task with its subtasks.
+func doStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "print the status as JSON")
+	taskID := flags.Int("task", 0, "print the task with the given ID and its subtasks")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	conn, err := grpc.NewClient(*addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer conn.Close()
+
+	client := pb.NewDDSONServiceClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if *taskID > 0 {
+		task, err := client.GetTask(ctx, &pb.GetTaskRequest{TaskId: int32(*taskID)})
+		if err != nil {
+			return err
+		}
+		if *asJson {
+			return printJson(map[string]proto.Message{"task": task})
+		}
+		printTask(os.Stdout, task)
+		return nil
+	}
+
+	serverStatus, err := client.GetServerStatus(ctx, &pb.GetServerStatusRequest{})
+	if err != nil {
+		return err
+	}
+	tasks, err := client.ListTasks(ctx, &pb.ListTasksRequest{})
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		return printJson(map[string]proto.Message{"server": serverStatus, "tasks": tasks})
+	}
+	printServerStatus(os.Stdout, serverStatus, tasks.GetTasks())
+	return nil
+}
+
+// printJson prints the messages as one JSON object, each under its name.
+func printJson(messages map[string]proto.Message) error {
+	object := make(map[string]json.RawMessage)
+	for name, message := range messages {
+		data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(message)
+		if err != nil {
+			return err
+		}
+		object[name] = data
+	}
+	data, err := json.MarshalIndent(object, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func printServerStatus(w io.Writer, status *pb.ServerStatus, tasks []*pb.TaskStatus) {
+	fmt.Fprintf(w, "Server %s: %d pending, %d running, speed: %s, remaining: ~%s, known size: %s, estimated wait: %s, agent strategy: %s\n",
+		status.GetVersion(), status.GetPendingTasks(), status.GetRunningTasks(),
+		common.PrettyFormatSpeed(int(status.GetSpeed())),
+		common.PrettyFormatSize(status.GetRemainingBytes()), common.PrettyFormatSize(status.GetTotalSize()),
+		formatWait(status.GetEstimatedWaitSeconds()), status.GetAgentStrategy())
+
+	fmt.Fprintln(w)
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TASK\tSTATE\tQUEUE\tPRIORITY\tREQUESTER\tPROGRESS\tSPEED\tURL")
+	for _, task := range tasks {
+		queue := "-"
+		if task.GetQueuePosition() > 0 {
+			queue = fmt.Sprint(task.GetQueuePosition())
+		}
+		if task.GetPromoted() {
+			queue += " (promoted)"
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			task.GetId(), task.GetState(), queue, task.GetPriority(), task.GetRequester(),
+			formatProgress(task.GetDownloadedBytes(), task.GetTotalSize()),
+			common.PrettyFormatSpeed(int(task.GetSpeed())), task.GetUrl())
+	}
+	table.Flush()
+
+	fmt.Fprintln(w)
+	table = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "AGENT\tNAME\tADDR\tSTATE\tSLOTS\tERRORS\tTHROUGHPUT\tFIRST BYTE\tHEALTH\tVERSION")
+	for _, agent := range status.GetAgents() {
+		state := agent.GetState()
+		if agent.GetBannedUntil() > 0 {
+			state += " until " + time.Unix(agent.GetBannedUntil(), 0).Format(time.TimeOnly)
+		}
+		slots := "-"
+		if agent.GetSlots() > 0 {
+			slots = fmt.Sprintf("%d/%d", agent.GetRunning(), agent.GetSlots())
+		}
+		firstByte := "-"
+		if agent.GetFirstByteMs() > 0 {
+			firstByte = (time.Duration(agent.GetFirstByteMs()) * time.Millisecond).String()
+		}
+		health := "-"
+		if agent.GetBannedUntil() == 0 {
+			health = fmt.Sprintf("%.2f", agent.GetHealthScore())
+			if agent.GetRecentFailures() > 0 {
+				health += fmt.Sprintf(" (%d failed, %.0f%%)", agent.GetRecentFailures(), agent.GetErrorRate()*100)
+			}
+		}
+		fmt.Fprintf(table, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			agent.GetId(), agent.GetName(), agent.GetAddr(), state, slots, agent.GetErrorCount(),
+			common.PrettyFormatSpeed(int(agent.GetThroughput())), firstByte, health, agent.GetVersion())
+	}
+	table.Flush()
+}
+
+func printTask(w io.Writer, task *pb.TaskStatus) {
+	fmt.Fprintf(w, "Task %d: %s\n", task.GetId(), task.GetState())
+	fmt.Fprintf(w, "  URL:        %s\n", task.GetUrl())
+	for _, mirror := range task.GetMirrors() {
+		fmt.Fprintf(w, "  Mirror:     %s\n", mirror)
+	}
+	fmt.Fprintf(w, "  Requester:  %s (%d waiting)\n", task.GetRequester(), task.GetRequesters())
+	fmt.Fprintf(w, "  Priority:   %s\n", task.GetPriority())
+	if task.GetBatchId() != "" {
+		fmt.Fprintf(w, "  Batch:      %s\n", task.GetBatchId())
+	}
+	if task.GetChecksum() != "" {
+		fmt.Fprintf(w, "  SHA256:     %s\n", task.GetChecksum())
+	}
+	if task.GetQueuePosition() > 0 {
+		fmt.Fprintf(w, "  Queue:      %d\n", task.GetQueuePosition())
+	}
+	fmt.Fprintf(w, "  Downloaded: %s, assembled: %s, speed: %s\n",
+		formatProgress(task.GetDownloadedBytes(), task.GetTotalSize()),
+		common.PrettyFormatSize(task.GetAssembledBytes()),
+		common.PrettyFormatSpeed(int(task.GetSpeed())))
+	if task.GetError() != "" {
+		fmt.Fprintf(w, "  Error:      %s\n", task.GetError())
+	}
+	if len(task.GetSubtasks()) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w)
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SUBTASK\tOFFSET\tSIZE\tSTATE\tAGENT\tDOWNLOADED\tRETRIES")
+	for _, subtask := range task.GetSubtasks() {
+		agent := "-"
+		if subtask.GetAgentId() >= 0 {
+			agent = fmt.Sprint(subtask.GetAgentId())
+			if subtask.GetSpeculated() {
+				agent += " (+speculative)"
+			}
+		}
+		fmt.Fprintf(table, "%d\t%d\t%s\t%s\t%s\t%s\t%d\n",
+			subtask.GetId(), subtask.GetOffset(), common.PrettyFormatSize(subtask.GetSize()),
+			subtask.GetState(), agent, common.PrettyFormatSize(subtask.GetDownloadedBytes()), subtask.GetRetries())
+	}
+	table.Flush()
+}
+
+func formatProgress(downloaded int64, totalSize int64) string {
+	if totalSize <= 0 {
+		return common.PrettyFormatSize(downloaded)
+	}
+	return fmt.Sprintf("%s/%s (%.1f%%)", common.PrettyFormatSize(downloaded), common.PrettyFormatSize(totalSize),
+		float64(downloaded)*100/float64(totalSize))
+}
+
+func formatWait(seconds int64) string {
+	if seconds <= 0 {
+		return "N/A"
+	}
+	return (time.Duration(seconds) * time.Second).String()
+}
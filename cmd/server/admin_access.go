@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ADMIN_TOKEN_METADATA is the gRPC metadata key clients send the admin token in.
+const ADMIN_TOKEN_METADATA = "ddson-admin-token"
+
+// authorizeAdmin checks that the caller may change the queue or the agents for everyone.
+// Callers on the host of the server are trusted, others must send the admin token of the server.
+// Without an admin token, only the host of the server is trusted.
+func (s *server) authorizeAdmin(ctx context.Context) error {
+	if isLoopbackCaller(ctx) {
+		return nil
+	}
+	if s.adminToken != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, token := range md.Get(ADMIN_TOKEN_METADATA) {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+				return nil
+			}
+		}
+	}
+	return status.Errorf(codes.PermissionDenied, "%s is not an admin of the server, run it on the server host or pass the admin token", requesterFromContext(ctx))
+}
+
+func isLoopbackCaller(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return false
+	}
+	ip := net.ParseIP(requesterHost(p.Addr.String()))
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizeAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		caller     string
+		adminToken string // admin token of the server
+		token      string // token sent by the caller
+		want       codes.Code
+	}{
+		{name: "server host", caller: "127.0.0.1:40000", want: codes.OK},
+		{name: "server host over IPv6", caller: "[::1]:40000", want: codes.OK},
+		{name: "other host", caller: "10.0.0.1:40000", want: codes.PermissionDenied},
+		{name: "other host with the token", caller: "10.0.0.1:40000", adminToken: "secret", token: "secret", want: codes.OK},
+		{name: "other host with another token", caller: "10.0.0.1:40000", adminToken: "secret", token: "guess", want: codes.PermissionDenied},
+		{name: "other host without the token", caller: "10.0.0.1:40000", adminToken: "secret", want: codes.PermissionDenied},
+		{name: "a token the server does not have", caller: "10.0.0.1:40000", token: "secret", want: codes.PermissionDenied},
+	}
+
+	for _, test := range tests {
+		addr, err := net.ResolveTCPAddr("tcp", test.caller)
+		if err != nil {
+			t.Fatalf("%s: ResolveTCPAddr: %v", test.name, err)
+		}
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+		if test.token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ADMIN_TOKEN_METADATA, test.token))
+		}
+		s := &server{adminToken: test.adminToken}
+		if got := status.Code(s.authorizeAdmin(ctx)); got != test.want {
+			t.Errorf("%s: authorizeAdmin = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
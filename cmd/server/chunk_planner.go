@@ -0,0 +1,102 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+)
+
+const (
+	MIN_CHUNK_SIZE   = int64(1 * 1024 * 1024)  // 1 MB
+	MAX_CHUNK_SIZE   = int64(64 * 1024 * 1024) // 64 MB
+	CHUNKS_PER_AGENT = 4                       // cut a file into at least this many chunks per agent, so every agent gets work
+	TAIL_SPLIT       = 4                       // chunks at the tail of a download are this many times smaller
+
+	// a chunk should take about this long on an agent of median throughput
+	TARGET_CHUNK_DURATION = 20 * time.Second
+)
+
+// chunkPlanner decides how the missing ranges of a file are cut into chunks.
+// Regular chunks are sized from the measured throughput of the agents, so a chunk takes about TARGET_CHUNK_DURATION.
+// The last round of chunks is cut smaller, so the tail of the download finishes at about the same time on all agents.
+type chunkPlanner struct {
+	chunkSize     int64 // size of regular chunks
+	tailChunkSize int64 // size of chunks at the tail of the download
+	tailSize      int64 // number of bytes at the tail of the download
+}
+
+// newChunkPlanner creates a planner for downloading remainingSize bytes with agentCount agents.
+// throughputs are the measured throughputs of the agents in bytes per second, 0 for agents not measured yet.
+func newChunkPlanner(remainingSize int64, agentCount int, throughputs []int) *chunkPlanner {
+	if agentCount < 1 {
+		agentCount = 1
+	}
+
+	chunkSize := CHUNK_SIZE
+	if median := medianThroughput(throughputs); median > 0 {
+		chunkSize = int64(median) * int64(TARGET_CHUNK_DURATION/time.Second)
+	}
+	if upper := remainingSize / int64(agentCount*CHUNKS_PER_AGENT); chunkSize > upper {
+		chunkSize = upper
+	}
+	chunkSize = min(max(chunkSize, MIN_CHUNK_SIZE), MAX_CHUNK_SIZE)
+
+	tailChunkSize := max(chunkSize/TAIL_SPLIT, MIN_CHUNK_SIZE)
+	tailSize := int64(0)
+	if tailChunkSize < chunkSize {
+		tailSize = int64(agentCount) * chunkSize
+	}
+
+	planner := &chunkPlanner{
+		chunkSize:     chunkSize,
+		tailChunkSize: tailChunkSize,
+		tailSize:      tailSize,
+	}
+	slog.Debug("Chunk planner created", "remainingSize", remainingSize, "agentCount", agentCount, "chunkSize", chunkSize, "tailChunkSize", tailChunkSize, "tailSize", tailSize)
+	return planner
+}
+
+// plan cuts the ranges, given as [offset, size] pairs sorted by offset, into chunks.
+func (p *chunkPlanner) plan(ranges [][2]int64) [][2]int64 {
+	remainingSize := int64(0)
+	for _, r := range ranges {
+		remainingSize += r[1]
+	}
+	// position in the remaining bytes where the tail starts
+	tailStart := max(remainingSize-p.tailSize, 0)
+
+	chunks := make([][2]int64, 0)
+	position := int64(0)
+	for _, r := range ranges {
+		offset, rangeEnd := r[0], r[0]+r[1]
+		for offset < rangeEnd {
+			size := p.chunkSize
+			if position >= tailStart {
+				size = p.tailChunkSize
+			} else if position+size > tailStart {
+				size = tailStart - position
+			}
+			size = min(size, rangeEnd-offset)
+
+			chunks = append(chunks, [2]int64{offset, size})
+			offset += size
+			position += size
+		}
+	}
+	return chunks
+}
+
+// medianThroughput returns the median of the measured throughputs, ignoring agents not measured yet.
+func medianThroughput(throughputs []int) int {
+	measured := make([]int, 0, len(throughputs))
+	for _, t := range throughputs {
+		if t > 0 {
+			measured = append(measured, t)
+		}
+	}
+	if len(measured) == 0 {
+		return 0
+	}
+	sort.Ints(measured)
+	return measured[len(measured)/2]
+}
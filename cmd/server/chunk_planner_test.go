@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func checkChunks(t *testing.T, ranges [][2]int64, chunks [][2]int64) {
+	t.Helper()
+	i := 0
+	for _, r := range ranges {
+		offset := r[0]
+		for offset < r[0]+r[1] {
+			if i >= len(chunks) {
+				t.Fatalf("range %v is not covered, missing offset %d", r, offset)
+			}
+			if chunks[i][0] != offset {
+				t.Fatalf("chunk #%d starts at %d, want %d", i, chunks[i][0], offset)
+			}
+			if chunks[i][1] <= 0 {
+				t.Fatalf("chunk #%d has size %d", i, chunks[i][1])
+			}
+			offset += chunks[i][1]
+			i++
+		}
+		if offset != r[0]+r[1] {
+			t.Fatalf("chunks exceed range %v, end at %d", r, offset)
+		}
+	}
+	if i != len(chunks) {
+		t.Fatalf("%d chunks outside of the ranges", len(chunks)-i)
+	}
+}
+
+func TestChunkPlannerCoversRanges(t *testing.T) {
+	ranges := [][2]int64{{0, 300 << 20}, {310 << 20, 5 << 20}, {400 << 20, 123456789}}
+	total := int64(0)
+	for _, r := range ranges {
+		total += r[1]
+	}
+
+	for _, agentCount := range []int{0, 1, 3, 20} {
+		planner := newChunkPlanner(total, agentCount, []int{0, 2 << 20, 4 << 20})
+		chunks := planner.plan(ranges)
+		checkChunks(t, ranges, chunks)
+
+		for i, chunk := range chunks {
+			if chunk[1] > MAX_CHUNK_SIZE {
+				t.Errorf("agents %d: chunk #%d is %d bytes, larger than %d", agentCount, i, chunk[1], MAX_CHUNK_SIZE)
+			}
+		}
+	}
+}
+
+func TestChunkPlannerSizes(t *testing.T) {
+	total := int64(1 << 30) // 1 GB
+
+	// unknown throughput: default chunk size
+	planner := newChunkPlanner(total, 2, []int{0, 0})
+	if planner.chunkSize != CHUNK_SIZE {
+		t.Errorf("chunk size is %d, want %d", planner.chunkSize, CHUNK_SIZE)
+	}
+
+	// 1 MB/s agents get 20 MB chunks
+	planner = newChunkPlanner(total, 2, []int{1 << 20, 1 << 20})
+	if planner.chunkSize != 20<<20 {
+		t.Errorf("chunk size is %d, want %d", planner.chunkSize, 20<<20)
+	}
+
+	// fast agents are capped
+	planner = newChunkPlanner(total, 2, []int{100 << 20})
+	if planner.chunkSize != MAX_CHUNK_SIZE {
+		t.Errorf("chunk size is %d, want %d", planner.chunkSize, MAX_CHUNK_SIZE)
+	}
+
+	// a small file is still spread over all agents
+	planner = newChunkPlanner(40<<20, 10, []int{1 << 20})
+	if planner.chunkSize != MIN_CHUNK_SIZE {
+		t.Errorf("chunk size is %d, want %d", planner.chunkSize, MIN_CHUNK_SIZE)
+	}
+
+	// the tail is cut into smaller chunks
+	planner = newChunkPlanner(total, 2, []int{1 << 20})
+	chunks := planner.plan([][2]int64{{0, total}})
+	last := chunks[len(chunks)-1]
+	if last[1] != planner.tailChunkSize || planner.tailChunkSize >= planner.chunkSize {
+		t.Errorf("last chunk is %d bytes, want %d (regular chunks are %d bytes)", last[1], planner.tailChunkSize, planner.chunkSize)
+	}
+}
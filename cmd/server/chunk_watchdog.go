@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// MIN_SPEED_WINDOW is the period over which the progress of a chunk is compared to the minimum speed.
+const MIN_SPEED_WINDOW = 15 * time.Second
+
+var (
+	errChunkTimeout = errors.New("chunk did not finish in time")
+	errChunkTooSlow = errors.New("chunk is downloaded slower than the minimum speed")
+)
+
+// chunkLimits are the limits every attempt to download a chunk must respect.
+// Zero values disable the limit.
+type chunkLimits struct {
+	timeout     time.Duration // hard deadline of one attempt
+	minSpeed    int64         // bytes per second, measured over speedWindow
+	speedWindow time.Duration // MIN_SPEED_WINDOW if zero
+}
+
+// chunkWatchdog aborts an attempt that violates the chunk limits, by cancelling its context.
+// It also measures the time to the first byte of the attempt, for the health record of the agent.
+type chunkWatchdog struct {
+	limits    chunkLimits
+	progress  atomic.Int64 // bytes downloaded by the agent plus bytes received from it, only the received ones for a whole file
+	started   time.Time
+	firstByte atomic.Int64 // nanoseconds from the start to the first progress, 0 until then
+	cancel    context.CancelCauseFunc
+}
+
+// watch returns a context that is cancelled when the attempt violates the limits,
+// the watchdog to report progress to, and a function to release both once the attempt is over.
+// context.Cause of the context is errChunkTimeout or errChunkTooSlow after a violation.
+func (limits chunkLimits) watch(ctx context.Context) (context.Context, *chunkWatchdog, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stopTimeout := context.CancelFunc(func() {})
+	if limits.timeout > 0 {
+		ctx, stopTimeout = context.WithTimeoutCause(ctx, limits.timeout, errChunkTimeout)
+	}
+
+	watchdog := &chunkWatchdog{limits: limits, started: time.Now(), cancel: cancel}
+	if limits.minSpeed > 0 {
+		go watchdog.run(ctx)
+	}
+	return ctx, watchdog, func() {
+		stopTimeout()
+		cancel(nil)
+	}
+}
+
+// setProgress records the bytes moved so far by the attempt.
+func (w *chunkWatchdog) setProgress(bytes int64) {
+	if bytes > 0 && w.firstByte.Load() == 0 {
+		w.firstByte.CompareAndSwap(0, int64(max(time.Since(w.started), 1)))
+	}
+	w.progress.Store(bytes)
+}
+
+// timeToFirstByte returns how long the attempt took to make progress, 0 if it made none.
+func (w *chunkWatchdog) timeToFirstByte() time.Duration {
+	return time.Duration(w.firstByte.Load())
+}
+
+func (w *chunkWatchdog) run(ctx context.Context) {
+	window := w.limits.speedWindow
+	if window <= 0 {
+		window = MIN_SPEED_WINDOW
+	}
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	minProgress := int64(float64(w.limits.minSpeed) * window.Seconds())
+	var lastProgress int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		progress := w.progress.Load()
+		if progress-lastProgress < minProgress {
+			slog.Warn("Chunk download too slow, aborting", "bytes", progress-lastProgress, "window", window, "minSpeed", w.limits.minSpeed)
+			w.cancel(fmt.Errorf("%w: %d bytes in %s", errChunkTooSlow, progress-lastProgress, window))
+			return
+		}
+		lastProgress = progress
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChunkWatchdog(t *testing.T) {
+	const window = 20 * time.Millisecond
+	tests := []struct {
+		name      string
+		limits    chunkLimits
+		progress  int64         // bytes reported every millisecond, 0 for none
+		reportFor time.Duration // how long the progress is reported
+		wait      time.Duration // how long the attempt runs
+		wantCause error         // nil if the attempt is not aborted
+	}{
+		{name: "no limits", wait: 100 * time.Millisecond},
+		{name: "timeout", limits: chunkLimits{timeout: 20 * time.Millisecond}, wait: time.Second, wantCause: errChunkTimeout},
+		{name: "timeout despite progress", limits: chunkLimits{timeout: 50 * time.Millisecond}, progress: 1000, reportFor: time.Second, wait: time.Second, wantCause: errChunkTimeout},
+		{name: "no progress", limits: chunkLimits{minSpeed: 1000, speedWindow: window}, wait: time.Second, wantCause: errChunkTooSlow},
+		{name: "slower than the minimum speed", limits: chunkLimits{minSpeed: 1000000, speedWindow: window}, progress: 10, reportFor: time.Second, wait: time.Second, wantCause: errChunkTooSlow},
+		{name: "progress keeps the attempt running", limits: chunkLimits{minSpeed: 1000, speedWindow: window}, progress: 10, reportFor: 150 * time.Millisecond, wait: 100 * time.Millisecond},
+		{name: "stalled after some progress", limits: chunkLimits{minSpeed: 1000, speedWindow: window}, progress: 10, reportFor: 50 * time.Millisecond, wait: time.Second, wantCause: errChunkTooSlow},
+	}
+
+	for _, test := range tests {
+		ctx, watchdog, stop := test.limits.watch(context.Background())
+		reported := make(chan struct{})
+		go func() {
+			defer close(reported)
+			if test.progress == 0 {
+				return
+			}
+			var bytes int64
+			for start := time.Now(); time.Since(start) < test.reportFor && ctx.Err() == nil; {
+				bytes += test.progress
+				watchdog.setProgress(bytes)
+				time.Sleep(time.Millisecond)
+			}
+		}()
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(test.wait):
+		}
+		cause := context.Cause(ctx)
+		stop()
+		<-reported
+
+		if test.wantCause == nil && cause != nil || test.wantCause != nil && !errors.Is(cause, test.wantCause) {
+			t.Errorf("%s: attempt aborted with %v, want %v", test.name, cause, test.wantCause)
+		}
+	}
+}
+
+func TestChunkWatchdogTimeToFirstByte(t *testing.T) {
+	_, watchdog, stop := chunkLimits{}.watch(context.Background())
+	defer stop()
+
+	watchdog.setProgress(0)
+	if got := watchdog.timeToFirstByte(); got != 0 {
+		t.Fatalf("time to first byte %s before any byte, want 0", got)
+	}
+	time.Sleep(10 * time.Millisecond)
+	watchdog.setProgress(100)
+	first := watchdog.timeToFirstByte()
+	if first < 10*time.Millisecond || first > time.Second {
+		t.Fatalf("time to first byte %s, want about 10ms", first)
+	}
+	time.Sleep(10 * time.Millisecond)
+	watchdog.setProgress(200)
+	if got := watchdog.timeToFirstByte(); got != first {
+		t.Fatalf("time to first byte %s after more progress, want %s", got, first)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"golang.org/x/term"
@@ -21,13 +22,20 @@ import (
 
 type server struct {
 	pb.UnimplementedDDSONServiceServer
-	agentList       agents.AgentList
-	taskList        *taskList
-	heartbeatTimers map[int]*time.Timer
-	persistency     *persistency.Persistency
+	agentList   agents.AgentList
+	taskList    *taskList
+	sessions    *agentSessions // sessions of the registered agents, to push commands to them
+	persistency *persistency.Persistency
+	chunkLimits chunkLimits // limits of every attempt to download a chunk
+	retryPolicy agents.RetryPolicy
+	throughput  *throughputMeter
+	throttle    *originThrottle // pauses the origin hosts that rate limit the downloads
+	hostLimiter *hostLimiter    // limits the concurrent connections to every origin host
+	staging     *stagingLocks   // one task at a time uses a staging directory
+	adminToken  string          // token of the callers allowed to promote tasks and control agents from other hosts, empty for none
 }
 
-func newServer() *server {
+func newServer(workers int, limits chunkLimits, policy agents.RetryPolicy, strategy agents.SelectionStrategy, hostLimits hostLimitRules, defaultHostLimit int, adminToken string) *server {
 	homeDir, err := common.OriginalUserHomeDir()
 	if err != nil {
 		slog.Error("failed to get original user home directory", "error", err)
@@ -41,10 +49,17 @@ func newServer() *server {
 	}
 
 	return &server{
-		agentList:       agents.NewAgentList(),
-		taskList:        newTaskList(),
-		heartbeatTimers: make(map[int]*time.Timer),
-		persistency:     p,
+		agentList:   agents.NewAgentList(policy, strategy),
+		taskList:    newTaskList(workers, p),
+		sessions:    newAgentSessions(),
+		persistency: p,
+		chunkLimits: limits,
+		retryPolicy: policy,
+		throttle:    newOriginThrottle(policy),
+		hostLimiter: newHostLimiter(hostLimits, defaultHostLimit, p),
+		throughput:  newThroughputMeter(THROUGHPUT_WINDOW),
+		staging:     newStagingLocks(),
+		adminToken:  adminToken,
 	}
 }
 
@@ -52,6 +67,21 @@ func main() {
 	debug := flag.Bool("debug", false, "enable debug mode (default: false)")
 	port := flag.Int("port", 5510, "the port to listen on (default: 5510)")
 	verbose := flag.Bool("verbose", false, "enable verbose logging (default: false)")
+	workers := flag.Int("workers", 3, "the number of download tasks to run in parallel (default: 3)")
+	chunkTimeout := flag.Duration("chunk-timeout", 10*time.Minute, "abort a chunk download on an agent after this duration, 0 to disable (default: 10m)")
+	minSpeed := flag.Int64("min-speed", 16*1024, "abort a chunk download on an agent slower than this many bytes per second, 0 to disable (default: 16384)")
+	policy := agents.DefaultRetryPolicy()
+	flag.IntVar(&policy.Attempts, "retry-attempts", policy.Attempts, "attempts of a chunk before the task fails, each on one agent, permanent errors such as 404 are not retried (default: 4)")
+	flag.DurationVar(&policy.BaseDelay, "retry-delay", policy.BaseDelay, "delay before the first retry, doubled for every following retry (default: 1s)")
+	flag.DurationVar(&policy.MaxDelay, "retry-max-delay", policy.MaxDelay, "maximum delay between retries (default: 30s)")
+	flag.Float64Var(&policy.Jitter, "retry-jitter", policy.Jitter, "fraction of the retry delay that is random, from 0 to 1 (default: 0.2)")
+	flag.IntVar(&policy.MaxAgentErrors, "agent-max-errors", policy.MaxAgentErrors, "ban an agent with more errors than this (default: 3)")
+	flag.DurationVar(&policy.AgentBan, "agent-ban", policy.AgentBan, "how long an agent with too many errors is banned (default: 5m)")
+	agentStrategy := flag.String("agent-strategy", agents.StrategyLeastLoaded, "how the agent of every chunk is picked: "+strings.Join(agents.SelectionStrategyNames(), ", ")+" (default: "+agents.StrategyLeastLoaded+")")
+	var hostLimits hostLimitRules
+	flag.Var(&hostLimits, "host-limit", "limit the concurrent connections to the origin hosts matching a pattern, as PATTERN=N, such as '*.example.com=4' (repeatable, the first match applies)")
+	defaultHostLimit := flag.Int("default-host-limit", 0, "limit the concurrent connections to the origin hosts without a --host-limit, 0 for no limit (default: 0)")
+	adminToken := flag.String("admin-token", os.Getenv("DDSON_ADMIN_TOKEN"), "token of the clients allowed to promote tasks and control agents from other hosts, clients on the server host always are (default: $DDSON_ADMIN_TOKEN)")
 	flag.Parse()
 
 	// Set up slog logger
@@ -69,6 +99,12 @@ func main() {
 	logger = logging.NewCustomLogger(logLevel, useColor, "")
 	slog.SetDefault(logger)
 
+	strategy, err := agents.NewSelectionStrategy(*agentStrategy)
+	if err != nil {
+		slog.Error("invalid --agent-strategy", "error", err)
+		os.Exit(1)
+	}
+
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		slog.Error("failed to listen", "error", err)
@@ -84,13 +120,17 @@ func main() {
 		grpc.MaxSendMsgSize(100*1024*1024), // 100 MB
 	)
 
-	serverInstance := newServer()
+	serverInstance := newServer(*workers, chunkLimits{timeout: *chunkTimeout, minSpeed: *minSpeed}, policy, strategy, hostLimits, *defaultHostLimit, *adminToken)
+	if err := serverInstance.taskList.restoreTasks(); err != nil {
+		slog.Error("failed to restore tasks", "error", err)
+		os.Exit(1)
+	}
 	pb.RegisterDDSONServiceServer(s, serverInstance)
 
 	// Start task processing goroutine
 	go serverInstance.runTasks()
 
-	slog.Info("Server listening", "address", lis.Addr())
+	slog.Info("Server listening", "address", lis.Addr(), "agentStrategy", strategy.Name())
 	if err := s.Serve(lis); err != nil {
 		slog.Error("failed to serve", "error", err)
 		os.Exit(1)
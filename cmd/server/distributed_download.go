@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -17,34 +18,85 @@ import (
 	"internal/pb"
 )
 
-const CHUNK_SIZE = int64(10 * 1024 * 1024) // 10 MB
+const CHUNK_SIZE = int64(10 * 1024 * 1024) // 10 MB, used until the throughput of the agents is measured
+
+// MAX_ORIGIN_RESTARTS limits how many times a task starts over because the file changed on the origin.
+const MAX_ORIGIN_RESTARTS = 2
 
 func executeTask(task *taskInfo, server *server) {
 	defer task.markDone()
 
+	for restarts := 0; ; restarts++ {
+		downloadTask(task, server)
+		if !errors.Is(task.getError(), errOriginChanged) {
+			return
+		}
+		if restarts >= MAX_ORIGIN_RESTARTS {
+			slog.Error("File keeps changing on the origin, giving up", "taskID", task.id, "restarts", restarts)
+			return
+		}
+		slog.Warn("File changed on the origin, restarting the task", "taskID", task.id, "restarts", restarts+1, "error", task.getError())
+		if !task.restart() {
+			slog.Info("Task not restarted, nobody waits for it any more", "taskID", task.id)
+			return
+		}
+	}
+}
+
+// downloadTask downloads the file of the task into the cache. A failure is recorded in the task.
+func downloadTask(task *taskInfo, server *server) {
+	// the context of this run, a restart replaces the context of the task once this run returns
+	ctx := task.getContext()
+
 	// Check if server supports partial downloads
-	supportsPartial, totalSize, err := httputil.CheckPartialDownloadSupport(task.downloadUrl)
+	remoteFile, err := probeOrigin(ctx, task.downloadUrl, server.retryPolicy, server.throttle)
 	if err != nil {
 		slog.Error("Error checking partial download support", "error", err)
 		task.setError(err)
 		return
 	}
-	if !supportsPartial {
-		slog.Warn("Server does not support partial downloads, downloading the whole file")
-		err = fmt.Errorf("server does not support partial downloads")
+	// without Range support, a single agent downloads the whole file.
+	// the size may be unknown too, it is then known once the download completes.
+	wholeFile := !remoteFile.SupportsPartial
+	if wholeFile {
+		slog.Warn("Server does not support partial downloads, downloading the whole file", "taskID", task.id, "size", remoteFile.TotalSize)
+	}
+	totalSize := remoteFile.TotalSize
+	origins := []*originURL{newOriginURL(task.downloadUrl, remoteFile)}
+	if len(task.mirrors) > 0 && wholeFile {
+		slog.Warn("Mirrors are not used, the whole file is downloaded from the URL of the request", "taskID", task.id, "mirrors", len(task.mirrors))
+	} else if len(task.mirrors) > 0 {
+		mirrors, err := probeMirrors(ctx, task, server, remoteFile)
+		if err != nil {
+			slog.Error("Error checking mirrors", "taskID", task.id, "error", err)
+			task.setError(err)
+			return
+		}
+		origins = append(origins, mirrors...)
+	}
+	mirrors := newMirrorSet(origins, server.throttle, server.hostLimiter)
+
+	task.mtx.Lock()
+	task.totalSize = totalSize
+	task.state = taskState_DOWNLOADING
+	task.mtx.Unlock()
+	server.taskList.persistState(task)
+
+	// chunks are saved in a staging directory keyed by the URL and the version of the file, and the expected checksum
+	// like the in-flight tasks, so only one task at a time uses it.
+	// it is kept if the task fails, so a retry or a restarted server only downloads the missing chunks.
+	stagingDir, err := server.persistency.StagingDir(task.downloadUrl, remoteFile.ETag, remoteFile.LastModified, totalSize, task.checksum)
+	if err != nil {
+		slog.Error("Error creating staging directory", "error", err)
 		task.setError(err)
 		return
 	}
-
-	// create temporary folder in /tmp
-	tmpDir, err := os.MkdirTemp("", "ddson")
-	slog.Info("saving temporary files", "dir", tmpDir)
-	if err != nil {
-		slog.Error("Error creating temporary directory", "error", err)
+	if err := server.staging.lock(ctx, stagingDir); err != nil {
 		task.setError(err)
 		return
 	}
-	defer os.RemoveAll(tmpDir) // Clean up temporary directory
+	defer server.staging.unlock(stagingDir)
+	slog.Info("saving chunk files", "dir", stagingDir)
 
 	progressChan := make(chan [2]int, 32)
 	defer close(progressChan)
@@ -52,146 +104,186 @@ func executeTask(task *taskInfo, server *server) {
 	// start a goroutine to update the download progress
 	go progressFunc(progressChan, task)
 
-	// create sub tasks
-	task.subtasks = createSubtasks(task.downloadUrl, tmpDir, totalSize, progressChan)
+	// create sub tasks for the chunks that are not staged yet
+	var subtasks []*subTaskInfo
+	if wholeFile {
+		subtasks = []*subTaskInfo{newSubTaskInfo(mirrors, task.id, 0, 0, totalSize, wholeFileChunk(stagingDir), progressChan)}
+		subtasks[0].wholeFile = true
+	} else {
+		subtasks = createSubtasks(mirrors, task.id, stagingDir, totalSize, server, progressChan)
+	}
+	task.mtx.Lock()
+	task.subtasks = subtasks // status reports read them while the task runs
+	task.mtx.Unlock()
 	totalSubTasks := len(task.subtasks)
 	slog.Info("Created sub tasks", "count", totalSubTasks)
 
-	err = executeSubTasks(task, server)
-
+	// the chunks are assembled in order while the others are still downloading,
+	// so requesters can stream the beginning of the file before the task completes
+	assembledFile, err := os.CreateTemp("", "combined_")
 	if err != nil {
-		slog.Error("Error executing sub tasks", "error", err)
+		slog.Error("Error creating combined file", "error", err)
 		task.setError(err)
 		return
 	}
-	slog.Info("All sub tasks executed", "count", totalSubTasks)
+	slog.Info("Assembling sub tasks into file", "file", assembledFile.Name())
+	task.setAssembledFile(assembledFile.Name())
+	hasher := sha256.New()
+	assembleResult := make(chan error, 1)
+	go func() {
+		err := assembleChunks(task, io.MultiWriter(assembledFile, hasher))
+		if err != nil && !task.isStopped() {
+			slog.Error("Error assembling file", "error", err)
+			task.setError(err) // stops the sub tasks
+		}
+		assembleResult <- err
+	}()
 
-	completeFile, err := combine(task.subtasks, totalSize)
+	err = executeSubTasks(task, server)
 	if err != nil {
-		slog.Error("Error combining files", "error", err)
+		slog.Error("Error executing sub tasks", "error", err)
+		task.setError(err) // also stops the assembling
+	} else {
+		slog.Info("All sub tasks executed", "count", totalSubTasks)
+	}
+	<-assembleResult
+	completeFile := assembledFile.Name()
+	if err := assembledFile.Close(); err != nil && !task.isStopped() {
+		slog.Error("Error closing combined file", "error", err)
 		task.setError(err)
+	}
+
+	if task.isStopped() {
+		slog.Info("Task stopped before validation", "taskID", task.id, "error", task.getError())
+		os.Remove(completeFile)
+		if errors.Is(task.getError(), errOriginChanged) {
+			// the staged chunks belong to the old version of the file
+			if err := server.persistency.RemoveStagingDir(stagingDir); err != nil {
+				slog.Warn("Failed to remove staging directory", "dir", stagingDir, "error", err)
+			}
+		}
 		return
 	}
-	slog.Info("Combined file created", "file", completeFile)
 
 	if task.checksum != "" {
+		// the checksum was computed while assembling
 		slog.Info("Validating combined file", "file", completeFile, "checksum", task.checksum)
-		err = task.stream.Send(&pb.DownloadStatus{
+		task.broadcast(&pb.DownloadStatus{
 			Status: pb.DownloadStatusType_VALIDATING,
 		})
-		if err != nil {
-			slog.Error("Failed to send validation status", "error", err)
-			task.setError(err)
-			return
-		}
-		err = validateFile(completeFile, task.checksum)
-		if err != nil {
-			slog.Error("Error validating file", "error", err)
-			task.setError(err)
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		if sum != task.checksum {
+			slog.Error("Checksum mismatch", "got", sum, "want", task.checksum)
+			os.Remove(completeFile)
+			// a retry would assemble the same chunks again, it downloads them all instead
+			if err := server.persistency.RemoveStagingDir(stagingDir); err != nil {
+				slog.Warn("Failed to remove staging directory", "dir", stagingDir, "error", err)
+			}
+			task.setError(fmt.Errorf("checksum mismatch: got %s, want %s", sum, task.checksum))
 			return
 		}
 	} else {
 		slog.Info("No checksum provided, skipping validation")
 	}
 
-	defer os.Remove(completeFile) // Clean up combined file after transfer
-	err = transferFileData(task.stream, completeFile)
-	if err != nil {
-		slog.Error("Error transferring file data", "error", err)
-		task.setError(err)
-		return
-	}
-	slog.Info("File transfer completed", "file", completeFile)
-
-	// move the downloaded file to a temporary location, and save the path of taskInfo
-	tempFile, err := os.CreateTemp("", "downloaded_")
+	// save the downloaded file to persistency, every requester of the task transfers it from there
+	slog.Info("Saving downloaded file to persistency", "path", completeFile)
+	err = server.persistency.AddDownloadedFile(task.downloadUrl, completeFile, task.checksum)
 	if err != nil {
-		slog.Error("Error creating temporary file for downloaded content", "error", err)
+		slog.Error("Failed to save downloaded file", "url", task.downloadUrl, "error", err)
 	} else {
-		defer tempFile.Close()
-
-		os.Rename(completeFile, tempFile.Name())
-		slog.Info("Moved combined file to temporary location", "file", tempFile.Name())
-		task.downloadedFile = tempFile.Name()
+		completeFile, err = server.persistency.GetPersistedFile(task.downloadUrl, task.checksum)
+		if err != nil || completeFile == "" {
+			slog.Error("Failed to get persisted file", "url", task.downloadUrl, "error", err)
+			task.setError(fmt.Errorf("failed to get persisted file for %s", task.downloadUrl))
+			return
+		}
 	}
+	task.downloadedFile = completeFile
+	task.setAssembledFile(completeFile) // requesters that did not open the file yet find it in the cache
 
-	task.state = taskState_COMPLETED
-}
-
-func combine(subtasks []*subTaskInfo, totalSize int64) (string, error) {
-	// Create a new file to write the combined content
-	combinedFile, err := os.CreateTemp("", "combined_")
-	if err != nil {
-		slog.Error("Error creating combined file", "error", err)
-		return "", err
+	if err := server.persistency.RemoveStagingDir(stagingDir); err != nil {
+		slog.Warn("Failed to remove staging directory", "dir", stagingDir, "error", err)
 	}
-	defer combinedFile.Close()
-	slog.Info("Combining sub tasks into file", "file", combinedFile.Name())
-
-	// sort the completed sub tasks by offset
-	sort.Slice(subtasks, func(i, j int) bool {
-		return subtasks[i].offset < subtasks[j].offset
-	})
+	task.setState(taskState_COMPLETED)
+}
 
-	// print sorted sub tasks
-	for _, subTask := range subtasks {
-		slog.Debug("Sub task info", "subtaskID", subTask.id, "offset", subTask.offset, "size", subTask.downloadSize, "file", subTask.targetFile)
+// probeMirrors probes the mirrors of the task, and returns the ones to download chunks from.
+// Like the URL of the request, a mirror is retried as the retry policy says, and waited for while its host is throttled.
+// Mirrors that can not be reached or do not support ranges are left out.
+// A mirror with another size than the URL of the request serves another file, the task fails.
+func probeMirrors(ctx context.Context, task *taskInfo, server *server, primary *httputil.RemoteFileInfo) ([]*originURL, error) {
+	origins := make([]*originURL, 0, len(task.mirrors))
+	for _, mirrorUrl := range task.mirrors {
+		remoteFile, err := probeOrigin(ctx, mirrorUrl, server.retryPolicy, server.throttle)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			slog.Warn("Mirror not reachable, not using it", "taskID", task.id, "url", mirrorUrl, "error", err)
+			continue
+		}
+		if remoteFile.TotalSize != primary.TotalSize {
+			return nil, fmt.Errorf("mirror %s has %d bytes, %s has %d bytes", mirrorUrl, remoteFile.TotalSize, task.downloadUrl, primary.TotalSize)
+		}
+		if !remoteFile.SupportsPartial {
+			slog.Warn("Mirror does not support partial downloads, not using it", "taskID", task.id, "url", mirrorUrl)
+			continue
+		}
+		origins = append(origins, newOriginURL(mirrorUrl, remoteFile))
 	}
+	slog.Info("Mirrors checked", "taskID", task.id, "mirrors", len(task.mirrors), "used", len(origins))
+	return origins, nil
+}
 
+// assembleChunks writes the chunks of the task to out in offset order, each of them as soon as it is downloaded.
+// Every written chunk advances the assembled size of the task, which requesters stream.
+// It returns when the whole file is written, or when the task is stopped.
+func assembleChunks(task *taskInfo, out io.Writer) error {
+	ctx := task.getContext()
 	currentOffset := int64(0)
-	for _, subTask := range subtasks {
+	for _, subTask := range task.subtasks {
 		if subTask.offset != currentOffset {
 			slog.Error("Error: subtask offset mismatch", "got", subTask.offset, "want", currentOffset)
-			return "", fmt.Errorf("subtask offset mismatch: got %d, want %d", subTask.offset, currentOffset)
+			return fmt.Errorf("subtask offset mismatch: got %d, want %d", subTask.offset, currentOffset)
 		}
-		currentOffset += subTask.downloadSize
-	}
 
-	currentOffset = 0
-	for _, subTask := range subtasks {
-		slog.Debug("Combining sub task", "subtaskID", subTask.id, "offset", subTask.offset, "size", subTask.downloadSize)
-		// Open the sub task file
+		select {
+		case <-subTask.done:
+		case <-ctx.Done():
+			return fmt.Errorf("task stopped with %d of %d bytes assembled", currentOffset, task.getTotalSize())
+		}
+
+		slog.Debug("Assembling sub task", "subtaskID", subTask.id, "offset", subTask.offset, "size", subTask.downloadSize)
 		file, err := os.Open(subTask.targetFile)
 		if err != nil {
 			slog.Error("Error opening sub task file", "error", err)
-			return "", err
+			return err
 		}
-		defer file.Close()
-		// Read the content and write it to the combined file
-		_, err = io.Copy(combinedFile, file)
+		n, err := io.Copy(out, file)
+		file.Close()
 		if err != nil {
 			slog.Error("Error writing to combined file", "error", err)
-			return "", err
+			return err
 		}
-		// Update the current offset
-		currentOffset += subTask.downloadSize
+		if n != subTask.downloadSize {
+			slog.Error("Error: sub task file size mismatch", "subtaskID", subTask.id, "got", n, "want", subTask.downloadSize)
+			return fmt.Errorf("sub task %d has %d bytes, want %d", subTask.id, n, subTask.downloadSize)
+		}
+		currentOffset += n
+		task.advanceAssembled(currentOffset)
 	}
 
+	task.mtx.Lock()
+	if task.totalSize < 0 {
+		// the origin did not send the size, a whole-file download finds it out
+		task.totalSize = currentOffset
+	}
+	totalSize := task.totalSize
+	task.mtx.Unlock()
 	if currentOffset != totalSize {
 		slog.Error("Error: total size mismatch", "got", currentOffset, "want", totalSize)
-		return "", fmt.Errorf("total size mismatch: got %d, want %d", currentOffset, totalSize)
-	}
-
-	return combinedFile.Name(), nil
-}
-
-func validateFile(file string, checksum string) error {
-	// calculate the checksum (sha256) of the file
-	f, err := os.Open(file)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, f); err != nil {
-		slog.Error("Error calculating checksum", "error", err)
-		return err
-	}
-	sum := hex.EncodeToString(hasher.Sum(nil))
-	if sum != checksum {
-		slog.Error("Checksum mismatch", "got", sum, "want", checksum)
-		return fmt.Errorf("checksum mismatch: got %s, want %s", sum, checksum)
+		return fmt.Errorf("total size mismatch: got %d, want %d", currentOffset, totalSize)
 	}
 	return nil
 }
@@ -210,51 +302,109 @@ func progressFunc(progressChan chan [2]int, task *taskInfo) {
 
 			totalSpeed := downloadProgress.getTotalSpeed()
 			slog.Debug("Total download speed", "speed", common.PrettyFormatSpeed(totalSpeed))
-			err := task.stream.Send(&pb.DownloadStatus{
+			task.setSpeed(totalSpeed)
+			task.broadcast(&pb.DownloadStatus{
 				Status:               pb.DownloadStatusType_DOWNLOADING,
 				Speed:                int32(totalSpeed),
 				TotalDownloadedBytes: int64(downloadProgress.getTotalDownloadedBytes()),
+				TotalSize:            task.getTotalSize(),
 			})
-			if err != nil {
-				slog.Error("Failed to send download status", "error", err)
-				task.setError(err)
-				return
-			}
 		}
 	}
 }
 
-func createSubtasks(downloadUrl string, tmpDir string, totalSize int64, progressChan chan [2]int) []*subTaskInfo {
-	subtasks := make([]*subTaskInfo, 0, totalSize/CHUNK_SIZE+1)
-	i := 0
-	for offset := int64(0); offset < totalSize; offset += CHUNK_SIZE {
-		downloadSize := CHUNK_SIZE
-		if offset+downloadSize > totalSize {
-			downloadSize = totalSize - offset
-		}
+// createSubtasks creates a subtask for every chunk of the file.
+// Chunks already in the staging directory are marked as completed and are not downloaded again,
+// the missing ranges are cut into chunks by a chunkPlanner.
+func createSubtasks(mirrors *mirrorSet, taskId int, stagingDir string, totalSize int64, server *server, progressChan chan [2]int) []*subTaskInfo {
+	staged := scanStagedChunks(stagingDir, totalSize)
+	subtasks := make([]*subTaskInfo, 0, len(staged))
+	for _, chunk := range staged {
+		subTask := newSubTaskInfo(mirrors, taskId, 0, chunk.offset, chunk.size, chunk.path, progressChan)
+		subTask.markCompleted()
+		subtasks = append(subtasks, subTask)
+	}
+	if len(staged) > 0 {
+		slog.Info("Found staged chunks", "dir", stagingDir, "count", len(staged))
+	}
 
-		targetFile := fmt.Sprintf("%s/%d", tmpDir, offset)
-		subTask := newSubTaskInfo(downloadUrl, i, offset, downloadSize, targetFile, progressChan)
-		i++
+	missing := missingRanges(staged, totalSize)
+	missingSize := int64(0)
+	for _, r := range missing {
+		missingSize += r[1]
+	}
+	planner := newChunkPlanner(missingSize, server.agentList.SlotCount(), server.agentList.Throughputs())
+	for _, chunk := range planner.plan(missing) {
+		offset, downloadSize := chunk[0], chunk[1]
+		targetFile := chunkFile(stagingDir, offset, downloadSize)
+		subTask := newSubTaskInfo(mirrors, taskId, 0, offset, downloadSize, targetFile, progressChan)
 		subtasks = append(subtasks, subTask)
 	}
 
+	// subtask IDs are the index in the slice, sorted by offset
+	sort.Slice(subtasks, func(i, j int) bool {
+		return subtasks[i].offset < subtasks[j].offset
+	})
+	for i, subTask := range subtasks {
+		subTask.id = i
+	}
+
 	return subtasks
 }
 
 func executeSubTasks(task *taskInfo, server *server) error {
+	ctx := task.getContext()
 	totalSubTasks := len(task.subtasks)
+	if totalSubTasks == 0 {
+		return nil
+	}
 	finishChan := make(chan int, totalSubTasks)
 	finishedSubTasks := 0
+	startedSubTasks := 0
+	runningSubTasks := 0
 	debugFinishedTasks := make([]int, totalSubTasks)
 
-	for _, subTask := range task.subtasks {
-		go subTask.execute(server, &task.quitFlag, finishChan)
+	// startSubTasks starts pending subtasks until the task uses up its share of agents.
+	// other running tasks get their share, so that a big task does not starve small ones.
+	startSubTasks := func() {
+		share := server.taskList.agentShare(server.agentList.SlotCount(), task)
+		for startedSubTasks < totalSubTasks && runningSubTasks < share && !task.isStopped() {
+			subTask := task.subtasks[startedSubTasks]
+			startedSubTasks++
+			if subTask.completed {
+				// restored from a previous run
+				finishedSubTasks++
+				debugFinishedTasks[subTask.id] = 1
+				continue
+			}
+			go subTask.execute(server, ctx, finishChan)
+			runningSubTasks++
+		}
+		slog.Debug("Sub tasks started", "taskID", task.id, "started", startedSubTasks, "running", runningSubTasks, "share", share)
+	}
+	startSubTasks()
+	if runningSubTasks == 0 && finishedSubTasks == totalSubTasks {
+		slog.Info("All chunks were already staged", "taskID", task.id)
+		return nil
 	}
 
+	// stragglers are checked periodically, once all subtasks of the task are started
+	speculationTicker := time.NewTicker(SPECULATION_INTERVAL)
+	defer speculationTicker.Stop()
+
 	var err error
-	for subtaskID := range finishChan {
+	for {
+		var subtaskID int
+		select {
+		case subtaskID = <-finishChan:
+		case <-speculationTicker.C:
+			if startedSubTasks == totalSubTasks && !task.isStopped() {
+				speculateStragglers(task, server)
+			}
+			continue
+		}
 		finishedSubTasks++
+		runningSubTasks--
 		debugFinishedTasks[subtaskID] = 1 // for debugging purposes
 		debugFinishedString := getDebugFinishedString(debugFinishedTasks, totalSubTasks)
 		slog.Debug("debug", "debugFinishedTasks", debugFinishedString)
@@ -271,19 +421,28 @@ func executeSubTasks(task *taskInfo, server *server) error {
 			task.setError(err)
 		}
 
-		// always wait for all subtasks to finish, even if one fails
-		// this is to prevent subtask to write to progressChan after quitFlag is set
-		if finishedSubTasks == totalSubTasks {
-			slog.Info("All sub tasks finished", "taskID", task.id)
+		startSubTasks()
+
+		// always wait for all started subtasks to finish, even if one fails
+		// this is to prevent subtask to write to progressChan after the task is stopped
+		if runningSubTasks == 0 && (finishedSubTasks == totalSubTasks || task.isStopped()) {
+			slog.Info("All sub tasks finished", "taskID", task.id, "finished", finishedSubTasks, "total", totalSubTasks)
 			close(finishChan)
 			break
 		}
 	}
 
+	if err == nil {
+		err = task.getError()
+	}
+	if err == nil && finishedSubTasks != totalSubTasks {
+		err = fmt.Errorf("task stopped with %d of %d sub tasks finished", finishedSubTasks, totalSubTasks)
+	}
 	return err
 }
 
-func transferFileData(stream pb.DDSONService_DownloadServer, filePath string) error {
+// transferFileData sends the content of the file to a requester, using the send function of its stream.
+func transferFileData(send func(*pb.DownloadStatus) error, filePath string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		slog.Error("Error opening file", "error", err)
@@ -311,7 +470,7 @@ func transferFileData(stream pb.DDSONService_DownloadServer, filePath string) er
 			return err
 		}
 		slog.Log(context.Background(), slog.LevelDebug-1, "Sending bytes", "count", n, "totalSent", totalBytesSent)
-		err = stream.Send(&pb.DownloadStatus{
+		err = send(&pb.DownloadStatus{
 			Status: pb.DownloadStatusType_TRANSFERRING,
 			Data:   buffer[:n],
 		})
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"internal/agents"
+	"internal/httputil"
+	"internal/pb"
+)
+
+func TestAssembleChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunks    []string // content of the chunk files, in offset order
+		sizes     []int64  // sizes of the subtasks, the length of the chunks if nil
+		offsets   []int64  // offsets of the subtasks, one after the other if nil
+		totalSize int64
+		stop      bool // the task is stopped before the chunks are downloaded
+		want      string
+		wantError string
+	}{
+		{name: "whole file", chunks: []string{"abc", "def", "g"}, totalSize: 7, want: "abcdefg"},
+		{name: "unknown size", chunks: []string{"abcdefg"}, totalSize: -1, want: "abcdefg"},
+		{name: "truncated chunk", chunks: []string{"abc", "de"}, sizes: []int64{3, 3}, totalSize: 6, want: "abcde", wantError: "has 2 bytes, want 3"},
+		{name: "offset mismatch", chunks: []string{"abc", "def"}, offsets: []int64{0, 4}, totalSize: 7, want: "abc", wantError: "offset mismatch"},
+		{name: "short file", chunks: []string{"abc"}, totalSize: 4, want: "abc", wantError: "total size mismatch"},
+		{name: "stopped task", chunks: []string{"abc"}, totalSize: 3, stop: true, wantError: "task stopped"},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		task := newTaskInfo("http://example.com/file", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+		task.totalSize = test.totalSize
+		offset := int64(0)
+		for i, chunk := range test.chunks {
+			size := int64(len(chunk))
+			if test.sizes != nil {
+				size = test.sizes[i]
+			}
+			if test.offsets != nil {
+				offset = test.offsets[i]
+			}
+			path := filepath.Join(dir, chunkFile("", offset, size))
+			if err := os.WriteFile(path, []byte(chunk), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+			task.subtasks = append(task.subtasks, newSubTaskInfo(nil, task.id, i, offset, size, path, nil))
+			offset += size
+		}
+
+		var out bytes.Buffer
+		result := make(chan error)
+		go func() { result <- assembleChunks(task, &out) }()
+
+		if test.stop {
+			task.setCancelled("test")
+		} else {
+			// the chunks complete in reverse order, they are still written in offset order
+			for i := len(task.subtasks) - 1; i >= 0; i-- {
+				task.subtasks[i].markCompleted()
+			}
+		}
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: assembleChunks did not return", test.name)
+		}
+
+		if test.wantError == "" && err != nil || test.wantError != "" && (err == nil || !strings.Contains(err.Error(), test.wantError)) {
+			t.Errorf("%s: assembleChunks = %v, want %q", test.name, err, test.wantError)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: assembled %q, want %q", test.name, out.String(), test.want)
+		}
+		if _, assembled, _, _ := task.assembledState(); err == nil && assembled != int64(len(test.want)) {
+			t.Errorf("%s: %d bytes assembled, want %d", test.name, assembled, len(test.want))
+		}
+		if err == nil && task.getTotalSize() != int64(len(test.want)) {
+			t.Errorf("%s: total size %d once assembled, want %d", test.name, task.getTotalSize(), len(test.want))
+		}
+	}
+}
+
+// testDownloadStream is the Download stream of a requester, it keeps what the server sends.
+type testDownloadStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	mtx  sync.Mutex
+	data []byte
+	sent chan struct{} // receives a value for every status sent
+}
+
+func (stream *testDownloadStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *testDownloadStream) Send(status *pb.DownloadStatus) error {
+	stream.mtx.Lock()
+	stream.data = append(stream.data, status.GetData()...)
+	stream.mtx.Unlock()
+	stream.sent <- struct{}{}
+	return nil
+}
+
+func (stream *testDownloadStream) received() string {
+	stream.mtx.Lock()
+	defer stream.mtx.Unlock()
+	return string(stream.data)
+}
+
+func TestStreamTask(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      error // the task fails once the file is assembled
+		wantError string
+	}{
+		{name: "completed"},
+		{name: "failed validation", fail: errors.New("checksum mismatch"), wantError: "checksum mismatch"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "combined")
+		if err := os.WriteFile(path, []byte("abcdef"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		task := newTaskInfo("http://example.com/file", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+		task.totalSize = 6
+		task.setState(taskState_DOWNLOADING)
+		stream := &testDownloadStream{ctx: context.Background(), sent: make(chan struct{}, 16)}
+		sub := task.attach(stream, "10.0.0.1:40000")
+
+		result := make(chan error)
+		go func() { result <- (&server{}).streamTask(task, sub) }()
+
+		// the requester gets the first chunk before the task completes
+		task.setAssembledFile(path)
+		task.advanceAssembled(3)
+		select {
+		case <-stream.sent:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: the assembled bytes were not streamed", test.name)
+		}
+		if got := stream.received(); got != "abc" {
+			t.Fatalf("%s: streamed %q before the task completed, want %q", test.name, got, "abc")
+		}
+
+		task.advanceAssembled(6)
+		if test.fail != nil {
+			task.setError(test.fail)
+		} else {
+			task.setState(taskState_COMPLETED)
+		}
+		task.markDone()
+		var err error
+		select {
+		case err = <-result:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: streamTask did not return once the task is done", test.name)
+		}
+		if test.wantError == "" && err != nil || test.wantError != "" && (err == nil || !strings.Contains(err.Error(), test.wantError)) {
+			t.Errorf("%s: streamTask = %v, want %q", test.name, err, test.wantError)
+		}
+		if got := stream.received(); got != "abcdef" {
+			t.Errorf("%s: streamed %q, want %q", test.name, got, "abcdef")
+		}
+	}
+}
+
+func TestProbeMirrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		mirrors   []string // paths of the mirrors on the origin
+		stop      bool     // the task is stopped before the mirrors are probed
+		wantUsed  int
+		wantError bool
+	}{
+		{name: "mirrors used", mirrors: []string{"/file", "/file?copy"}, wantUsed: 2},
+		{name: "throttled mirror retried", mirrors: []string{"/throttled"}, wantUsed: 1},
+		{name: "unusable mirrors left out", mirrors: []string{"/missing", "/no-ranges", "/file"}, wantUsed: 1},
+		{name: "another file", mirrors: []string{"/other"}, wantError: true},
+		{name: "stopped task", mirrors: []string{"/file"}, stop: true, wantError: true},
+	}
+
+	for _, test := range tests {
+		// the throttled mirror answers 503 to the first probe, both its HEAD and its range request
+		var throttled atomic.Int32
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/missing":
+				w.WriteHeader(http.StatusNotFound)
+				return
+			case "/throttled":
+				if throttled.Add(1) <= 2 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+			case "/other":
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("Content-Length", "20")
+				return
+			case "/no-ranges":
+				w.Header().Set("Content-Length", "10")
+				w.Write([]byte("0123456789"))
+				return
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", "10")
+		}))
+
+		policy := agents.DefaultRetryPolicy()
+		policy.BaseDelay = 10 * time.Millisecond
+		s := newTestDownloadServer(t, policy)
+		mirrors := make([]string, 0, len(test.mirrors))
+		for _, path := range test.mirrors {
+			mirrors = append(mirrors, origin.URL+path)
+		}
+		task := newTaskInfo(origin.URL+"/file", mirrors, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if test.stop {
+			cancel()
+		}
+
+		got, err := probeMirrors(ctx, task, s, &httputil.RemoteFileInfo{TotalSize: 10, SupportsPartial: true})
+		cancel()
+		origin.Close()
+		if (err != nil) != test.wantError || len(got) != test.wantUsed {
+			t.Errorf("%s: probeMirrors = %d mirrors, %v, want %d mirrors, error %v", test.name, len(got), err, test.wantUsed, test.wantError)
+		}
+	}
+}
@@ -18,6 +18,7 @@ require (
 	google.golang.org/grpc v1.73.0
 	internal/agents v0.0.0
 	internal/common v0.0.0
+	internal/database v0.0.0
 	internal/httputil v0.0.0
 	internal/logging v0.0.0
 	internal/pb v0.0.0
@@ -39,7 +40,6 @@ require (
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250603155806-513f23925822 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
-	internal/database v0.0.0 // indirect
 	modernc.org/libc v1.65.10 // indirect
 	modernc.org/mathutil v1.7.1 // indirect
 	modernc.org/memory v1.11.0 // indirect
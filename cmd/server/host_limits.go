@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"internal/persistency"
+)
+
+const HOST_LIMIT_RAISE_AFTER = 10 // downloads in a row a host serves at its learned limit before the limit is raised by one
+
+// errOriginOverloaded is returned when the origin answered with a server error,
+// it may not keep up with the connections of the agents.
+var errOriginOverloaded = errors.New("origin overloaded")
+
+// hostLimitRule limits the concurrent connections to the hosts matching a pattern, see matchHost.
+type hostLimitRule struct {
+	pattern string
+	limit   int
+}
+
+// hostLimitRules is the --host-limit flag, it can be repeated. The first rule matching a host applies.
+type hostLimitRules []hostLimitRule
+
+func (r *hostLimitRules) String() string {
+	rules := make([]string, 0, len(*r))
+	for _, rule := range *r {
+		rules = append(rules, fmt.Sprintf("%s=%d", rule.pattern, rule.limit))
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *hostLimitRules) Set(value string) error {
+	rule, err := parseHostLimitRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// parseHostLimitRule parses a rule in the PATTERN=N form, such as "*.example.com=4".
+func parseHostLimitRule(value string) (hostLimitRule, error) {
+	pattern, limit, found := strings.Cut(value, "=")
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if !found || pattern == "" {
+		return hostLimitRule{}, fmt.Errorf("invalid host limit %q, expected PATTERN=N", value)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return hostLimitRule{}, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil || n < 1 {
+		return hostLimitRule{}, fmt.Errorf("invalid host limit %q, N must be a positive number", value)
+	}
+	return hostLimitRule{pattern: pattern, limit: n}, nil
+}
+
+// matchHost tells whether the host matches the pattern, "*" matches any part of a host name, "?" any character.
+// A pattern without a port matches the host on any port.
+func matchHost(pattern string, host string) bool {
+	host = strings.ToLower(host)
+	if matched, _ := path.Match(pattern, host); matched {
+		return true
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		matched, _ := path.Match(pattern, hostname)
+		return matched
+	}
+	return false
+}
+
+// hostLimiter limits the concurrent connections of the agents to every origin host, across all tasks.
+// The limit of a host is the first --host-limit rule matching it, or the default limit.
+// A host that answers with overload errors gets a lower learned limit, half of its connections at the time,
+// which is raised again by one after every HOST_LIMIT_RAISE_AFTER downloads at the limit.
+// The learned limits are saved in the database, a restarted server does not overload the host again.
+type hostLimiter struct {
+	mtx          sync.Mutex
+	rules        []hostLimitRule
+	defaultLimit int // 0 if the hosts without a rule are not limited
+	hosts        map[string]*hostConnections
+	persistency  *persistency.Persistency
+	changed      chan struct{} // closed and replaced whenever a connection is released or a limit is raised
+}
+
+type hostConnections struct {
+	active    int
+	learned   int       // 0 if no limit was learned for the host
+	loweredAt time.Time // connections opened before the limit was lowered do not lower it again
+	successes int       // downloads in a row at the learned limit
+}
+
+// hostSlot is a connection to an origin host, taken by an attempt to download a chunk.
+type hostSlot struct {
+	host    string
+	opened  time.Time
+	atLimit bool // the host had no free connection left once this one was taken
+}
+
+func newHostLimiter(rules []hostLimitRule, defaultLimit int, p *persistency.Persistency) *hostLimiter {
+	l := &hostLimiter{
+		rules:        rules,
+		defaultLimit: defaultLimit,
+		hosts:        make(map[string]*hostConnections),
+		persistency:  p,
+		changed:      make(chan struct{}),
+	}
+	if p == nil {
+		return l
+	}
+	learned, err := p.GetHostLimits()
+	if err != nil {
+		slog.Warn("Failed to load the learned host limits", "error", err)
+		return l
+	}
+	for host, limit := range learned {
+		slog.Info("Learned host limit restored", "host", host, "limit", limit)
+		l.hosts[host] = &hostConnections{learned: limit}
+	}
+	return l
+}
+
+// configuredLimitNoLock returns the limit set for the host in the configuration, 0 if it is not limited.
+func (l *hostLimiter) configuredLimitNoLock(host string) int {
+	for _, rule := range l.rules {
+		if matchHost(rule.pattern, host) {
+			return rule.limit
+		}
+	}
+	return l.defaultLimit
+}
+
+// limitNoLock returns the number of concurrent connections allowed to the host, 0 if it is not limited.
+func (l *hostLimiter) limitNoLock(host string) int {
+	limit := l.configuredLimitNoLock(host)
+	if h, exists := l.hosts[host]; exists && h.learned > 0 && (limit == 0 || h.learned < limit) {
+		limit = h.learned
+	}
+	return limit
+}
+
+func (l *hostLimiter) hostNoLock(host string) *hostConnections {
+	h, exists := l.hosts[host]
+	if !exists {
+		h = &hostConnections{}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// wake returns a channel closed at the next change, waiters for a free connection check again then.
+func (l *hostLimiter) wake() <-chan struct{} {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.changed
+}
+
+func (l *hostLimiter) notifyNoLock() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// tryAcquire takes a connection to the host of the URL, it returns nil if the host has no free connection.
+func (l *hostLimiter) tryAcquire(rawURL string) *hostSlot {
+	host := originHost(rawURL)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	limit := l.limitNoLock(host)
+	h := l.hostNoLock(host)
+	if limit > 0 && h.active >= limit {
+		return nil
+	}
+	h.active++
+	return &hostSlot{host: host, opened: time.Now(), atLimit: limit > 0 && h.active >= limit}
+}
+
+// available tells whether the host of the URL has a free connection, without taking it.
+func (l *hostLimiter) available(rawURL string) bool {
+	host := originHost(rawURL)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	limit := l.limitNoLock(host)
+	h, exists := l.hosts[host]
+	return limit == 0 || !exists || h.active < limit
+}
+
+// release gives the connection back to its host.
+// A host without connections nor a learned limit is forgotten, the hosts of finished tasks do not pile up.
+func (l *hostLimiter) release(slot *hostSlot) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if h, exists := l.hosts[slot.host]; exists {
+		if h.active > 0 {
+			h.active--
+		}
+		if h.active == 0 && h.learned == 0 {
+			delete(l.hosts, slot.host)
+		}
+	}
+	l.notifyNoLock()
+}
+
+// recordOverload lowers the learned limit of the host to half of its connections, the host could not serve all of them.
+func (l *hostLimiter) recordOverload(slot *hostSlot, reason error) {
+	l.mtx.Lock()
+	h := l.hostNoLock(slot.host)
+	if !slot.opened.After(h.loweredAt) {
+		// opened before the limit was lowered, the host is already spared
+		l.mtx.Unlock()
+		return
+	}
+	limit := max(h.active/2, 1)
+	if current := l.limitNoLock(slot.host); current > 0 {
+		limit = min(limit, max(current-1, 1))
+	}
+	h.successes = 0
+	if h.learned == limit {
+		l.mtx.Unlock()
+		return
+	}
+	slog.Warn("Origin host overloaded, lowering its connection limit", "host", slot.host, "connections", h.active, "limit", limit, "reason", reason)
+	h.learned = limit
+	h.loweredAt = time.Now()
+	l.mtx.Unlock()
+
+	l.save(slot.host, limit)
+}
+
+// recordSuccess raises the learned limit of the host by one after HOST_LIMIT_RAISE_AFTER downloads at the limit.
+// The learned limit is forgotten once it reaches the configured limit.
+func (l *hostLimiter) recordSuccess(slot *hostSlot) {
+	l.mtx.Lock()
+	h, exists := l.hosts[slot.host]
+	if !exists || h.learned == 0 || !slot.atLimit {
+		l.mtx.Unlock()
+		return
+	}
+	h.successes++
+	if h.successes < HOST_LIMIT_RAISE_AFTER {
+		l.mtx.Unlock()
+		return
+	}
+	h.successes = 0
+	h.learned++
+	learned := h.learned
+	if configured := l.configuredLimitNoLock(slot.host); configured > 0 && learned >= configured {
+		learned = 0
+	}
+	h.learned = learned
+	slog.Info("Origin host keeps up, raising its connection limit", "host", slot.host, "limit", l.limitNoLock(slot.host))
+	l.notifyNoLock()
+	l.mtx.Unlock()
+
+	l.save(slot.host, learned)
+}
+
+// save saves the learned limit of the host, 0 removes it.
+func (l *hostLimiter) save(host string, limit int) {
+	if l.persistency == nil {
+		return
+	}
+	var err error
+	if limit > 0 {
+		err = l.persistency.SaveHostLimit(host, limit)
+	} else {
+		err = l.persistency.RemoveHostLimit(host)
+	}
+	if err != nil {
+		slog.Warn("Failed to save the learned host limit", "host", host, "limit", limit, "error", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "example.com", host: "example.com", want: true},
+		{pattern: "example.com", host: "example.com:8080", want: true},
+		{pattern: "example.com:8080", host: "example.com:8080", want: true},
+		{pattern: "example.com:8080", host: "example.com:9090", want: false},
+		{pattern: "*.example.com", host: "cdn.example.com", want: true},
+		{pattern: "*.example.com", host: "a.b.example.com:443", want: true},
+		{pattern: "*.example.com", host: "example.com", want: false},
+		{pattern: "*.example.com", host: "EXAMPLE.example.COM", want: true},
+		{pattern: "10.0.0.?", host: "10.0.0.7:80", want: true},
+		{pattern: "10.0.0.?", host: "10.0.0.17", want: false},
+		{pattern: "*", host: "anything:1", want: true},
+	}
+
+	for _, test := range tests {
+		if got := matchHost(test.pattern, test.host); got != test.want {
+			t.Errorf("matchHost(%q, %q) = %v, want %v", test.pattern, test.host, got, test.want)
+		}
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	var rules hostLimitRules
+	for _, value := range []string{"*.internal.example.com=2", "*=8"} {
+		if err := rules.Set(value); err != nil {
+			t.Fatalf("Set(%q): %v", value, err)
+		}
+	}
+	for _, value := range []string{"example.com", "=3", "example.com=0", "[=1"} {
+		if err := rules.Set(value); err == nil {
+			t.Errorf("Set(%q) accepted an invalid rule", value)
+		}
+	}
+	limiter := newHostLimiter(rules, 0, nil)
+
+	internal := "http://files.internal.example.com/big.bin"
+	first, second := limiter.tryAcquire(internal), limiter.tryAcquire(internal)
+	if first == nil || second == nil {
+		t.Fatalf("the first 2 connections to %s were refused", internal)
+	}
+	if limiter.tryAcquire(internal) != nil {
+		t.Fatalf("a third connection to %s was accepted", internal)
+	}
+	limiter.release(second)
+	if third := limiter.tryAcquire(internal); third == nil {
+		t.Fatalf("a released connection to %s was not reused", internal)
+	} else {
+		limiter.release(third)
+	}
+	limiter.release(first)
+
+	// the vendor gets 8 connections, until it answers with an overload error
+	vendor := "https://vendor.com/big.bin"
+	slots := make([]*hostSlot, 0)
+	for slot := limiter.tryAcquire(vendor); slot != nil; slot = limiter.tryAcquire(vendor) {
+		slots = append(slots, slot)
+	}
+	if len(slots) != 8 {
+		t.Fatalf("%d connections to %s, want 8", len(slots), vendor)
+	}
+	limiter.recordOverload(slots[0], errOriginOverloaded)
+	limiter.recordOverload(slots[1], errors.New("a connection opened before the limit was lowered"))
+	for _, slot := range slots {
+		limiter.release(slot)
+	}
+	slots = slots[:0]
+	for slot := limiter.tryAcquire(vendor); slot != nil; slot = limiter.tryAcquire(vendor) {
+		slots = append(slots, slot)
+	}
+	if len(slots) != 4 {
+		t.Fatalf("%d connections to %s after an overload, want 4", len(slots), vendor)
+	}
+
+	// the limit is raised again once the vendor keeps up
+	for i := 0; i < HOST_LIMIT_RAISE_AFTER; i++ {
+		limiter.recordSuccess(slots[len(slots)-1])
+	}
+	if limiter.tryAcquire(vendor) == nil {
+		t.Fatalf("the limit of %s was not raised", vendor)
+	}
+}
+
+func TestHostLimiterForgetsIdleHosts(t *testing.T) {
+	limiter := newHostLimiter(nil, 1, nil)
+	urls := []string{"http://a.example.com/file", "http://b.example.com/file", "http://overloaded.example.com/file"}
+	slots := make([]*hostSlot, 0, len(urls))
+	for _, url := range urls {
+		slots = append(slots, limiter.tryAcquire(url))
+		if limiter.available(url) {
+			t.Fatalf("%s has a free connection above the limit", url)
+		}
+	}
+	limiter.recordOverload(slots[2], errOriginOverloaded)
+	for _, slot := range slots {
+		limiter.release(slot)
+	}
+
+	// only the learned limit is kept once the connections are released
+	if len(limiter.hosts) != 1 || limiter.hosts["overloaded.example.com"] == nil {
+		t.Fatalf("%d hosts kept once idle, want only the one with a learned limit", len(limiter.hosts))
+	}
+	for _, url := range urls {
+		if !limiter.available(url) {
+			t.Errorf("%s has no free connection once released", url)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_MIRROR_FAILURES = 3 // failed chunks after which a mirror is dropped
+	MIRROR_MIN_CHUNKS   = 2 // chunks a mirror downloads before its speed is compared to the other mirrors
+	MIRROR_SLOWDOWN     = 4 // a mirror this many times slower than the fastest one is dropped
+)
+
+// mirrorSet is the set of URLs a task downloads its chunks from: the URL of the request and its mirrors.
+// Each attempt to download a chunk picks the next mirror in use, round-robin,
+// so the chunks are spread across the mirrors and a retry goes to another mirror.
+// A mirror that fails repeatedly or is much slower than the others is dropped, the last one is always kept.
+// A mirror on a host paused by the origin throttle, or at its connection limit, is skipped while another mirror can be used.
+type mirrorSet struct {
+	mtx      sync.Mutex
+	mirrors  []*mirror
+	next     int
+	throttle *originThrottle
+	limiter  *hostLimiter
+}
+
+type mirror struct {
+	origin   *originURL
+	failures int
+	chunks   int           // chunks downloaded from the mirror
+	bytes    int64         // bytes of the downloaded chunks
+	duration time.Duration // time spent downloading them
+	dropped  bool
+}
+
+func newMirrorSet(origins []*originURL, throttle *originThrottle, limiter *hostLimiter) *mirrorSet {
+	set := &mirrorSet{throttle: throttle, limiter: limiter}
+	for _, origin := range origins {
+		set.mirrors = append(set.mirrors, &mirror{origin: origin})
+	}
+	return set
+}
+
+// acquire picks the mirror the next attempt downloads from, and takes a connection to its host.
+// Mirrors on a host paused by the origin throttle, or without a free connection, are skipped.
+// It waits while no mirror can be used. The connection must be released once the attempt is over.
+func (s *mirrorSet) acquire(ctx context.Context) (*originURL, *hostSlot, error) {
+	return s.waitFor(ctx, true)
+}
+
+// wait waits until a mirror can be used, without taking a connection.
+// An attempt waits here before it holds an agent, and only takes the connection with acquire once it holds one,
+// so neither an agent nor a connection is held while waiting for the other.
+func (s *mirrorSet) wait(ctx context.Context) error {
+	_, _, err := s.waitFor(ctx, false)
+	return err
+}
+
+func (s *mirrorSet) waitFor(ctx context.Context, take bool) (*originURL, *hostSlot, error) {
+	for {
+		// a connection released meanwhile closes wake
+		wake := s.limiter.wake()
+		origin, slot, resume := s.tryAcquire(take)
+		if origin != nil {
+			return origin, slot, nil
+		}
+		var timer *time.Timer
+		var resumed <-chan time.Time
+		if !resume.IsZero() {
+			timer = time.NewTimer(time.Until(resume))
+			resumed = timer.C
+		}
+		select {
+		case <-wake:
+		case <-resumed:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// tryAcquire returns the next mirror in use that can be downloaded from, round-robin, with a connection to its host.
+// Without take, it only returns a mirror that can be used, nothing is taken and the round-robin does not move on.
+// When every mirror is paused by the origin throttle, it returns when the first of them resumes instead.
+func (s *mirrorSet) tryAcquire(take bool) (*originURL, *hostSlot, time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var resume time.Time
+	full := false
+	for i := range s.mirrors {
+		m := s.mirrors[(s.next+i)%len(s.mirrors)]
+		if m.dropped {
+			continue
+		}
+		if until := s.throttle.pausedUntil(m.origin.get()); !until.IsZero() {
+			if resume.IsZero() || until.Before(resume) {
+				resume = until
+			}
+			continue
+		}
+		if !take {
+			if s.limiter.available(m.origin.get()) {
+				return m.origin, nil, time.Time{}
+			}
+		} else if slot := s.limiter.tryAcquire(m.origin.get()); slot != nil {
+			s.next += i + 1
+			return m.origin, slot, time.Time{}
+		}
+		full = true
+	}
+	if full {
+		// a released connection wakes the caller up before any pause ends
+		return nil, nil, time.Time{}
+	}
+	return nil, nil, resume
+}
+
+// pause pauses the host of the mirror after the origin throttled a download from it.
+// The host is the one of the URL the mirror is downloaded from now, which is the one tryAcquire checks,
+// not the one of a stale URL the throttled attempt may have used.
+func (s *mirrorSet) pause(origin *originURL, retryAfter time.Duration) {
+	s.throttle.pause(origin.get(), retryAfter)
+}
+
+// release gives back the connection taken by acquire.
+func (s *mirrorSet) release(slot *hostSlot) {
+	s.limiter.release(slot)
+}
+
+// recordSuccess records a chunk downloaded from the mirror,
+// and drops the mirrors that are much slower than the fastest one.
+func (s *mirrorSet) recordSuccess(origin *originURL, bytes int64, duration time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	m := s.find(origin)
+	if m == nil {
+		return
+	}
+	s.throttle.recordSuccess(origin.get())
+	m.failures = 0
+	m.chunks++
+	m.bytes += bytes
+	m.duration += duration
+
+	fastest := 0.0
+	for _, m := range s.mirrors {
+		if !m.dropped && m.chunks >= MIRROR_MIN_CHUNKS {
+			fastest = max(fastest, m.rate())
+		}
+	}
+	for _, m := range s.mirrors {
+		if !m.dropped && m.chunks >= MIRROR_MIN_CHUNKS && m.rate()*MIRROR_SLOWDOWN < fastest {
+			s.dropNoLock(m, "slower than the other mirrors")
+		}
+	}
+}
+
+// recordFailure records a chunk the mirror failed to serve, the mirror is dropped after MAX_MIRROR_FAILURES in a row.
+func (s *mirrorSet) recordFailure(origin *originURL, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	m := s.find(origin)
+	if m == nil || m.dropped {
+		return
+	}
+	m.failures++
+	slog.Debug("Mirror failed a chunk", "url", origin.original, "failures", m.failures, "error", err)
+	if m.failures >= MAX_MIRROR_FAILURES {
+		s.dropNoLock(m, err.Error())
+	}
+}
+
+// drop stops using the mirror. It returns false if it is the last mirror in use, which is kept.
+func (s *mirrorSet) drop(origin *originURL, reason string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	m := s.find(origin)
+	if m == nil {
+		return false
+	}
+	return s.dropNoLock(m, reason)
+}
+
+func (s *mirrorSet) dropNoLock(m *mirror, reason string) bool {
+	if m.dropped {
+		return true
+	}
+	live := 0
+	for _, other := range s.mirrors {
+		if !other.dropped {
+			live++
+		}
+	}
+	if live <= 1 {
+		return false
+	}
+	m.dropped = true
+	slog.Warn("Mirror dropped", "url", m.origin.original, "reason", reason, "mirrorsLeft", live-1)
+	return true
+}
+
+func (s *mirrorSet) find(origin *originURL) *mirror {
+	for _, m := range s.mirrors {
+		if m.origin == origin {
+			return m
+		}
+	}
+	return nil
+}
+
+// rate returns the bytes per second the mirror served its chunks at.
+func (m *mirror) rate() float64 {
+	if m.duration <= 0 {
+		return 0
+	}
+	return float64(m.bytes) / m.duration.Seconds()
+}
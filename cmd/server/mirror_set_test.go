@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"internal/agents"
+	"internal/httputil"
+	"internal/pb"
+)
+
+func newTestMirrorSet(urls ...string) (*mirrorSet, []*originURL) {
+	origins := make([]*originURL, 0, len(urls))
+	for _, url := range urls {
+		origins = append(origins, newOriginURL(url, &httputil.RemoteFileInfo{URL: url}))
+	}
+	return newMirrorSet(origins, newOriginThrottle(agents.DefaultRetryPolicy()), newHostLimiter(nil, 0, nil)), origins
+}
+
+// picks returns the URLs of the next n mirrors the attempts download from.
+func picks(t *testing.T, set *mirrorSet, n int) []string {
+	urls := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		origin, slot, err := set.acquire(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		set.release(slot)
+		urls = append(urls, origin.get())
+	}
+	return urls
+}
+
+func TestMirrorSet(t *testing.T) {
+	const a, b, c = "http://a.example.com/file", "http://b.example.com/file", "http://c.example.com/file"
+	tests := []struct {
+		name   string
+		record func(set *mirrorSet, origins []*originURL)
+		want   []string
+	}{
+		{
+			name:   "round-robin",
+			record: func(set *mirrorSet, origins []*originURL) {},
+			want:   []string{a, b, c, a},
+		},
+		{
+			name: "failing mirror dropped",
+			record: func(set *mirrorSet, origins []*originURL) {
+				for i := 0; i < MAX_MIRROR_FAILURES; i++ {
+					set.recordFailure(origins[1], errors.New("connection reset"))
+				}
+			},
+			want: []string{a, c, a, c},
+		},
+		{
+			name: "a success resets the failures",
+			record: func(set *mirrorSet, origins []*originURL) {
+				for i := 0; i < MAX_MIRROR_FAILURES-1; i++ {
+					set.recordFailure(origins[1], errors.New("connection reset"))
+				}
+				set.recordSuccess(origins[1], 1000, time.Second)
+				set.recordFailure(origins[1], errors.New("connection reset"))
+			},
+			want: []string{a, b, c, a},
+		},
+		{
+			name: "slow mirror dropped",
+			record: func(set *mirrorSet, origins []*originURL) {
+				for i := 0; i < MIRROR_MIN_CHUNKS; i++ {
+					set.recordSuccess(origins[0], 1000, time.Second)
+					set.recordSuccess(origins[2], 1000, MIRROR_SLOWDOWN*2*time.Second)
+				}
+			},
+			want: []string{a, b, a, b},
+		},
+		{
+			name: "throttled host skipped",
+			record: func(set *mirrorSet, origins []*originURL) {
+				// the attempt downloaded from a URL resolved again since, the host of the mirror is paused
+				subTask := newSubTaskInfo(set, 1, 0, 0, 10, "", nil)
+				subTask.originError(context.Background(), origins[0], "http://stale.example.net/file", pb.NewThrottledError(time.Minute, "too many requests"))
+			},
+			want: []string{b, c, b, c},
+		},
+		{
+			name: "last mirror kept",
+			record: func(set *mirrorSet, origins []*originURL) {
+				for _, origin := range origins {
+					set.drop(origin, "test")
+				}
+			},
+			want: []string{c, c},
+		},
+	}
+
+	for _, test := range tests {
+		set, origins := newTestMirrorSet(a, b, c)
+		test.record(set, origins)
+		got := picks(t, set, len(test.want))
+		for i := range test.want {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: attempts download from %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestMirrorSetWaitsForThrottledHosts(t *testing.T) {
+	set, origins := newTestMirrorSet("http://a.example.com/file")
+	set.throttle.pause(origins[0].get(), 50*time.Millisecond)
+
+	start := time.Now()
+	got := picks(t, set, 1)
+	if got[0] != origins[0].get() || time.Since(start) < 40*time.Millisecond {
+		t.Fatalf("acquired %v after %s, want the only mirror once its host resumes", got, time.Since(start))
+	}
+
+	set.throttle.pause(origins[0].get(), time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := set.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire = %v while the only host is paused, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestMirrorSetWait(t *testing.T) {
+	const a, b = "http://a.example.com/file", "http://b.example.com/file"
+	set, origins := newTestMirrorSet(a, b)
+	set.limiter = newHostLimiter(nil, 1, nil)
+
+	// waiting for a mirror neither takes a connection nor moves the round-robin on
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := set.wait(ctx); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	origin, slot, err := set.acquire(ctx)
+	if err != nil || origin != origins[0] {
+		t.Fatalf("acquire = %v, %v after wait, want %s", origin, err, a)
+	}
+
+	// b is free, then the connections to both hosts are taken
+	if err := set.wait(ctx); err != nil {
+		t.Fatalf("wait with a free host: %v", err)
+	}
+	_, other, err := set.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	waited := make(chan error)
+	go func() { waited <- set.wait(ctx) }()
+	select {
+	case err := <-waited:
+		t.Fatalf("wait = %v while every host is at its limit", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	set.release(slot)
+	if err := <-waited; err != nil {
+		t.Fatalf("wait once a connection is released: %v", err)
+	}
+	set.release(other)
+}
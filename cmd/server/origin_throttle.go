@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"internal/agents"
+)
+
+const (
+	MAX_THROTTLE_PAUSE = 10 * time.Minute // a longer Retry-After is capped, so a bogus header does not stall the server
+	MAX_THROTTLES      = 20               // a chunk or a probe throttled this many times fails its task
+)
+
+// originThrottle pauses the downloads from the origin hosts that rate limit us.
+// When an origin answers 429 or 503, every agent would get the same answer, so instead of retrying on other agents
+// and counting the failures against them, all the subtasks downloading from the host wait until the pause ends.
+// The pause lasts as long as the Retry-After of the origin asks, or backs off as the retry policy says without one.
+type originThrottle struct {
+	mtx    sync.Mutex
+	policy agents.RetryPolicy
+	hosts  map[string]*throttledHost
+}
+
+type throttledHost struct {
+	until   time.Time // the host is paused until then
+	strikes int       // pauses since the last successful download from the host
+}
+
+func newOriginThrottle(policy agents.RetryPolicy) *originThrottle {
+	return &originThrottle{policy: policy, hosts: make(map[string]*throttledHost)}
+}
+
+// originHost returns the host a URL is throttled by.
+func originHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Host
+}
+
+// pause pauses the downloads from the host of the URL for retryAfter, or the backoff of the host if it is 0.
+// An ongoing pause is only extended, never shortened. It returns when the host resumes.
+func (t *originThrottle) pause(rawURL string, retryAfter time.Duration) time.Time {
+	host := originHost(rawURL)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	h, exists := t.hosts[host]
+	if !exists {
+		h = &throttledHost{}
+		t.hosts[host] = h
+	}
+	now := time.Now()
+	if now.Before(h.until) && retryAfter <= 0 {
+		// a request sent before the pause, it does not make the backoff longer
+		return h.until
+	}
+	if !now.Before(h.until) {
+		h.strikes++
+	}
+	delay := retryAfter
+	if delay <= 0 {
+		delay = t.policy.Backoff(h.strikes)
+	}
+	until := now.Add(min(delay, MAX_THROTTLE_PAUSE))
+	if until.After(h.until) {
+		slog.Warn("Origin throttled the downloads, pausing the host", "host", host, "retryAfter", retryAfter, "pause", until.Sub(now).Round(time.Millisecond), "strikes", h.strikes)
+		h.until = until
+	}
+	return h.until
+}
+
+// recordSuccess resets the backoff of the host of the URL after a download from it succeeded.
+func (t *originThrottle) recordSuccess(rawURL string) {
+	host := originHost(rawURL)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if h, exists := t.hosts[host]; exists && time.Now().After(h.until) {
+		delete(t.hosts, host)
+	}
+}
+
+// pausedUntil returns when the host of the URL resumes, the zero time if it is not paused.
+func (t *originThrottle) pausedUntil(rawURL string) time.Time {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	h, exists := t.hosts[originHost(rawURL)]
+	if !exists || !time.Now().Before(h.until) {
+		return time.Time{}
+	}
+	return h.until
+}
+
+// wait waits until the host of the URL is not paused. It returns the error of ctx if ctx is done first.
+func (t *originThrottle) wait(ctx context.Context, rawURL string) error {
+	return waitUntil(ctx, func() time.Time { return t.pausedUntil(rawURL) })
+}
+
+// waitUntil sleeps until the time returned by resumeTime, which is checked again after every sleep,
+// a pause may be extended meanwhile. It returns once resumeTime returns a time in the past or the zero time.
+func waitUntil(ctx context.Context, resumeTime func() time.Time) error {
+	for {
+		until := resumeTime()
+		delay := time.Until(until)
+		if until.IsZero() || delay <= 0 {
+			return ctx.Err()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"internal/agents"
+	"internal/httputil"
+)
+
+// MAX_URL_RESOLUTIONS limits how many times the URL of a task is resolved again during the task.
+const MAX_URL_RESOLUTIONS = 5
+
+// errOriginChanged is returned when the origin serves another version of the file than the one the task started with.
+// The chunks downloaded so far can not be mixed with the new version, the task restarts.
+var errOriginChanged = errors.New("file changed on the origin")
+
+// originURL is the URL of the file of a task, resolved through redirects once by the probe.
+// Agents download from the resolved URL. A signed redirect target expires,
+// so the URL is resolved again when an agent reports the origin rejected it.
+// The ETag and Last-Modified seen by the probe identify the version of the file,
+// agents make sure every chunk comes from that version.
+type originURL struct {
+	mtx          sync.Mutex
+	original     string
+	resolved     string
+	resolutions  int
+	resolving    *resolution // the resolution in progress, nil if none
+	etag         string
+	lastModified string
+}
+
+// resolution is a resolution of the original URL in progress, the subtasks hitting the same stale URL wait for it.
+type resolution struct {
+	done chan struct{} // closed once the resolution is over
+	err  error
+}
+
+func newOriginURL(original string, remoteFile *httputil.RemoteFileInfo) *originURL {
+	resolved := remoteFile.URL
+	if resolved == "" {
+		resolved = original
+	}
+	if resolved != original {
+		slog.Info("Origin URL redirected, agents download from the target", "url", original, "resolved", resolved)
+	}
+	return &originURL{
+		original:     original,
+		resolved:     resolved,
+		etag:         remoteFile.ETag,
+		lastModified: remoteFile.LastModified,
+	}
+}
+
+// get returns the URL agents download from.
+func (u *originURL) get() string {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	return u.resolved
+}
+
+// reresolve resolves the original URL again after the origin rejected the stale URL.
+// Subtasks hitting the same stale URL share one resolution, they wait for it until ctx is done.
+// The URL is probed without the lock, get does not wait for the probe.
+// A URL that was not redirected is not resolved again, the origin rejects the file itself.
+func (u *originURL) reresolve(ctx context.Context, stale string) (string, error) {
+	u.mtx.Lock()
+	if u.resolved != stale {
+		defer u.mtx.Unlock()
+		return u.resolved, nil // already resolved again by another subtask
+	}
+	if r := u.resolving; r != nil {
+		u.mtx.Unlock()
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		if r.err != nil {
+			return "", r.err
+		}
+		return u.get(), nil
+	}
+	if u.resolved == u.original {
+		defer u.mtx.Unlock()
+		return "", fmt.Errorf("%w: origin rejected %s", agents.ErrPermanent, u.original)
+	}
+	if u.resolutions >= MAX_URL_RESOLUTIONS {
+		defer u.mtx.Unlock()
+		return "", fmt.Errorf("%w: origin rejected %s after %d resolutions", agents.ErrPermanent, u.original, u.resolutions)
+	}
+	u.resolutions++
+	r := &resolution{done: make(chan struct{})}
+	u.resolving = r
+	u.mtx.Unlock()
+
+	info, err := httputil.ProbeContext(ctx, u.original)
+
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	defer close(r.done)
+	u.resolving = nil
+	if err != nil {
+		r.err = fmt.Errorf("resolving %s again: %w", u.original, permanentOriginError(err))
+		return "", r.err
+	}
+	if u.etag != "" && info.ETag != "" && info.ETag != u.etag {
+		r.err = fmt.Errorf("%w: ETag %s, expected %s", errOriginChanged, info.ETag, u.etag)
+		return "", r.err
+	}
+	slog.Info("Origin URL resolved again", "url", u.original, "stale", stale, "resolved", info.URL, "resolutions", u.resolutions)
+	u.resolved = info.URL
+	return u.resolved, nil
+}
+
+// validators returns the ETag and Last-Modified of the version of the file the task downloads.
+func (u *originURL) validators() (string, string) {
+	return u.etag, u.lastModified
+}
+
+// permanentOriginError marks the error as permanent if the origin answered with a status no retry can change, such as 404.
+func permanentOriginError(err error) error {
+	var statusErr *httputil.StatusError
+	if errors.As(err, &statusErr) && httputil.IsPermanentStatus(statusErr.StatusCode) && !agents.IsPermanent(err) {
+		return fmt.Errorf("%w: %w", agents.ErrPermanent, err)
+	}
+	return err
+}
+
+// probeOrigin probes the URL, retrying transient errors as the retry policy says.
+// It gives up at once when the origin rejects the URL.
+// When the origin throttles the probe, its host is paused and the probe waits for it, without using up an attempt.
+func probeOrigin(ctx context.Context, url string, policy agents.RetryPolicy, throttle *originThrottle) (*httputil.RemoteFileInfo, error) {
+	throttles := 0
+	for attempt := 1; ; {
+		if err := throttle.wait(ctx, url); err != nil {
+			return nil, err
+		}
+		info, err := httputil.ProbeContext(ctx, url)
+		if err == nil {
+			throttle.recordSuccess(url)
+			return info, nil
+		}
+		var statusErr *httputil.StatusError
+		if errors.As(err, &statusErr) && httputil.IsThrottlingStatus(statusErr.StatusCode) {
+			throttles++
+			if throttles >= MAX_THROTTLES {
+				return nil, fmt.Errorf("probing %s gave up, the origin throttled it %d times: %w", url, throttles, err)
+			}
+			throttle.pause(url, statusErr.RetryAfter)
+			continue
+		}
+		err = permanentOriginError(err)
+		if agents.IsPermanent(err) {
+			return nil, fmt.Errorf("probing %s failed with a permanent error, not retried: %w", url, err)
+		}
+		if attempt >= policy.Attempts {
+			return nil, fmt.Errorf("probing %s gave up after %d attempts: %w", url, attempt, err)
+		}
+		slog.Warn("Failed to probe the origin, retrying", "url", url, "attempt", attempt, "retryIn", policy.Backoff(attempt), "error", err)
+		if ctxErr := policy.Wait(ctx, attempt); ctxErr != nil {
+			return nil, ctxErr
+		}
+		attempt++
+	}
+}
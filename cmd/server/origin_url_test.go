@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"internal/httputil"
+)
+
+func TestReresolve(t *testing.T) {
+	// the origin redirects to a signed URL, the probes wait until released
+	var probes atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/file":
+			probes.Add(1)
+			<-release
+			http.Redirect(w, r, "/signed-2", http.StatusFound)
+		default:
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", "10")
+		}
+	}))
+	defer origin.Close()
+	stale := origin.URL + "/signed-1"
+	u := newOriginURL(origin.URL+"/file", &httputil.RemoteFileInfo{URL: stale})
+
+	// the subtasks hitting the stale URL share one resolution
+	const subtasks = 4
+	results := make(chan string, subtasks)
+	var wg sync.WaitGroup
+	for i := 0; i < subtasks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resolved, err := u.reresolve(context.Background(), stale)
+			if err != nil {
+				t.Errorf("reresolve: %v", err)
+			}
+			results <- resolved
+		}()
+	}
+	for probes.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the other subtasks get the URL while it is resolved, a stopped one gives up waiting
+	got := make(chan string)
+	go func() { got <- u.get() }()
+	select {
+	case url := <-got:
+		if url != stale {
+			t.Errorf("get = %s while resolving, want %s", url, stale)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("get waits for the resolution")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := u.reresolve(ctx, stale); !errors.Is(err, context.Canceled) {
+		t.Errorf("reresolve of a stopped subtask = %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	wg.Wait()
+	close(results)
+	for resolved := range results {
+		if resolved != origin.URL+"/signed-2" {
+			t.Errorf("resolved %s, want %s", resolved, origin.URL+"/signed-2")
+		}
+	}
+	if probes.Load() != 1 {
+		t.Errorf("the URL was resolved %d times, want once", probes.Load())
+	}
+}
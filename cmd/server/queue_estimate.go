@@ -0,0 +1,84 @@
+package main
+
+import (
+	"time"
+
+	"internal/pb"
+)
+
+const PENDING_UPDATE_INTERVAL = 5 * time.Second // requesters of a pending task get its queue position this often
+
+// queueLoad is the work ahead of a pending task, or of the whole queue.
+type queueLoad struct {
+	position  int   // position of the task in the queue, starting at 1, 0 if it is not pending
+	bytes     int64 // bytes left to download before the task starts
+	estimated bool  // false if the size of none of the tasks is known, bytes is 0 then
+}
+
+// queueLoad returns the work ahead of the task: what is left of the running tasks and the tasks before it in the queue.
+// With a nil task, it returns the work of all running and pending tasks.
+// The estimate follows the order the scheduler starts the pending tasks in, see scheduleOrderNoLock,
+// a task promoted or added later may still get ahead of the task.
+// The size of a task is known once it starts, the others count as the average known size.
+func (s *server) queueLoad(task *taskInfo) queueLoad {
+	pending, running := s.taskList.snapshot()
+
+	var load queueLoad
+	ahead := make([]*pb.TaskStatus, 0, len(running)+len(pending))
+	for _, runningTask := range running {
+		ahead = append(ahead, runningTask.status(0, false))
+	}
+	for i, pendingTask := range pending {
+		if pendingTask == task {
+			load.position = i + 1
+			break
+		}
+		ahead = append(ahead, pendingTask.status(i+1, false))
+	}
+	if task != nil && load.position == 0 {
+		// the task is running or finished, nothing is ahead of it
+		return queueLoad{}
+	}
+
+	var knownSize int64
+	known, unknown := 0, 0
+	for _, taskStatus := range ahead {
+		if taskStatus.GetTotalSize() > 0 {
+			knownSize += taskStatus.GetTotalSize()
+			load.bytes += max(taskStatus.GetTotalSize()-taskStatus.GetDownloadedBytes(), 0)
+			known++
+		} else {
+			unknown++
+		}
+	}
+	if known > 0 {
+		load.bytes += int64(unknown) * (knownSize / int64(known))
+		load.estimated = true
+	} else {
+		load.estimated = unknown == 0
+	}
+	return load
+}
+
+// wait returns the time to download the bytes of the load at the recent throughput of the server, 0 if it is unknown.
+func (s *server) wait(load queueLoad) time.Duration {
+	speed := s.throughput.rate()
+	if !load.estimated || speed <= 0 {
+		return 0
+	}
+	return time.Duration(load.bytes/int64(speed)) * time.Second
+}
+
+// pendingStatus returns the PENDING status sent to the requesters of a task waiting in the queue.
+func (s *server) pendingStatus(task *taskInfo, message string) *pb.DownloadStatus {
+	load := s.queueLoad(task)
+	return &pb.DownloadStatus{
+		Status:               pb.DownloadStatusType_PENDING,
+		ClientCount:          int32(s.agentList.Count()),
+		NumberInQueue:        int32(load.position),
+		TaskId:               int32(task.id),
+		TotalSize:            task.getTotalSize(),
+		Message:              message,
+		EstimatedWaitSeconds: int64(s.wait(load).Seconds()),
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueLoad(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(s *server) *taskInfo // returns the task to get the load of, nil for the whole queue
+		want  queueLoad
+	}{
+		{
+			// the pending tasks of unknown size count as the running one
+			name:  "whole queue",
+			setup: func(s *server) *taskInfo { return nil },
+			want:  queueLoad{bytes: 300, estimated: true},
+		},
+		{
+			name:  "pending task",
+			setup: func(s *server) *taskInfo { return s.taskList.getTask(3) },
+			want:  queueLoad{position: 2, bytes: 200, estimated: true},
+		},
+		{
+			name:  "running task",
+			setup: func(s *server) *taskInfo { return s.taskList.getTask(1) },
+			want:  queueLoad{},
+		},
+		{
+			name: "no known size",
+			setup: func(s *server) *taskInfo {
+				s.taskList.getTask(1).totalSize = 0
+				return s.taskList.getTask(2)
+			},
+			want: queueLoad{position: 1},
+		},
+	}
+
+	for _, test := range tests {
+		s := newTestServer(t)
+		if got := s.queueLoad(test.setup(s)); got != test.want {
+			t.Errorf("%s: queueLoad = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name       string
+		load       queueLoad
+		downloaded int64 // bytes downloaded in the last 10 seconds
+		want       time.Duration
+	}{
+		{name: "no throughput", load: queueLoad{bytes: 1000, estimated: true}, want: 0},
+		{name: "not estimated", load: queueLoad{position: 1}, downloaded: 10000, want: 0},
+		{name: "estimated", load: queueLoad{bytes: 20000, estimated: true}, downloaded: 10000, want: 20 * time.Second},
+	}
+
+	for _, test := range tests {
+		s := &server{throughput: newThroughputMeter(THROUGHPUT_WINDOW)}
+		if test.downloaded > 0 {
+			s.throughput.add(test.downloaded, 10*time.Second)
+		}
+		// the throughput is a little lower than 1000 bytes per second once measured, the wait a little longer
+		if got := s.wait(test.load); got < test.want || got > test.want+time.Second {
+			t.Errorf("%s: wait = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"internal/pb"
+)
+
+// CancelDownload cancels a task for everyone when an admin calls it, see authorizeAdmin,
+// such as a runaway task or a task restored without requesters.
+// Otherwise it cancels the download of the task for the requester calling it, only a requester of the task may.
+// The task itself is only cancelled once no other requester waits for it, the others keep downloading the file.
+func (s *server) CancelDownload(ctx context.Context, req *pb.CancelDownloadRequest) (*pb.CancelDownloadResponse, error) {
+	taskID := int(req.GetTaskId())
+	requester := requesterFromContext(ctx)
+	slog.Info("Received cancel request", "taskID", taskID, "requester", requester)
+
+	task := s.taskList.getTask(taskID)
+	if task == nil {
+		return cancelDownloadFailed(taskID, fmt.Errorf("task #%d not found", taskID))
+	}
+	if s.authorizeAdmin(ctx) == nil {
+		if err := s.taskList.cancelTask(taskID, "cancelled by an admin"); err != nil {
+			return cancelDownloadFailed(taskID, err)
+		}
+		return &pb.CancelDownloadResponse{
+			Success: true,
+			Message: fmt.Sprintf("task #%d cancelled", taskID),
+		}, nil
+	}
+	isRequester, remaining := task.detachRequester(requesterHost(requester))
+	if !isRequester {
+		return cancelDownloadFailed(taskID, fmt.Errorf("task #%d was not requested by %s", taskID, requesterHost(requester)))
+	}
+	if remaining > 0 {
+		slog.Info("Task goes on for its other requesters", "taskID", taskID, "requesters", remaining)
+		return &pb.CancelDownloadResponse{
+			Success: true,
+			Message: fmt.Sprintf("download of task #%d cancelled, the task goes on for %d other requesters", taskID, remaining),
+		}, nil
+	}
+
+	err := s.taskList.cancelTask(taskID, "cancelled by request")
+	if err != nil {
+		return cancelDownloadFailed(taskID, err)
+	}
+
+	return &pb.CancelDownloadResponse{
+		Success: true,
+		Message: fmt.Sprintf("task #%d cancelled", taskID),
+	}, nil
+}
+
+func cancelDownloadFailed(taskID int, err error) (*pb.CancelDownloadResponse, error) {
+	slog.Warn("Failed to cancel task", "taskID", taskID, "error", err)
+	return &pb.CancelDownloadResponse{
+		Success: false,
+		Message: err.Error(),
+	}, nil
+}
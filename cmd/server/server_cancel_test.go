@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"internal/pb"
+)
+
+func TestCancelDownload(t *testing.T) {
+	tests := []struct {
+		name          string
+		caller        string
+		token         string // admin token sent by the caller
+		wantSuccess   bool
+		wantCancelled bool
+	}{
+		{name: "other host", caller: "10.0.0.2:40000"},
+		{name: "other host with the admin token", caller: "10.0.0.2:40000", token: "secret", wantSuccess: true, wantCancelled: true},
+		{name: "server host", caller: "127.0.0.1:40000", wantSuccess: true, wantCancelled: true},
+		{name: "requester", caller: "10.0.0.1:40001", wantSuccess: true, wantCancelled: true},
+	}
+
+	for _, test := range tests {
+		// task #2 is pending, requested by 10.0.0.1
+		s := newTestServer(t)
+		s.adminToken = "secret"
+		addr, err := net.ResolveTCPAddr("tcp", test.caller)
+		if err != nil {
+			t.Fatalf("%s: ResolveTCPAddr: %v", test.name, err)
+		}
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+		if test.token != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ADMIN_TOKEN_METADATA, test.token))
+		}
+
+		resp, err := s.CancelDownload(ctx, &pb.CancelDownloadRequest{TaskId: 2})
+		if err != nil || resp.Success != test.wantSuccess {
+			t.Errorf("%s: CancelDownload = %v, %v, want success %v", test.name, resp, err, test.wantSuccess)
+		}
+		if cancelled := s.taskList.getTask(2) == nil; cancelled != test.wantCancelled {
+			t.Errorf("%s: task cancelled %v, want %v", test.name, cancelled, test.wantCancelled)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"internal/pb"
+)
+
+// ControlAgent drains, shuts down or resizes an agent, and pushes the matching command on its session.
+// The agent list stops giving new downloads to a drained or shut down agent at once, the agent leaves by ending its session.
+// Only admins may control an agent, see authorizeAdmin.
+func (s *server) ControlAgent(ctx context.Context, req *pb.ControlAgentRequest) (*pb.ControlAgentResponse, error) {
+	agentID := int(req.GetAgentId())
+	slog.Info("Received agent control request", "agentID", agentID, "action", req.GetAction(), "maxConcurrency", req.GetMaxConcurrency(), "requester", requesterFromContext(ctx))
+	if err := s.authorizeAdmin(ctx); err != nil {
+		slog.Warn("Refused to control agent", "agentID", agentID, "error", err)
+		return nil, err
+	}
+
+	var command *pb.AgentCommand
+	var message string
+	switch req.GetAction() {
+	case pb.AgentAction_AGENT_DRAIN:
+		if !s.agentList.DrainAgent(agentID) {
+			return controlAgentFailed(agentID, fmt.Errorf("agent #%d not found", agentID))
+		}
+		command = &pb.AgentCommand{Command: &pb.AgentCommand_Drain{Drain: &pb.DrainAgent{}}}
+		message = fmt.Sprintf("agent #%d draining, it leaves once its downloads are done", agentID)
+	case pb.AgentAction_AGENT_SHUTDOWN:
+		if !s.agentList.DrainAgent(agentID) {
+			return controlAgentFailed(agentID, fmt.Errorf("agent #%d not found", agentID))
+		}
+		command = &pb.AgentCommand{Command: &pb.AgentCommand_Shutdown{Shutdown: &pb.ShutdownAgent{
+			Reason: fmt.Sprintf("shut down by %s", requesterFromContext(ctx)),
+		}}}
+		message = fmt.Sprintf("agent #%d shutting down", agentID)
+	case pb.AgentAction_AGENT_SET_SLOTS:
+		slots := int(req.GetMaxConcurrency())
+		if slots < 1 {
+			return controlAgentFailed(agentID, fmt.Errorf("invalid number of slots %d, at least 1 is needed", slots))
+		}
+		if !s.agentList.SetSlots(agentID, slots) {
+			return controlAgentFailed(agentID, fmt.Errorf("agent #%d not found", agentID))
+		}
+		command = &pb.AgentCommand{Command: &pb.AgentCommand_Config{Config: &pb.AgentConfig{MaxConcurrency: int32(slots)}}}
+		message = fmt.Sprintf("agent #%d runs %d downloads at the same time", agentID, slots)
+	default:
+		return controlAgentFailed(agentID, fmt.Errorf("unknown action %s", req.GetAction()))
+	}
+
+	if err := s.sessions.send(agentID, command); err != nil {
+		return controlAgentFailed(agentID, fmt.Errorf("failed to send the command to agent #%d: %w", agentID, err))
+	}
+	return &pb.ControlAgentResponse{
+		Success: true,
+		Message: message,
+	}, nil
+}
+
+func controlAgentFailed(agentID int, err error) (*pb.ControlAgentResponse, error) {
+	slog.Warn("Failed to control agent", "agentID", agentID, "error", err)
+	return &pb.ControlAgentResponse{
+		Success: false,
+		Message: err.Error(),
+	}, nil
+}
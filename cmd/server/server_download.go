@@ -1,24 +1,54 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"os"
 	"time"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
 	"internal/pb"
 )
 
 func (s *server) Download(req *pb.DownloadRequest, stream pb.DDSONService_DownloadServer) error {
-	slog.Info("Received download request", "url", req.GetUrl(), "agentID", req.GetClientId())
+	slog.Info("Received download request", "url", req.GetUrl(), "mirrors", req.GetMirrors(), "batchID", req.GetBatchId(), "priority", req.GetPriority(), "taskID", req.GetTaskId(), "agentID", req.GetClientId())
 
 	// TODO: maybe later, only allow download from registered clients
 	slog.Warn("NOT checking client id for now. implement later")
 	agentID := 0
 
-	// Send initial status as PENDING
+	// reattach to a task by ID, for example after the server or the requester restarted
+	downloadUrl, mirrors, checksum := req.GetUrl(), req.GetMirrors(), req.GetChecksum()
+	if req.GetTaskId() != 0 {
+		taskInfo, sub, err := s.taskList.attachTask(int(req.GetTaskId()), stream, requesterFromContext(stream.Context()))
+		if err == nil {
+			return s.waitForTask(taskInfo, sub, "reattached to task")
+		}
+
+		// the task is not in the queue any more, it may have completed and been cached
+		persisted, dbErr := s.persistency.GetTask(int(req.GetTaskId()))
+		if dbErr != nil || persisted == nil {
+			slog.Warn("Task to reattach not found", "taskID", req.GetTaskId(), "error", err)
+			return err
+		}
+		slog.Info("Task to reattach is finished, downloading its file", "taskID", persisted.Id, "state", persisted.State)
+		downloadUrl, checksum = persisted.URL, persisted.Checksum
+		if mirrors, dbErr = s.persistency.GetTaskMirrors(int(persisted.Id)); dbErr != nil {
+			slog.Warn("Failed to load task mirrors, downloading from the URL only", "taskID", persisted.Id, "error", dbErr)
+		}
+	}
+
+	// Send initial status as PENDING, the position in the queue comes once the task is queued
 	err := stream.Send(&pb.DownloadStatus{
-		Status:        pb.DownloadStatusType_PENDING,
-		ClientCount:   int32(s.agentList.Count()),
-		NumberInQueue: int32(s.taskList.size()),
+		Status:      pb.DownloadStatusType_PENDING,
+		ClientCount: int32(s.agentList.Count()),
 	})
 	if err != nil {
 		slog.Error("Failed to send initial status", "error", err)
@@ -26,40 +56,55 @@ func (s *server) Download(req *pb.DownloadRequest, stream pb.DDSONService_Downlo
 	}
 
 	// Check in the database if the file is cached
-	cached, err := s.persistency.GetPersistedFile(req.GetUrl(), req.GetChecksum())
+	cached, err := s.persistency.GetPersistedFile(downloadUrl, checksum)
 	if err != nil {
-		slog.Error("Failed to check cached file", "url", req.GetUrl(), "error", err)
+		slog.Error("Failed to check cached file", "url", downloadUrl, "error", err)
 	} else if cached != "" {
-		slog.Info("File is cached, sending cached file", "url", req.GetUrl(), "cachedPath", cached)
+		slog.Info("File is cached, sending cached file", "url", downloadUrl, "cachedPath", cached)
 		// Send file content from cache
 		// transferFileData is from distributed_download.go, consider moving this method to a common place
-		return transferFileData(stream, cached)
+		return transferFileData(stream.Send, cached)
 	} else {
-		slog.Info("File is not cached, proceed with download", "url", req.GetUrl())
+		slog.Info("File is not cached, proceed with download", "url", downloadUrl)
 	}
 
-	// Create a task and add it to task list
-	taskInfo := s.taskList.addTask(req.GetUrl(), req.GetChecksum(), stream, agentID)
-
-	// wait for the task to complete
-	// TODO: periodically update the status (using select?)
-	<-taskInfo.done
+	// Create a task and add it to task list, or attach to the task that is already downloading the file
+	taskInfo, sub, attached := s.taskList.addTask(downloadUrl, mirrors, checksum, requesterFromContext(stream.Context()), req.GetBatchId(), req.GetPriority(), stream, agentID)
+	message := fmt.Sprintf("task #%d created", taskInfo.id)
+	if attached {
+		message = fmt.Sprintf("attached to in-flight task #%d", taskInfo.id)
+	}
+	return s.waitForTask(taskInfo, sub, message)
+}
 
-	if taskInfo.err != nil {
-		slog.Error("Task is done, error in task", "error", taskInfo.err)
-		return taskInfo.err
+// waitForTask sends the file of the task to the requester, while the task downloads it.
+func (s *server) waitForTask(taskInfo *taskInfo, sub *subscriber, message string) error {
+	stream := sub.stream
+	err := sub.send(s.pendingStatus(taskInfo, message))
+	if err != nil {
+		slog.Error("Failed to send task status", "error", err)
+		s.detachFromTask(taskInfo, sub)
+		return err
 	}
 
-	// save the downloaded file to persistency
-	if taskInfo.downloadedFile != "" {
-		slog.Info("Saving downloaded file to persistency", "path", taskInfo.downloadedFile)
-		err = s.persistency.AddDownloadedFile(req.GetUrl(), taskInfo.downloadedFile, req.GetChecksum())
-		if err != nil {
-			slog.Error("Failed to save downloaded file", "url", req.GetUrl(), "error", err)
+	// stream the file while the task is downloading it, until the task completes or the requester goes away
+	err = s.streamTask(taskInfo, sub)
+	if err != nil {
+		if stream.Context().Err() != nil {
+			slog.Info("Requester disconnected, detaching from task", "taskID", taskInfo.id, "subscriberID", sub.id)
+			s.detachFromTask(taskInfo, sub)
+			return stream.Context().Err()
 		}
-	} else {
-		slog.Debug("No need to update persistency")
+		taskInfo.detach(sub)
+		if status.Code(err) == codes.Canceled {
+			slog.Info("Requester cancelled its download", "taskID", taskInfo.id, "subscriberID", sub.id)
+			return err
+		}
+		slog.Error("Error streaming task file", "taskID", taskInfo.id, "error", err)
+		return err
 	}
+	taskInfo.detach(sub)
+	slog.Info("File transfer completed", "taskID", taskInfo.id, "file", taskInfo.downloadedFile)
 
 	// cleanup persistency
 	slog.Debug("Cleaning up persistency")
@@ -67,7 +112,148 @@ func (s *server) Download(req *pb.DownloadRequest, stream pb.DDSONService_Downlo
 	if err != nil {
 		slog.Warn("Failed to cleanup persistency", "error", err)
 	}
+	err = s.persistency.CleanupTasks(time.Second * 60 * 60 * 24 * 16) // 16 days
+	if err != nil {
+		slog.Warn("Failed to cleanup finished tasks", "error", err)
+	}
+	err = s.persistency.CleanupStaging(time.Second * 60 * 60 * 24 * 16) // 16 days
+	if err != nil {
+		slog.Warn("Failed to cleanup staging directories", "error", err)
+	}
 
-	slog.Info("Task is done", "url", req.GetUrl())
+	slog.Info("Task is done", "taskID", taskInfo.id, "url", taskInfo.downloadUrl)
 	return nil
 }
+
+// requesterFromContext returns the address of the requester of a stream.
+func requesterFromContext(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	return p.Addr.String()
+}
+
+// requesterHost returns the host of the address of a requester. Every stream of a requester comes from another port.
+func requesterHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// detachFromTask detaches the requester from the task, and cancels the task if nobody else is waiting for it.
+func (s *server) detachFromTask(task *taskInfo, sub *subscriber) {
+	if task.detach(sub) > 0 {
+		return
+	}
+	err := s.taskList.cancelTask(task.id, "all requesters disconnected")
+	if err != nil {
+		slog.Debug("Task not cancelled", "taskID", task.id, "error", err)
+	}
+}
+
+// streamTask sends the assembled part of the task file to the requester, in order, as the file grows.
+// It returns once the whole file is sent and the task has completed,
+// so the requester still gets an error if the validation of the file fails after the transfer.
+// While the task is pending, the requester gets its position in the queue every PENDING_UPDATE_INTERVAL.
+func (s *server) streamTask(task *taskInfo, sub *subscriber) error {
+	ctx := sub.stream.Context()
+	pendingTicker := time.NewTicker(PENDING_UPDATE_INTERVAL)
+	defer pendingTicker.Stop()
+	var file *os.File
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	buffer := make([]byte, 1024*1024) // 1 MB buffer
+	sent := int64(0)
+	generation := 0
+	taskDone := false
+	for {
+		path, assembled, gen, notify := task.assembledState()
+		if gen != generation {
+			// the task restarted after the file changed on the origin, the new file is sent from the start
+			generation = gen
+			if file != nil {
+				file.Close()
+				file = nil
+			}
+			if sent > 0 {
+				slog.Info("Task restarted, requester discards the transferred data", "taskID", task.id, "subscriberID", sub.id, "sent", sent)
+				err := sub.send(&pb.DownloadStatus{
+					Status:    pb.DownloadStatusType_TRANSFERRING,
+					Restarted: true,
+				})
+				if err != nil {
+					slog.Error("Error sending restart", "error", err)
+					return err
+				}
+				sent = 0
+			}
+		}
+		if file == nil && path != "" {
+			f, err := os.Open(path)
+			if err == nil {
+				file = f
+			} else if !errors.Is(err, os.ErrNotExist) {
+				slog.Error("Error opening file", "path", path, "error", err)
+				return err
+			}
+			// else the file was moved to the cache or removed, its new path comes with the next notification
+		}
+
+		if file != nil && sent < assembled {
+			n, err := file.ReadAt(buffer[:min(int64(len(buffer)), assembled-sent)], sent)
+			if err != nil && (err != io.EOF || n == 0) {
+				slog.Error("Error reading file", "path", path, "sent", sent, "assembled", assembled, "error", err)
+				return err
+			}
+			slog.Log(context.Background(), slog.LevelDebug-1, "Sending bytes", "taskID", task.id, "count", n, "totalSent", sent)
+			err = sub.send(&pb.DownloadStatus{
+				Status:    pb.DownloadStatusType_TRANSFERRING,
+				Data:      buffer[:n],
+				TotalSize: task.getTotalSize(),
+			})
+			if err != nil {
+				slog.Error("Error sending file data", "error", err)
+				return err
+			}
+			sent += int64(n)
+			continue
+		}
+
+		if taskDone {
+			if err := task.getError(); err != nil {
+				return err
+			}
+			totalSize := task.getTotalSize()
+			if file != nil && sent == totalSize {
+				return nil
+			}
+			return fmt.Errorf("task #%d completed, but only %d of %d bytes were sent", task.id, sent, totalSize)
+		}
+
+		select {
+		case <-notify:
+		case <-task.done:
+			// send what is left, then report the result of the task
+			taskDone = true
+		case <-pendingTicker.C:
+			if !task.isPending() {
+				continue
+			}
+			if err := sub.send(s.pendingStatus(task, "")); err != nil {
+				slog.Error("Error sending pending status", "error", err)
+				return err
+			}
+		case <-sub.cancelled:
+			return status.Errorf(codes.Canceled, "download of task #%d cancelled by the requester", task.id)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"internal/pb"
+)
+
+// PromoteTask moves a pending task to the front of the queue, ahead of the tasks of other requesters.
+// Only admins may promote a task, see authorizeAdmin.
+func (s *server) PromoteTask(ctx context.Context, req *pb.PromoteTaskRequest) (*pb.PromoteTaskResponse, error) {
+	taskID := int(req.GetTaskId())
+	slog.Info("Received promote request", "taskID", taskID, "requester", requesterFromContext(ctx))
+	if err := s.authorizeAdmin(ctx); err != nil {
+		slog.Warn("Refused to promote task", "taskID", taskID, "error", err)
+		return nil, err
+	}
+
+	err := s.taskList.promoteTask(taskID)
+	if err != nil {
+		slog.Warn("Failed to promote task", "taskID", taskID, "error", err)
+		return &pb.PromoteTaskResponse{
+			Success: false,
+			Message: err.Error(),
+		}, nil
+	}
+
+	return &pb.PromoteTaskResponse{
+		Success: true,
+		Message: fmt.Sprintf("task #%d moved to the front of the queue", taskID),
+	}, nil
+}
@@ -2,19 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
-	"time"
 
 	"internal/agents"
 	"internal/pb"
 	"internal/version"
 
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
-func (s *server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.RegisterResponse, error) {
+const MAX_AGENT_IDENTITY = 128 // characters of the identity an agent registers with
+
+// registerAgent adds the agent opening a session to the agent list, ctx is the context of the session.
+func (s *server) registerAgent(ctx context.Context, req *pb.RegisterRequest) (*agents.AgentImpl, error) {
 	slog.Debug("Agent registering", "name", req.Name, "version", req.Version)
 
 	// check if version is compatible
@@ -40,29 +45,29 @@ func (s *server) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.Reg
 	port := int(req.Port)
 
 	addr := net.JoinHostPort(agentAddr, fmt.Sprintf("%d", port))
-	slog.Debug("Agent info", "address", addr, "port", port, "version", req.Version, "name", req.Name)
+	slog.Debug("Agent info", "address", addr, "port", port, "version", req.Version, "name", req.Name, "maxConcurrency", req.MaxConcurrency)
+
+	if len(req.Identity) > MAX_AGENT_IDENTITY {
+		return nil, status.Errorf(codes.InvalidArgument, "agent identity longer than %d characters", MAX_AGENT_IDENTITY)
+	}
 
 	// Create new agent
-	newAgent := agents.NewAgent(req.Name, req.Version, addr)
+	newAgent, err := agents.NewAgent(req.Name, req.Version, addr, req.Identity, int(req.MaxConcurrency))
+	if err != nil {
+		slog.Error("Failed to connect to agent", "error", err, "name", req.Name, "address", addr)
+		return nil, err
+	}
 	id, err := s.agentList.AddAgent(newAgent)
 	if err != nil {
 		slog.Error("Failed to register agent", "error", err, "name", req.Name, "address", agentAddr, "port", port)
+		newAgent.Close()
+		var exists *agents.AlreadyExistsError
+		if errors.As(err, &exists) {
+			// the other session may be a stale one, the agent retries once it is gone
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
 		return nil, err
 	}
-	heartbeatTimer := time.NewTimer(20 * time.Second)
-	s.heartbeatTimers[id] = heartbeatTimer
-
-	go func() {
-		<-heartbeatTimer.C
-		slog.Debug("Heartbeat timer expired, removing agent", "agentID", id, "name", req.Name, "address", addr)
-		newAgent.Retire()
-		s.agentList.RemoveAgent(id)
-		delete(s.heartbeatTimers, id)
-	}()
-
-	slog.Info("Agent registered", "name", req.Name, "id", id, "address", addr)
-	return &pb.RegisterResponse{
-		Id:            int32(id),
-		ServerVersion: version.CurrentVersion().String(),
-	}, nil
+	slog.Info("Agent registered", "name", req.Name, "id", id, "address", addr, "identity", req.Identity, "slots", newAgent.GetSlots())
+	return newAgent, nil
 }
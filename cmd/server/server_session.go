@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"internal/agents"
+	"internal/pb"
+	"internal/version"
+)
+
+const (
+	AGENT_REPORT_INTERVAL = 5 * time.Second           // how often the agents report on their session
+	AGENT_SESSION_TIMEOUT = 4 * AGENT_REPORT_INTERVAL // an agent that did not report for this long is removed
+)
+
+// nextAttemptID numbers the DownloadPart calls, so an AbortSubtask command can name one.
+var nextAttemptID atomic.Int64
+
+// agentSession is the AgentSession stream of a registered agent, the server pushes commands on it.
+type agentSession struct {
+	agentID int
+	stream  pb.DDSONService_AgentSessionServer
+	sendMtx sync.Mutex // the commands are sent from the handlers of other calls
+}
+
+func (session *agentSession) send(command *pb.AgentCommand) error {
+	session.sendMtx.Lock()
+	defer session.sendMtx.Unlock()
+	return session.stream.Send(command)
+}
+
+// agentSessions are the sessions of the registered agents, by agent ID.
+type agentSessions struct {
+	mtx      sync.Mutex
+	sessions map[int]*agentSession
+}
+
+func newAgentSessions() *agentSessions {
+	return &agentSessions{sessions: make(map[int]*agentSession)}
+}
+
+func (sessions *agentSessions) add(session *agentSession) {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	sessions.sessions[session.agentID] = session
+}
+
+// remove removes the session, unless a returning agent already opened a new one with the same agent ID.
+func (sessions *agentSessions) remove(session *agentSession) {
+	sessions.mtx.Lock()
+	defer sessions.mtx.Unlock()
+	if sessions.sessions[session.agentID] == session {
+		delete(sessions.sessions, session.agentID)
+	}
+}
+
+// send pushes a command to the agent. It fails if the agent has no session.
+func (sessions *agentSessions) send(agentID int, command *pb.AgentCommand) error {
+	sessions.mtx.Lock()
+	session, exists := sessions.sessions[agentID]
+	sessions.mtx.Unlock()
+	if !exists {
+		return fmt.Errorf("agent #%d has no session", agentID)
+	}
+	return session.send(command)
+}
+
+// abort tells the agent to stop an attempt the server no longer waits for.
+// Cancelling the DownloadPart call already stops it, unless the connection to the agent is broken.
+func (sessions *agentSessions) abort(agentID int, attemptID int64, subtaskID int, reason error) {
+	err := sessions.send(agentID, &pb.AgentCommand{Command: &pb.AgentCommand_Abort{Abort: &pb.AbortSubtask{
+		AttemptId: attemptID,
+		SubtaskId: int32(subtaskID),
+		Reason:    reason.Error(),
+	}}})
+	if err != nil {
+		slog.Debug("Failed to abort the subtask on the agent", "agentID", agentID, "subtaskID", subtaskID, "attemptID", attemptID, "error", err)
+	}
+}
+
+// AgentSession registers the agent with the first message of the stream, and keeps it in the agent list until the stream ends.
+// The agent reports every AGENT_REPORT_INTERVAL, it is removed if it stays silent for AGENT_SESSION_TIMEOUT.
+func (s *server) AgentSession(stream pb.DDSONService_AgentSessionServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	req := msg.GetRegister()
+	if req == nil {
+		return status.Error(codes.InvalidArgument, "the first message of a session must register the agent")
+	}
+	agent, err := s.registerAgent(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	id := agent.GetAgentInfo().GetID()
+	session := &agentSession{agentID: id, stream: stream}
+	s.sessions.add(session)
+	defer func() {
+		s.sessions.remove(session)
+		s.agentList.RemoveAgent(agent)
+	}()
+
+	err = session.send(&pb.AgentCommand{Command: &pb.AgentCommand_Registered{Registered: &pb.RegisterResponse{
+		Success:       true,
+		Id:            int32(id),
+		ServerVersion: version.CurrentVersion().String(),
+	}}})
+	if err == nil {
+		err = session.send(&pb.AgentCommand{Command: &pb.AgentCommand_Config{Config: &pb.AgentConfig{
+			ReportIntervalSeconds: int32(AGENT_REPORT_INTERVAL / time.Second),
+		}}})
+	}
+	if err != nil {
+		slog.Warn("Failed to answer the registration of the agent", "agentID", id, "error", err)
+		return err
+	}
+
+	// Recv blocks, it runs in a goroutine so a silent agent times out. It returns once the handler returns
+	reports := make(chan *pb.AgentMessage)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case reports <- msg:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	timeout := time.NewTimer(AGENT_SESSION_TIMEOUT)
+	defer timeout.Stop()
+	for {
+		select {
+		case msg := <-reports:
+			timeout.Reset(AGENT_SESSION_TIMEOUT)
+			if s.agentList.GetAgentByID(id) != agents.Agent(agent) {
+				// banned meanwhile, the agent registers again once the ban expires
+				slog.Info("Agent no longer in the agent list, ending its session", "agentID", id, "name", req.Name)
+				return status.Error(codes.Aborted, "agent removed from the agent list")
+			}
+			s.handleAgentReport(id, msg.GetReport())
+		case err := <-recvErr:
+			slog.Info("Agent session ended, removing agent", "agentID", id, "name", req.Name, "error", err)
+			return nil
+		case <-timeout.C:
+			slog.Warn("Agent stopped reporting, removing agent", "agentID", id, "name", req.Name, "timeout", AGENT_SESSION_TIMEOUT)
+			return status.Errorf(codes.DeadlineExceeded, "no report for %s", AGENT_SESSION_TIMEOUT)
+		}
+	}
+}
+
+// handleAgentReport applies the report of the agent to the agent list.
+// The agent is the authority on its slots, it refuses the downloads above them, the agent list follows it.
+// A report sent before a new configuration reached the agent reverts the slots until its next report.
+func (s *server) handleAgentReport(agentID int, report *pb.AgentReport) {
+	if report == nil {
+		slog.Warn("Unexpected message on the agent session", "agentID", agentID)
+		return
+	}
+	slog.Log(context.Background(), slog.LevelDebug-1, "Agent report received", "agentID", agentID, "running", report.Running, "slots", report.Slots, "draining", report.Draining)
+	if report.Draining {
+		// the agent is leaving on its own, it gets no new download
+		s.agentList.DrainAgent(agentID)
+	}
+	state, ok := s.agentList.AgentState(agentID)
+	if !ok {
+		// banned or removed while the report was on its way
+		return
+	}
+	if report.Slots > 0 && int(report.Slots) != state.Slots {
+		slog.Info("Agent reports other slots than the agent list, following the agent", "agentID", agentID, "slots", report.Slots, "listSlots", state.Slots)
+		s.agentList.SetSlots(agentID, int(report.Slots))
+	}
+	if int(report.Running) > state.Running {
+		// downloads the server stopped waiting for, the agent refuses new ones with AGENT_BUSY while they hold its slots
+		slog.Warn("Agent runs more downloads than the server gave it", "agentID", agentID, "running", report.Running, "given", state.Running)
+	}
+}
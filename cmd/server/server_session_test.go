@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"internal/agents"
+	"internal/pb"
+	"internal/version"
+)
+
+// testSessionStream is the AgentSession stream of an agent, the test sends its messages and reads the commands of the server.
+type testSessionStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	messages chan *pb.AgentMessage // closed to end the session
+	commands chan *pb.AgentCommand
+}
+
+func newTestSessionStream(t *testing.T, addr string) *testSessionStream {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatalf("ResolveTCPAddr: %v", err)
+	}
+	ctx, cancel := context.WithCancel(peer.NewContext(context.Background(), &peer.Peer{Addr: tcpAddr}))
+	t.Cleanup(cancel)
+	return &testSessionStream{ctx: ctx, messages: make(chan *pb.AgentMessage), commands: make(chan *pb.AgentCommand, 16)}
+}
+
+func (stream *testSessionStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *testSessionStream) Recv() (*pb.AgentMessage, error) {
+	select {
+	case msg, ok := <-stream.messages:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-stream.ctx.Done():
+		return nil, stream.ctx.Err()
+	}
+}
+
+func (stream *testSessionStream) Send(command *pb.AgentCommand) error {
+	stream.commands <- command
+	return nil
+}
+
+func (stream *testSessionStream) command(t *testing.T) *pb.AgentCommand {
+	select {
+	case command := <-stream.commands:
+		return command
+	case <-time.After(time.Second):
+		t.Fatalf("no command sent on the session")
+		return nil
+	}
+}
+
+func register(slots int32) *pb.AgentMessage {
+	return &pb.AgentMessage{Message: &pb.AgentMessage_Register{Register: &pb.RegisterRequest{
+		Name:           "agent",
+		Version:        version.VersionString,
+		Port:           6000,
+		MaxConcurrency: slots,
+	}}}
+}
+
+func report(running int32, slots int32, draining bool) *pb.AgentMessage {
+	return &pb.AgentMessage{Message: &pb.AgentMessage_Report{Report: &pb.AgentReport{Running: running, Slots: slots, Draining: draining}}}
+}
+
+// waitForAgentState waits until the agent list reports the agent as check wants it.
+func waitForAgentState(t *testing.T, s *server, id int, check func(agents.AgentState) bool) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, state := range s.agentList.AgentStates() {
+			if state.ID == id && check(state) {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("agent #%d not in the expected state: %+v", id, s.agentList.AgentStates())
+}
+
+func TestAgentSession(t *testing.T) {
+	s := newTestServer(t)
+	s.sessions = newAgentSessions()
+	stream := newTestSessionStream(t, "127.0.0.1:40000")
+	result := make(chan error)
+	go func() { result <- s.AgentSession(stream) }()
+
+	stream.messages <- register(1)
+	registered := stream.command(t).GetRegistered()
+	if registered == nil || !registered.Success {
+		t.Fatalf("registration answered with %v", registered)
+	}
+	id := int(registered.Id)
+	if config := stream.command(t).GetConfig(); config.GetReportIntervalSeconds() != int32(AGENT_REPORT_INTERVAL/time.Second) {
+		t.Fatalf("configuration %v sent once registered, want the report interval", config)
+	}
+
+	// the agent list follows the slots the agent reports
+	stream.messages <- report(0, 3, false)
+	waitForAgentState(t, s, id, func(state agents.AgentState) bool { return state.Slots == 3 })
+
+	// an admin resizes the agent, the new slots are pushed on the session
+	resp, err := s.ControlAgent(stream.ctx, &pb.ControlAgentRequest{AgentId: int32(id), Action: pb.AgentAction_AGENT_SET_SLOTS, MaxConcurrency: 2})
+	if err != nil || !resp.Success {
+		t.Fatalf("ControlAgent = %v, %v", resp, err)
+	}
+	if config := stream.command(t).GetConfig(); config.GetMaxConcurrency() != 2 {
+		t.Fatalf("command %v sent to the resized agent, want 2 slots", config)
+	}
+
+	// the agent drains on its own
+	stream.messages <- report(1, 2, true)
+	waitForAgentState(t, s, id, func(state agents.AgentState) bool { return state.State == agents.AgentStateDraining })
+
+	// the agent leaves once the session ends
+	close(stream.messages)
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("AgentSession = %v once the agent left", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("AgentSession did not return once the session ended")
+	}
+	if s.agentList.Count() != 0 {
+		t.Fatalf("%d agents once the session ended", s.agentList.Count())
+	}
+	if err := s.sessions.send(id, &pb.AgentCommand{}); err == nil {
+		t.Fatalf("a command was sent to agent #%d once its session ended", id)
+	}
+}
+
+func TestAgentSessionRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    *pb.AgentMessage
+		wantCode codes.Code
+	}{
+		{name: "report before the registration", first: report(0, 1, false), wantCode: codes.InvalidArgument},
+		{
+			name: "identity too long",
+			first: &pb.AgentMessage{Message: &pb.AgentMessage_Register{Register: &pb.RegisterRequest{
+				Version:  version.VersionString,
+				Port:     6000,
+				Identity: string(make([]byte, MAX_AGENT_IDENTITY+1)),
+			}}},
+			wantCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		s := newTestServer(t)
+		s.sessions = newAgentSessions()
+		stream := newTestSessionStream(t, "127.0.0.1:40000")
+		result := make(chan error)
+		go func() { result <- s.AgentSession(stream) }()
+		stream.messages <- test.first
+		select {
+		case err := <-result:
+			if status.Code(err) != test.wantCode {
+				t.Errorf("%s: AgentSession = %v, want %s", test.name, err, test.wantCode)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: AgentSession did not return", test.name)
+		}
+		if s.agentList.Count() != 0 {
+			t.Errorf("%s: the agent was registered", test.name)
+		}
+	}
+}
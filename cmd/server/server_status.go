@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"internal/agents"
+	"internal/pb"
+	"internal/persistency"
+	"internal/version"
+)
+
+// ListTasks returns the pending and running tasks, without their subtasks.
+func (s *server) ListTasks(ctx context.Context, req *pb.ListTasksRequest) (*pb.ListTasksResponse, error) {
+	pending, running := s.taskList.snapshot()
+	resp := &pb.ListTasksResponse{}
+	for i, task := range pending {
+		resp.Tasks = append(resp.Tasks, task.status(i+1, false))
+	}
+	for _, task := range running {
+		resp.Tasks = append(resp.Tasks, task.status(0, false))
+	}
+	return resp, nil
+}
+
+// GetTask returns a task with its subtasks.
+// Finished tasks are looked up in the database, they are reported without subtasks.
+func (s *server) GetTask(ctx context.Context, req *pb.GetTaskRequest) (*pb.TaskStatus, error) {
+	taskID := int(req.GetTaskId())
+	pending, running := s.taskList.snapshot()
+	for i, task := range pending {
+		if task.id == taskID {
+			return task.status(i+1, true), nil
+		}
+	}
+	for _, task := range running {
+		if task.id == taskID {
+			return task.status(0, true), nil
+		}
+	}
+
+	persisted, err := s.persistency.GetTask(taskID)
+	if err != nil {
+		slog.Error("Failed to get task", "taskID", taskID, "error", err)
+		return nil, status.Errorf(codes.Internal, "failed to get task #%d: %v", taskID, err)
+	}
+	if persisted == nil {
+		return nil, status.Errorf(codes.NotFound, "task #%d not found", taskID)
+	}
+	mirrors, err := s.persistency.GetTaskMirrors(taskID)
+	if err != nil {
+		slog.Warn("Failed to get task mirrors", "taskID", taskID, "error", err)
+	}
+	taskStatus := &pb.TaskStatus{
+		Id:        int32(persisted.Id),
+		Url:       persisted.URL,
+		Mirrors:   mirrors,
+		Checksum:  persisted.Checksum,
+		Requester: persisted.Requester,
+		State:     persisted.State,
+		TotalSize: persisted.TotalSize,
+		Priority:  strings.TrimPrefix(persisted.Priority, "PRIORITY_"),
+	}
+	if persisted.State == persistency.TaskStateCompleted {
+		taskStatus.DownloadedBytes = persisted.TotalSize
+		taskStatus.AssembledBytes = persisted.TotalSize
+	}
+	return taskStatus, nil
+}
+
+// GetServerStatus returns the state of the queue and of the agents.
+// The estimated wait is the time to download what is left of all tasks at the recent throughput of the server.
+func (s *server) GetServerStatus(ctx context.Context, req *pb.GetServerStatusRequest) (*pb.ServerStatus, error) {
+	pending, running := s.taskList.snapshot()
+	resp := &pb.ServerStatus{
+		Version:       version.CurrentVersion().String(),
+		PendingTasks:  int32(len(pending)),
+		RunningTasks:  int32(len(running)),
+		AgentStrategy: s.agentList.StrategyName(),
+	}
+	for _, task := range append(pending, running...) {
+		resp.TotalSize += max(task.status(0, false).GetTotalSize(), 0)
+	}
+	load := s.queueLoad(nil)
+	resp.Speed = int32(s.throughput.rate())
+	resp.RemainingBytes = load.bytes
+	resp.EstimatedWaitSeconds = int64(s.wait(load).Seconds())
+
+	for _, agent := range s.agentList.AgentStates() {
+		resp.Agents = append(resp.Agents, agentStatus(agent))
+	}
+	return resp, nil
+}
+
+// agentStatus converts the state of an agent for GetServerStatus.
+// Banned agents have no health score.
+func agentStatus(agent agents.AgentState) *pb.AgentStatus {
+	status := &pb.AgentStatus{
+		Id:             int32(agent.ID),
+		Name:           agent.Name,
+		Addr:           agent.Addr,
+		Identity:       agent.Identity,
+		Version:        agent.Version,
+		State:          agent.State,
+		ErrorCount:     int32(agent.ErrorCount),
+		Throughput:     int64(agent.Throughput),
+		Slots:          int32(agent.Slots),
+		Running:        int32(agent.Running),
+		FirstByteMs:    agent.Health.FirstByte.Milliseconds(),
+		ErrorRate:      agent.Health.ErrorRate,
+		RecentFailures: int32(agent.Health.RecentFailures),
+	}
+	if agent.State != agents.AgentStateBanned {
+		status.HealthScore = agent.Health.Score()
+	}
+	if !agent.BannedUntil.IsZero() {
+		status.BannedUntil = agent.BannedUntil.Unix()
+	}
+	return status
+}
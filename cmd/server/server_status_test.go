@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"internal/agents"
+	"internal/pb"
+	"internal/persistency"
+)
+
+// newTestServer returns a server with one running task of 100 bytes, #1, and two pending tasks of unknown size, #2 and #3.
+func newTestServer(t *testing.T) *server {
+	list := newTestTaskList(t, 1)
+	strategy, err := agents.NewSelectionStrategy(agents.StrategyLeastLoaded)
+	if err != nil {
+		t.Fatalf("NewSelectionStrategy: %v", err)
+	}
+	s := &server{
+		agentList:   agents.NewAgentList(agents.DefaultRetryPolicy(), strategy),
+		taskList:    list,
+		persistency: list.p,
+		throughput:  newThroughputMeter(THROUGHPUT_WINDOW),
+	}
+	for i := 1; i <= 3; i++ {
+		list.addTask(fmt.Sprintf("http://example.com/%d", i), nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, nil, 0)
+	}
+	running := list.popTask(0)
+	running.totalSize = 100
+	running.setState(taskState_DOWNLOADING)
+	return s
+}
+
+func TestListTasks(t *testing.T) {
+	s := newTestServer(t)
+	resp, err := s.ListTasks(context.Background(), &pb.ListTasksRequest{})
+	if err != nil {
+		t.Fatalf("ListTasks: %v", err)
+	}
+
+	want := []struct {
+		id       int32
+		position int32
+		state    string
+	}{
+		{2, 1, taskState_PENDING.String()},
+		{3, 2, taskState_PENDING.String()},
+		{1, 0, taskState_DOWNLOADING.String()},
+	}
+	if len(resp.Tasks) != len(want) {
+		t.Fatalf("got %d tasks, want %d", len(resp.Tasks), len(want))
+	}
+	for i, task := range resp.Tasks {
+		if task.Id != want[i].id || task.QueuePosition != want[i].position || task.State != want[i].state {
+			t.Errorf("task %d is #%d at position %d, %s, want #%d at position %d, %s",
+				i, task.Id, task.QueuePosition, task.State, want[i].id, want[i].position, want[i].state)
+		}
+	}
+}
+
+func TestGetTask(t *testing.T) {
+	s := newTestServer(t)
+	// a task finished before the restart of the server is only in the database
+	if err := s.persistency.AddTask(10, "http://example.com/old", []string{"http://mirror.example.com/old"}, "", "10.0.0.2:40000", pb.Priority_PRIORITY_HIGH.String()); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	if err := s.persistency.UpdateTask(10, persistency.TaskStateCompleted, 42); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		id             int32
+		wantCode       codes.Code
+		wantState      string
+		wantPosition   int32
+		wantDownloaded int64
+		wantMirrors    int
+		wantPriority   string
+	}{
+		{name: "pending", id: 3, wantState: taskState_PENDING.String(), wantPosition: 2, wantPriority: "NORMAL"},
+		{name: "running", id: 1, wantState: taskState_DOWNLOADING.String(), wantPriority: "NORMAL"},
+		{name: "finished", id: 10, wantState: persistency.TaskStateCompleted, wantDownloaded: 42, wantMirrors: 1, wantPriority: "HIGH"},
+		{name: "unknown", id: 11, wantCode: codes.NotFound},
+	}
+
+	for _, test := range tests {
+		task, err := s.GetTask(context.Background(), &pb.GetTaskRequest{TaskId: test.id})
+		if status.Code(err) != test.wantCode {
+			t.Errorf("%s: GetTask = %v, want %s", test.name, err, test.wantCode)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if task.Id != test.id || task.State != test.wantState || task.QueuePosition != test.wantPosition {
+			t.Errorf("%s: got #%d, %s at position %d, want #%d, %s at position %d",
+				test.name, task.Id, task.State, task.QueuePosition, test.id, test.wantState, test.wantPosition)
+		}
+		if task.Priority != test.wantPriority {
+			t.Errorf("%s: priority %s, want %s", test.name, task.Priority, test.wantPriority)
+		}
+		if task.DownloadedBytes != test.wantDownloaded || len(task.Mirrors) != test.wantMirrors {
+			t.Errorf("%s: %d bytes downloaded from %d mirrors, want %d from %d",
+				test.name, task.DownloadedBytes, len(task.Mirrors), test.wantDownloaded, test.wantMirrors)
+		}
+	}
+}
+
+func TestGetServerStatus(t *testing.T) {
+	s := newTestServer(t)
+	s.throughput.add(50, time.Second)
+
+	resp, err := s.GetServerStatus(context.Background(), &pb.GetServerStatusRequest{})
+	if err != nil {
+		t.Fatalf("GetServerStatus: %v", err)
+	}
+	if resp.PendingTasks != 2 || resp.RunningTasks != 1 {
+		t.Errorf("%d pending and %d running tasks, want 2 and 1", resp.PendingTasks, resp.RunningTasks)
+	}
+	// the pending tasks of unknown size count as the running one
+	if resp.TotalSize != 100 || resp.RemainingBytes != 300 {
+		t.Errorf("total size %d with %d bytes remaining, want 100 and 300", resp.TotalSize, resp.RemainingBytes)
+	}
+	// 50 bytes in a little more than a second
+	if resp.Speed < 45 || resp.Speed > 50 || resp.EstimatedWaitSeconds != int64(300/resp.Speed) {
+		t.Errorf("speed %d with an estimated wait of %ds, want about 50 and the remaining bytes at that speed", resp.Speed, resp.EstimatedWaitSeconds)
+	}
+	if resp.AgentStrategy != agents.StrategyLeastLoaded || len(resp.Agents) != 0 {
+		t.Errorf("strategy %s with %d agents, want %s without agents", resp.AgentStrategy, len(resp.Agents), agents.StrategyLeastLoaded)
+	}
+}
+
+func TestAgentStatus(t *testing.T) {
+	bannedUntil := time.Unix(1700000000, 0)
+	health := agents.Health{Throughput: 1000, FirstByte: 250 * time.Millisecond, ErrorRate: 0.5, RecentFailures: 1}
+	tests := []struct {
+		name            string
+		agent           agents.AgentState
+		wantScore       float64
+		wantBannedUntil int64
+	}{
+		{
+			name:      "free",
+			agent:     agents.AgentState{ID: 1, State: agents.AgentStateFree, Health: health},
+			wantScore: 0.25,
+		},
+		{
+			name:      "never failed",
+			agent:     agents.AgentState{ID: 2, State: agents.AgentStateBusy},
+			wantScore: 1,
+		},
+		{
+			name:            "banned",
+			agent:           agents.AgentState{ID: 3, State: agents.AgentStateBanned, BannedUntil: bannedUntil},
+			wantBannedUntil: bannedUntil.Unix(),
+		},
+	}
+
+	for _, test := range tests {
+		got := agentStatus(test.agent)
+		if got.Id != int32(test.agent.ID) || got.State != test.agent.State {
+			t.Errorf("%s: got agent #%d %s, want #%d %s", test.name, got.Id, got.State, test.agent.ID, test.agent.State)
+		}
+		if got.HealthScore != test.wantScore || got.BannedUntil != test.wantBannedUntil {
+			t.Errorf("%s: health score %v banned until %d, want %v and %d", test.name, got.HealthScore, got.BannedUntil, test.wantScore, test.wantBannedUntil)
+		}
+		if got.FirstByteMs != test.agent.Health.FirstByte.Milliseconds() || got.RecentFailures != int32(test.agent.Health.RecentFailures) {
+			t.Errorf("%s: first byte %dms with %d recent failures, want %s and %d",
+				test.name, got.FirstByteMs, got.RecentFailures, test.agent.Health.FirstByte, test.agent.Health.RecentFailures)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	"internal/agents"
+)
+
+// A subtask running far slower than the others holds the whole task until it finishes.
+// When agents are idle, a speculative copy of such a straggler runs on another agent.
+// Each copy writes to its own part file, the first one to finish renames it to the target file and cancels the other.
+
+const (
+	SPECULATION_INTERVAL    = 5 * time.Second  // how often the running subtasks are checked for stragglers
+	SPECULATION_MIN_RUNTIME = 15 * time.Second // subtasks running for a shorter time are not judged
+	SPECULATION_SLOWDOWN    = 3                // a subtask slower than median/SPECULATION_SLOWDOWN is a straggler
+)
+
+// addCopy registers a running copy of the subtask, and returns the context it runs with.
+// The context is cancelled when a copy wins.
+func (subTask *subTaskInfo) addCopy(ctx context.Context) context.Context {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	copyCtx, cancel := context.WithCancel(ctx)
+	if subTask.won {
+		cancel()
+	} else {
+		subTask.cancels = append(subTask.cancels, cancel)
+	}
+	return copyCtx
+}
+
+// stopCopies cancels all running copies of the subtask.
+func (subTask *subTaskInfo) stopCopies() {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	for _, cancel := range subTask.cancels {
+		cancel()
+	}
+	subTask.cancels = nil
+}
+
+// startAttempt records that the original copy of the subtask starts running on the agent.
+func (subTask *subTaskInfo) startAttempt(agentID int) {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	subTask.assignedTo = agentID
+	subTask.startTime = time.Now()
+	subTask.downloadedBytes = 0
+}
+
+// pauseAttempt records that the original copy of the subtask waits for the origin to resume,
+// it is not running, and is not judged as a straggler meanwhile.
+func (subTask *subTaskInfo) pauseAttempt() {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	subTask.startTime = time.Time{}
+	subTask.downloadedBytes = 0
+}
+
+// reportProgress records the bytes downloaded by the agent of the original copy.
+func (subTask *subTaskInfo) reportProgress(downloadedBytes int64) {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	subTask.downloadedBytes = downloadedBytes
+}
+
+func (subTask *subTaskInfo) hasWon() bool {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	return subTask.won
+}
+
+// saveChunk renames partFile to the target file, unless another copy already did.
+// The other copies are cancelled once the chunk is saved.
+func (subTask *subTaskInfo) saveChunk(partFile string) (bool, error) {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	if subTask.won {
+		return false, nil
+	}
+	if err := os.Rename(partFile, subTask.targetFile); err != nil {
+		return false, err
+	}
+	subTask.won = true
+	if !subTask.startTime.IsZero() {
+		subTask.finishRate = float64(subTask.downloadSize) / time.Since(subTask.startTime).Seconds()
+	}
+	for _, cancel := range subTask.cancels {
+		cancel()
+	}
+	subTask.cancels = nil
+	return true, nil
+}
+
+// rate returns the bytes per second downloaded for the subtask,
+// and false if the subtask did not run long enough to be judged.
+func (subTask *subTaskInfo) rate(now time.Time) (float64, bool) {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	if subTask.won {
+		return subTask.finishRate, subTask.finishRate > 0
+	}
+	if subTask.startTime.IsZero() {
+		return 0, false
+	}
+	elapsed := now.Sub(subTask.startTime)
+	if elapsed < SPECULATION_MIN_RUNTIME {
+		return 0, false
+	}
+	return float64(subTask.downloadedBytes) / elapsed.Seconds(), true
+}
+
+// canSpeculate tells whether the subtask may get a speculative copy:
+// the agent is still downloading, and no copy was launched yet.
+func (subTask *subTaskInfo) canSpeculate() bool {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	return !subTask.won && !subTask.speculated && subTask.downloadedBytes < subTask.downloadSize
+}
+
+// speculate runs a copy of the subtask on another agent than the one running the original copy.
+// Errors of the copy are only logged, the original copy keeps retrying on its own.
+func (subTask *subTaskInfo) speculate(server *server, ctx context.Context) {
+	subTask.mtx.Lock()
+	subTask.speculated = true
+	excluded := []int{subTask.assignedTo}
+	subTask.mtx.Unlock()
+
+	copyCtx := subTask.addCopy(ctx)
+	go func() {
+		if err := subTask.mirrors.wait(copyCtx); err != nil {
+			// the original copy finished while waiting for the origin
+			return
+		}
+		err := server.agentList.RunTaskExcluding(copyCtx, excluded, func(agentInfo *agents.AgentInfo) error {
+			if copyCtx.Err() != nil {
+				// the original copy finished while waiting for an agent
+				return nil
+			}
+			// as for the original copy, the connection is only held with the agent
+			origin, slot, err := subTask.mirrors.acquire(copyCtx)
+			if err != nil {
+				// the original copy finished while waiting for a connection
+				return nil
+			}
+			defer subTask.mirrors.release(slot)
+			slog.Info("Running speculative copy of subtask", "taskID", subTask.taskId, "subtaskID", subTask.id, "agentID", agentInfo.GetID(), "slowAgentID", excluded[0])
+			return subTask.runOnAgent(server, copyCtx, agentInfo, origin, slot, subTask.targetFile+".spec.part", true)
+		})
+		if err != nil && copyCtx.Err() == nil {
+			slog.Warn("Speculative copy of subtask failed", "taskID", subTask.taskId, "subtaskID", subTask.id, "error", err)
+		}
+	}()
+}
+
+// speculateStragglers launches speculative copies of the running subtasks that are far slower than the median,
+// as long as there are free agents. The slowest subtasks get a copy first.
+func speculateStragglers(task *taskInfo, server *server) {
+	freeAgents := server.agentList.FreeCount()
+	if freeAgents == 0 {
+		return
+	}
+
+	now := time.Now()
+	rates := make([]float64, 0, len(task.subtasks))
+	running := make([]*subTaskInfo, 0)
+	runningRates := make(map[*subTaskInfo]float64)
+	for _, subTask := range task.subtasks {
+		rate, ok := subTask.rate(now)
+		if !ok {
+			continue
+		}
+		rates = append(rates, rate)
+		if subTask.canSpeculate() {
+			running = append(running, subTask)
+			runningRates[subTask] = rate
+		}
+	}
+	if len(rates) < 2 || len(running) == 0 {
+		return
+	}
+	slices.Sort(rates)
+	median := rates[len(rates)/2]
+
+	slices.SortFunc(running, func(a, b *subTaskInfo) int {
+		switch {
+		case runningRates[a] < runningRates[b]:
+			return -1
+		case runningRates[a] > runningRates[b]:
+			return 1
+		}
+		return 0
+	})
+	for _, subTask := range running {
+		if freeAgents == 0 || runningRates[subTask] >= median/SPECULATION_SLOWDOWN {
+			break
+		}
+		slog.Info("Subtask is straggling, launching a speculative copy", "taskID", task.id, "subtaskID", subTask.id, "rate", int64(runningRates[subTask]), "medianRate", int64(median))
+		subTask.speculate(server, task.getContext())
+		freeAgents--
+	}
+}
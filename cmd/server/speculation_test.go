@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	"internal/agents"
+	"internal/pb"
+)
+
+// testAgent is an agent serving DownloadPart on a local port, it sends the requested bytes of content.
+// A held agent sends nothing, and returns once the server stops the download.
+type testAgent struct {
+	pb.UnimplementedDDSONServiceClientServer
+	content  []byte
+	hold     bool
+	err      error                        // returned instead of the chunk, if not nil
+	requests chan *pb.DownloadPartRequest // every request, buffered
+	stopped  chan error                   // the error of every held download once stopped, buffered
+}
+
+func newTestAgent(content string, hold bool) *testAgent {
+	return &testAgent{
+		content:  []byte(content),
+		hold:     hold,
+		requests: make(chan *pb.DownloadPartRequest, 10),
+		stopped:  make(chan error, 10),
+	}
+}
+
+func (agent *testAgent) DownloadPart(req *pb.DownloadPartRequest, stream grpc.ServerStreamingServer[pb.DownloadStatus]) error {
+	agent.requests <- req
+	if agent.hold {
+		<-stream.Context().Done()
+		agent.stopped <- stream.Context().Err()
+		return stream.Context().Err()
+	}
+	if agent.err != nil {
+		return agent.err
+	}
+	data := agent.content[req.Offset:]
+	if !req.WholeFile {
+		data = data[:req.Size]
+	}
+	if err := stream.Send(&pb.DownloadStatus{Status: pb.DownloadStatusType_DOWNLOADING, DownloadedBytes: int64(len(data))}); err != nil {
+		return err
+	}
+	return stream.Send(&pb.DownloadStatus{Status: pb.DownloadStatusType_TRANSFERRING, Data: data})
+}
+
+// startTestAgent serves the agent on a local port, and adds it to the agent list of the server.
+func startTestAgent(t *testing.T, s *server, agent *testAgent) int {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	pb.RegisterDDSONServiceClientServer(grpcServer, agent)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	registered, err := agents.NewAgent("agent", "0.0.1", lis.Addr().String(), "", 1)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	t.Cleanup(registered.Close)
+	id, err := s.agentList.AddAgent(registered)
+	if err != nil {
+		t.Fatalf("AddAgent: %v", err)
+	}
+	return id
+}
+
+// newTestDownloadServer returns a server without agents, that runs the chunks of the tasks on the agents of the tests.
+func newTestDownloadServer(t *testing.T, policy agents.RetryPolicy) *server {
+	strategy, err := agents.NewSelectionStrategy(agents.StrategyLeastLoaded)
+	if err != nil {
+		t.Fatalf("NewSelectionStrategy: %v", err)
+	}
+	return &server{
+		agentList:   agents.NewAgentList(policy, strategy),
+		sessions:    newAgentSessions(),
+		retryPolicy: policy,
+		throughput:  newThroughputMeter(THROUGHPUT_WINDOW),
+		throttle:    newOriginThrottle(policy),
+		hostLimiter: newHostLimiter(nil, 0, nil),
+	}
+}
+
+func TestSpeculateStragglers(t *testing.T) {
+	// the subtasks download 2000 bytes, and ran for 20s at the given rates
+	tests := []struct {
+		name       string
+		rates      []int64 // bytes per second of the running subtasks, -1 for a subtask started too recently to be judged
+		done       []int   // subtasks whose agent downloaded the whole chunk already
+		freeAgents int
+		want       []int // subtasks getting a speculative copy
+	}{
+		{name: "slowest first", rates: []int64{100, 100, 100, 10, 5}, freeAgents: 1, want: []int{4}},
+		{name: "one copy per free agent", rates: []int64{100, 100, 100, 10, 5}, freeAgents: 3, want: []int{3, 4}},
+		{name: "no free agent", rates: []int64{100, 100, 100, 10, 5}},
+		{name: "no straggler", rates: []int64{100, 90, 80, 50}, freeAgents: 2},
+		{name: "too recent to be judged", rates: []int64{100, 100, -1}, freeAgents: 1},
+		{name: "downloaded, the agent sends the chunk", rates: []int64{100, 100, 100, 5}, done: []int{3}, freeAgents: 1},
+		{name: "a single judged subtask", rates: []int64{5, -1}, freeAgents: 1},
+	}
+
+	for _, test := range tests {
+		s := newTestDownloadServer(t, agents.DefaultRetryPolicy())
+		for i := 0; i < test.freeAgents; i++ {
+			startTestAgent(t, s, newTestAgent("", true))
+		}
+		// the copies wait for the paused origin, they never reach the agents
+		mirrors, origins := newTestMirrorSet("http://example.com/file")
+		mirrors.throttle.pause(origins[0].get(), time.Minute)
+
+		task := newTaskInfo("http://example.com/file", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+		for i, rate := range test.rates {
+			subTask := newSubTaskInfo(mirrors, task.id, i, int64(i)*2000, 2000, "", nil)
+			subTask.startTime = time.Now().Add(-20 * time.Second)
+			subTask.downloadedBytes = rate * 20
+			if rate < 0 {
+				subTask.startTime = time.Now()
+				subTask.downloadedBytes = 0
+			}
+			task.subtasks = append(task.subtasks, subTask)
+		}
+		for _, i := range test.done {
+			task.subtasks[i].downloadedBytes = 2000
+		}
+
+		speculateStragglers(task, s)
+		task.setCancelled("test")
+
+		var got []int
+		for i, subTask := range task.subtasks {
+			if subTask.status().Speculated {
+				got = append(got, i)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: speculative copies of subtasks %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSaveChunk(t *testing.T) {
+	tests := []struct {
+		name     string
+		copies   int
+		stopped  bool // execute returned and stopped the copies before they finish
+		wantWins int
+	}{
+		{name: "one copy", copies: 1, wantWins: 1},
+		{name: "the first of many copies wins", copies: 8, wantWins: 1},
+		{name: "stopped copies still save the chunk once", copies: 2, stopped: true, wantWins: 1},
+	}
+
+	for _, test := range tests {
+		dir := t.TempDir()
+		target := filepath.Join(dir, "chunk")
+		subTask := newSubTaskInfo(nil, 1, 0, 0, 1, target, nil)
+		ctxs := make([]context.Context, test.copies)
+		parts := make([]string, test.copies)
+		for i := range ctxs {
+			ctxs[i] = subTask.addCopy(context.Background())
+			parts[i] = filepath.Join(dir, fmt.Sprintf("chunk.%d.part", i))
+			if err := os.WriteFile(parts[i], []byte(fmt.Sprint(i)), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+		}
+		if test.stopped {
+			subTask.stopCopies()
+			for i, ctx := range ctxs {
+				if ctx.Err() == nil {
+					t.Errorf("%s: copy %d still runs once the copies are stopped", test.name, i)
+				}
+			}
+			if subTask.hasWon() {
+				t.Errorf("%s: stopping the copies saved the chunk", test.name)
+			}
+		}
+
+		// the copies finish at the same time
+		winners := make(chan int, test.copies)
+		var wg sync.WaitGroup
+		for i := range parts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				won, err := subTask.saveChunk(parts[i])
+				if err != nil {
+					t.Errorf("%s: saveChunk of copy %d: %v", test.name, i, err)
+				}
+				if won {
+					winners <- i
+				}
+			}()
+		}
+		wg.Wait()
+		close(winners)
+
+		if len(winners) != test.wantWins {
+			t.Errorf("%s: %d copies saved the chunk, want %d", test.name, len(winners), test.wantWins)
+			continue
+		}
+		winner := <-winners
+		if data, err := os.ReadFile(target); err != nil || string(data) != fmt.Sprint(winner) {
+			t.Errorf("%s: chunk is %q, %v, want the chunk of copy %d", test.name, data, err, winner)
+		}
+		for i, part := range parts {
+			if _, err := os.Stat(part); (i == winner) != os.IsNotExist(err) {
+				t.Errorf("%s: part file of copy %d: %v, only the one of the winner is renamed", test.name, i, err)
+			}
+		}
+		for i, ctx := range ctxs {
+			if ctx.Err() == nil {
+				t.Errorf("%s: copy %d still runs once copy %d won", test.name, i, winner)
+			}
+		}
+		if ctx := subTask.addCopy(context.Background()); ctx.Err() == nil {
+			t.Errorf("%s: a copy added once the chunk is saved runs", test.name)
+		}
+	}
+}
+
+func TestSpeculativeCopy(t *testing.T) {
+	s := newTestDownloadServer(t, agents.DefaultRetryPolicy())
+	slow := newTestAgent("", true)
+	slowID := startTestAgent(t, s, slow)
+
+	mirrors, _ := newTestMirrorSet("http://example.com/file")
+	dir := t.TempDir()
+	target := filepath.Join(dir, "chunk")
+	subTask := newSubTaskInfo(mirrors, 1, 0, 2, 4, target, make(chan [2]int, 10))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	finished := make(chan int, 1)
+	go subTask.execute(s, ctx, finished)
+
+	select {
+	case <-slow.requests:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the subtask did not run on the only agent")
+	}
+
+	// the copy runs on another agent than the straggling one, wins, and stops the original copy
+	fast := newTestAgent("0123456789", false)
+	startTestAgent(t, s, fast)
+	subTask.speculate(s, ctx)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the subtask did not finish once its speculative copy won")
+	}
+	if req := <-fast.requests; req.Offset != 2 || req.Size != 4 {
+		t.Errorf("speculative copy requested %d bytes at %d, want 4 at 2", req.Size, req.Offset)
+	}
+	select {
+	case <-slow.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the original copy still runs on agent %d", slowID)
+	}
+
+	if status := subTask.status(); status.State != "COMPLETED" || !status.Speculated || subTask.err != nil {
+		t.Errorf("subtask is %s with error %v, speculated %v, want COMPLETED by its speculative copy", status.State, subTask.err, status.Speculated)
+	}
+	if data, err := os.ReadFile(target); err != nil || string(data) != "2345" {
+		t.Errorf("chunk is %q, %v, want %q", data, err, "2345")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("%d files left in the chunk directory, %v, want only the chunk", len(entries), err)
+	}
+}
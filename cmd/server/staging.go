@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+)
+
+// stagingLocks make sure only one task at a time uses a staging directory.
+// A failed task no longer blocks a new task of the same file, but it still waits for its running subtasks,
+// which write to the directory until they stop.
+type stagingLocks struct {
+	mtx  sync.Mutex
+	held map[string]chan struct{} // closed when the directory is unlocked
+}
+
+func newStagingLocks() *stagingLocks {
+	return &stagingLocks{held: make(map[string]chan struct{})}
+}
+
+// lock waits until no other task uses the staging directory, or ctx is done.
+func (l *stagingLocks) lock(ctx context.Context, dir string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	for {
+		unlocked, held := l.held[dir]
+		if !held {
+			l.held[dir] = make(chan struct{})
+			return nil
+		}
+		slog.Info("Staging directory in use by another task, waiting", "dir", dir)
+		l.mtx.Unlock()
+		select {
+		case <-unlocked:
+		case <-ctx.Done():
+			l.mtx.Lock()
+			return fmt.Errorf("staging directory %s in use: %w", dir, ctx.Err())
+		}
+		l.mtx.Lock()
+	}
+}
+
+func (l *stagingLocks) unlock(dir string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if unlocked, held := l.held[dir]; held {
+		close(unlocked)
+		delete(l.held, dir)
+	}
+}
+
+// stagedChunk is a completed chunk file in a staging directory.
+type stagedChunk struct {
+	offset int64
+	size   int64
+	path   string
+}
+
+// chunkFile returns the path of a completed chunk in the staging directory.
+// The chunk is written to the same path with a ".part" suffix while it is downloading.
+func chunkFile(stagingDir string, offset int64, size int64) string {
+	return fmt.Sprintf("%s/%d-%d", stagingDir, offset, size)
+}
+
+// wholeFileChunk returns the path of the single chunk of a task that downloads the whole file at once.
+// It is never picked up by scanStagedChunks, a whole-file download cannot be resumed.
+func wholeFileChunk(stagingDir string) string {
+	return fmt.Sprintf("%s/whole", stagingDir)
+}
+
+// scanStagedChunks returns the completed chunks in the staging directory, sorted by offset.
+// Chunks that are truncated, overlap a previous chunk or lie outside of the file are ignored.
+func scanStagedChunks(stagingDir string, totalSize int64) []stagedChunk {
+	entries, err := os.ReadDir(stagingDir)
+	if err != nil {
+		slog.Warn("Failed to read staging directory", "dir", stagingDir, "error", err)
+		return nil
+	}
+
+	chunks := make([]stagedChunk, 0, len(entries))
+	for _, entry := range entries {
+		var offset, size int64
+		var rest string
+		n, _ := fmt.Sscanf(entry.Name(), "%d-%d%s", &offset, &size, &rest)
+		if n != 2 || entry.IsDir() {
+			continue // not a completed chunk
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() != size || size <= 0 || offset+size > totalSize {
+			slog.Debug("Ignoring invalid chunk file", "dir", stagingDir, "name", entry.Name())
+			continue
+		}
+		chunks = append(chunks, stagedChunk{
+			offset: offset,
+			size:   size,
+			path:   chunkFile(stagingDir, offset, size),
+		})
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].offset < chunks[j].offset
+	})
+
+	// keep non-overlapping chunks, the chunk layout may change between attempts
+	result := make([]stagedChunk, 0, len(chunks))
+	end := int64(0)
+	for _, chunk := range chunks {
+		if chunk.offset < end {
+			continue
+		}
+		result = append(result, chunk)
+		end = chunk.offset + chunk.size
+	}
+	return result
+}
+
+// missingRanges returns the ranges of the file that are not covered by the chunks, as [offset, size] pairs.
+// chunks must be sorted by offset and must not overlap.
+func missingRanges(chunks []stagedChunk, totalSize int64) [][2]int64 {
+	ranges := make([][2]int64, 0)
+	offset := int64(0)
+	for _, chunk := range chunks {
+		if chunk.offset > offset {
+			ranges = append(ranges, [2]int64{offset, chunk.offset - offset})
+		}
+		offset = chunk.offset + chunk.size
+	}
+	if offset < totalSize {
+		ranges = append(ranges, [2]int64{offset, totalSize - offset})
+	}
+	return ranges
+}
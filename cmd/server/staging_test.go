@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStagingLocks(t *testing.T) {
+	locks := newStagingLocks()
+	if err := locks.lock(context.Background(), "a"); err != nil {
+		t.Fatalf("lock: %v", err)
+	}
+	if err := locks.lock(context.Background(), "b"); err != nil {
+		t.Fatalf("lock of another directory: %v", err)
+	}
+
+	// a stopped task gives up waiting
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := locks.lock(ctx, "a"); err == nil {
+		t.Fatalf("a locked directory was locked twice")
+	}
+
+	locked := make(chan error)
+	go func() { locked <- locks.lock(context.Background(), "a") }()
+	select {
+	case <-locked:
+		t.Fatalf("a locked directory was locked twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+	locks.unlock("a")
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatalf("lock once unlocked: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the directory was not locked once unlocked")
+	}
+}
+
+func TestStagingDir(t *testing.T) {
+	p := newTestTaskList(t, 1).p
+	const url = "http://example.com/file"
+	dir, err := p.StagingDir(url, `"v1"`, "Mon, 02 Jan 2006 15:04:05 GMT", 100, "")
+	if err != nil {
+		t.Fatalf("StagingDir: %v", err)
+	}
+	undated, err := p.StagingDir(url, "", "Mon, 02 Jan 2006 15:04:05 GMT", 100, "")
+	if err != nil {
+		t.Fatalf("StagingDir: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		etag         string
+		lastModified string
+		want         string // the directory of the chunks of the same version
+		wantSame     bool
+	}{
+		{name: "same ETag", etag: `"v1"`, lastModified: "Tue, 03 Jan 2006 15:04:05 GMT", want: dir, wantSame: true},
+		{name: "changed ETag", etag: `"v2"`, lastModified: "Mon, 02 Jan 2006 15:04:05 GMT", want: dir},
+		{name: "same Last-Modified without ETag", lastModified: "Mon, 02 Jan 2006 15:04:05 GMT", want: undated, wantSame: true},
+		{name: "changed Last-Modified without ETag", lastModified: "Tue, 03 Jan 2006 15:04:05 GMT", want: undated},
+	}
+
+	for _, test := range tests {
+		got, err := p.StagingDir(url, test.etag, test.lastModified, 100, "")
+		if err != nil {
+			t.Fatalf("%s: StagingDir: %v", test.name, err)
+		}
+		if (got == test.want) != test.wantSame {
+			t.Errorf("%s: got %s, want the same directory as %s: %v", test.name, got, test.want, test.wantSame)
+		}
+	}
+}
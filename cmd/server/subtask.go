@@ -2,61 +2,174 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"sync"
+	"time"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 
 	"internal/agents"
 	"internal/pb"
 )
 
 type subTaskInfo struct {
-	downloadUrl  string
+	mirrors      *mirrorSet // shared by the subtasks of the task, every attempt picks one
+	taskId       int
 	id           int
 	offset       int64
 	downloadSize int64
 	assignedTo   int
 	targetFile   string
+	wholeFile    bool          // the chunk is the whole file, downloaded without a Range header. downloadSize is -1 until it completes if the size is unknown, it is then set under mtx
+	completed    bool          // the chunk is saved in targetFile
+	done         chan struct{} // closed once completed
 	err          error
-	retryCount   int
+	retryCount   int // written under mtx, status reads it
+	throttles    int // attempts the origin throttled, they do not count as retries
 	progressChan chan [2]int
+
+	// the fields below are shared with a speculative copy of the subtask, see speculation.go
+	mtx             *sync.Mutex
+	startTime       time.Time            // when the current attempt started, zero if not running
+	downloadedBytes int64                // bytes the agent of the current attempt has downloaded so far
+	won             bool                 // one copy of the subtask has saved the chunk in targetFile
+	finishRate      float64              // bytes per second of the subtask, once won
+	speculated      bool                 // a speculative copy was launched
+	finished        bool                 // execute returned, the chunk is completed or failed
+	cancels         []context.CancelFunc // stop the running copies once one of them wins
 }
 
-func newSubTaskInfo(downloadUrl string, id int, offset int64, downloadSize int64, targetFile string, progressChan chan [2]int) *subTaskInfo {
+func newSubTaskInfo(mirrors *mirrorSet, taskId int, id int, offset int64, downloadSize int64, targetFile string, progressChan chan [2]int) *subTaskInfo {
 	return &subTaskInfo{
-		downloadUrl:  downloadUrl,
+		mirrors:      mirrors,
+		taskId:       taskId,
 		id:           id,
 		offset:       offset,
 		downloadSize: downloadSize,
 		assignedTo:   -1,
 		targetFile:   targetFile,
 		progressChan: progressChan,
+		done:         make(chan struct{}),
+		mtx:          &sync.Mutex{},
 	}
 }
 
-func (subTask *subTaskInfo) execute(server *server, quitFlag *bool, finishChan chan int) {
+// markCompleted marks the chunk as saved in targetFile, so it can be assembled.
+func (subTask *subTaskInfo) markCompleted() {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	subTask.completed = true
+	close(subTask.done)
+}
+
+func (subTask *subTaskInfo) execute(server *server, ctx context.Context, finishChan chan int) {
 	slog.Debug("Executing subtask", "subtaskID", subTask.id, "offset", subTask.offset, "size", subTask.downloadSize, "targetFile", subTask.targetFile)
 
-	for subTask.retryCount <= 3 && !*quitFlag {
-		err := server.agentList.RunTask(func(agentInfo *agents.AgentInfo) error {
-			slog.Debug("Running subtask on agent", "subtaskID", subTask.id, "agentInfo", agentInfo)
-			return subTask.downloadChunk(quitFlag, agentInfo.GetAddr(), agentInfo.GetID())
-		})
+	// a speculative copy that wins cancels runCtx, to stop this one
+	runCtx := subTask.addCopy(ctx)
+	// agents that failed, stalled or were too slow on this chunk, the next attempt runs on another agent
+	excluded := make([]int, 0)
+	// once the file changed on the origin, no agent can download the chunk of the old version any more
+	var originChanged error
+	policy := server.retryPolicy
+	for ctx.Err() == nil {
+		if len(excluded) >= server.agentList.Count() {
+			// no other agent to try, give all of them another chance
+			excluded = excluded[:0]
+		}
+		// the agent of this attempt, -1 until one runs it
+		agentID := -1
+		// no agent is held while the origin is paused or at its connection limit, other tasks can use them
+		err := subTask.mirrors.wait(runCtx)
+		if err == nil {
+			// every attempt runs on a single agent, the attempts and the backoff between them are counted here only
+			err = server.agentList.RunTaskExcluding(runCtx, excluded, func(agentInfo *agents.AgentInfo) error {
+				if subTask.hasWon() {
+					return nil
+				}
+				if originChanged != nil {
+					return originChanged
+				}
+				// the connection is taken once the agent is held and given back once the agent is done,
+				// no connection is held while waiting for an agent
+				origin, slot, err := subTask.mirrors.acquire(runCtx)
+				if err != nil {
+					return err
+				}
+				defer subTask.mirrors.release(slot)
+				slog.Debug("Running subtask on agent", "subtaskID", subTask.id, "agentInfo", agentInfo)
+				agentID = agentInfo.GetID()
+				subTask.startAttempt(agentID)
+				err = subTask.runOnAgent(server, runCtx, agentInfo, origin, slot, subTask.targetFile+".part", false)
+				if errors.Is(err, errOriginChanged) {
+					originChanged = err
+				}
+				return err
+			})
+		}
+		if subTask.hasWon() {
+			// either this copy or the speculative one saved the chunk
+			err = nil
+		}
 		subTask.err = err
 		if err == nil {
+			subTask.markCompleted()
 			break
 		}
-		subTask.retryCount++
-		slog.Error("Error executing subtask", "error", err, "subtaskID", subTask.id, "retryCount", subTask.retryCount)
+		if errors.Is(err, errOriginChanged) {
+			slog.Warn("File changed on the origin, not retrying the chunk", "subtaskID", subTask.id, "error", err)
+			break
+		}
+		if agents.IsPermanent(err) {
+			slog.Error("Permanent error, not retrying the chunk", "subtaskID", subTask.id, "error", err)
+			subTask.err = fmt.Errorf("chunk #%d at offset %d failed with a permanent error, not retried: %w", subTask.id, subTask.offset, err)
+			break
+		}
+		if errors.Is(err, agents.ErrThrottled) {
+			subTask.throttles++
+			if subTask.throttles >= MAX_THROTTLES {
+				subTask.err = fmt.Errorf("chunk #%d at offset %d gave up, the origin throttled it %d times: %w", subTask.id, subTask.offset, subTask.throttles, err)
+				break
+			}
+			// the next attempt waits for the origin to resume
+			subTask.pauseAttempt()
+			slog.Info("Subtask throttled by the origin", "subtaskID", subTask.id, "throttles", subTask.throttles, "error", err)
+			continue
+		}
+		if errors.Is(err, agents.ErrAgentBusy) {
+			// not a failure of the chunk, the agents refused it while their slots were out of sync with the agent list
+			subTask.pauseAttempt()
+			slog.Info("Subtask refused by busy agents, requeued", "subtaskID", subTask.id, "error", err)
+			policy.Wait(runCtx, 1)
+			continue
+		}
+		retryCount := subTask.retry()
+		if retryCount >= policy.Attempts {
+			subTask.err = fmt.Errorf("chunk #%d at offset %d gave up after %d attempts: %w", subTask.id, subTask.offset, retryCount, err)
+			break
+		}
+		slog.Error("Error executing subtask", "error", err, "subtaskID", subTask.id, "agentID", agentID, "retryCount", retryCount, "retryIn", policy.Backoff(retryCount))
+		if agentID >= 0 {
+			excluded = append(excluded, agentID)
+		}
+		// the wait ends early when the task stops or a speculative copy wins
+		policy.Wait(runCtx, retryCount)
 	}
 
-	if *quitFlag {
-		// if we reach here, it means the subtask was stopped by the quit flag
-		slog.Info("Subtask execution stopped by quit flag", "subtaskID", subTask.id)
+	subTask.stopCopies()
+	subTask.mtx.Lock()
+	subTask.finished = true
+	subTask.mtx.Unlock()
+
+	if ctx.Err() != nil {
+		// if we reach here, it means the subtask was stopped because the task is stopped
+		slog.Info("Subtask execution stopped, task is stopped", "subtaskID", subTask.id)
 	} else if subTask.err != nil {
 		// if we reach here, it means the subtask failed after retries
 		slog.Error("Subtask failed after retries", "subtaskID", subTask.id, "error", subTask.err)
@@ -68,8 +181,95 @@ func (subTask *subTaskInfo) execute(server *server, quitFlag *bool, finishChan c
 	slog.Debug("Subtask execution finished, task notified", "subtaskID", subTask.id)
 }
 
-func (subTask *subTaskInfo) downloadChunk(quitFlag *bool, addr string, agentID int) error {
-	downloadUrl, offset, downloadSize := subTask.downloadUrl, subTask.offset, subTask.downloadSize
+// retry counts a failed attempt of the subtask, and returns the number of failed attempts so far.
+func (subTask *subTaskInfo) retry() int {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	subTask.retryCount++
+	return subTask.retryCount
+}
+
+// status returns a snapshot of the subtask, for status reports.
+func (subTask *subTaskInfo) status() *pb.SubTaskStatus {
+	subTask.mtx.Lock()
+	defer subTask.mtx.Unlock()
+
+	state := "PENDING"
+	switch {
+	case subTask.completed:
+		state = "COMPLETED"
+	case subTask.finished:
+		state = "FAILED"
+	case !subTask.startTime.IsZero():
+		state = "RUNNING"
+	}
+	downloadedBytes := subTask.downloadedBytes
+	if subTask.completed {
+		downloadedBytes = subTask.downloadSize
+	}
+	return &pb.SubTaskStatus{
+		Id:              int32(subTask.id),
+		Offset:          subTask.offset,
+		Size:            subTask.downloadSize,
+		State:           state,
+		AgentId:         int32(subTask.assignedTo),
+		DownloadedBytes: downloadedBytes,
+		Retries:         int32(subTask.retryCount),
+		Speculated:      subTask.speculated,
+	}
+}
+
+// runOnAgent downloads the chunk on the agent into partFile, from the origin acquired from the mirrors with slot,
+// within the chunk limits of the server.
+// It records the throughput and the time to the first byte of the agent on success, and how the mirror and its host did either way.
+func (subTask *subTaskInfo) runOnAgent(server *server, ctx context.Context, agentInfo *agents.AgentInfo, origin *originURL, slot *hostSlot, partFile string, speculative bool) error {
+	limits := server.chunkLimits
+	if subTask.wholeFile {
+		// the duration of a whole-file download depends on the size of the file, only the minimum speed applies
+		limits.timeout = 0
+	}
+	ctx, watchdog, stop := limits.watch(ctx)
+	defer stop()
+
+	conn, err := agentInfo.Conn()
+	if err != nil {
+		return err
+	}
+	startTime := time.Now()
+	attemptID := nextAttemptID.Add(1)
+	err = subTask.downloadChunk(ctx, origin, conn, agentInfo.GetID(), attemptID, partFile, speculative, watchdog)
+	if err != nil && ctx.Err() != nil {
+		// the attempt was stopped by the server, make sure the agent stops it too
+		server.sessions.abort(agentInfo.GetID(), attemptID, subTask.id, context.Cause(ctx))
+	}
+	if err == nil {
+		subTask.mirrors.recordSuccess(origin, subTask.downloadSize, time.Since(startTime))
+		subTask.mirrors.limiter.recordSuccess(slot)
+		server.throughput.add(subTask.downloadSize, time.Since(startTime))
+		// the throughput of the agent is used to plan the chunks of later tasks and to pick the agents
+		if agent := server.agentList.GetAgentByID(agentInfo.GetID()); agent != nil {
+			agent.RecordDownload(subTask.downloadSize, time.Since(startTime), watchdog.timeToFirstByte())
+		}
+	} else if errors.Is(err, agents.ErrThrottled) {
+		// not a failure of the mirror, it is paused until the origin resumes, with fewer connections
+		subTask.mirrors.limiter.recordOverload(slot, err)
+	} else if errors.Is(err, errOriginOverloaded) {
+		subTask.mirrors.limiter.recordOverload(slot, err)
+		subTask.mirrors.recordFailure(origin, err)
+	} else if errors.Is(err, agents.ErrOrigin) || errors.Is(err, errChunkTimeout) || errors.Is(err, errChunkTooSlow) {
+		subTask.mirrors.recordFailure(origin, err)
+	}
+	return err
+}
+
+// downloadChunk asks the agent on conn to download the chunk from origin, and writes it to partFile.
+// attemptID names the download in the AbortSubtask commands sent to the agent.
+// The progress of a speculative copy is not reported, the original copy already reports the same bytes.
+// The progress is always reported to the watchdog, which cancels ctx when the limits are violated.
+func (subTask *subTaskInfo) downloadChunk(ctx context.Context, origin *originURL, conn *grpc.ClientConn, agentID int, attemptID int64, partFile string, speculative bool, watchdog *chunkWatchdog) error {
+	downloadUrl, offset, downloadSize := origin.get(), subTask.offset, subTask.downloadSize
+	etag, lastModified := origin.validators()
 	subtaskID := subTask.id
 	slog.Info("Downloading chunk",
 		"subtaskID", subtaskID,
@@ -78,29 +278,20 @@ func (subTask *subTaskInfo) downloadChunk(quitFlag *bool, addr string, agentID i
 		"size", downloadSize,
 		"agentID", agentID)
 
-	// TODO: don't initialize a grpc agent for each download
-
-	// Create a grpc request to the agent to ask for the download
-	slog.Info("Connecting to agent", "subtaskID", subtaskID, "agentID", agentID, "address", addr)
-	// Establish a connection to the server
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		slog.Error("failed to connect to server", "subtaskID", subtaskID, "error", err)
-	}
-	defer conn.Close()
-
+	// the connection is shared by all the downloads running on the agent
 	grpcClient := pb.NewDDSONServiceClientClient(conn)
-	if err != nil {
-		slog.Error("Error creating gRPC client", "subtaskID", subtaskID, "error", err)
-		return err
-	}
 	// Send the request to the agent
-	stream, err := grpcClient.DownloadPart(context.Background(), &pb.DownloadPartRequest{
-		Url:       downloadUrl,
-		Offset:    offset,
-		Size:      downloadSize,
-		SubtaskId: int32(subtaskID),
-		ClientId:  int32(agentID),
+	// the agent aborts the download when ctx is cancelled
+	stream, err := grpcClient.DownloadPart(ctx, &pb.DownloadPartRequest{
+		Url:          downloadUrl,
+		Offset:       offset,
+		Size:         downloadSize,
+		SubtaskId:    int32(subtaskID),
+		ClientId:     int32(agentID),
+		WholeFile:    subTask.wholeFile,
+		Etag:         etag,
+		LastModified: lastModified,
+		AttemptId:    attemptID,
 	})
 	if err != nil {
 		slog.Error("Error sending download request", "subtaskID", subtaskID, "error", err)
@@ -108,27 +299,38 @@ func (subTask *subTaskInfo) downloadChunk(quitFlag *bool, addr string, agentID i
 	}
 
 	// Read the response from the agent
+	// the chunk is written to a part file, and renamed when it is complete
 	targetFile := subTask.targetFile
-	file, err := os.Create(targetFile)
+	file, err := os.Create(partFile)
 	if err != nil {
 		slog.Error("Error creating file", "subtaskID", subtaskID, "error", err)
 		return err
 	}
 	defer file.Close()
+	defer os.Remove(partFile) // no-op once the part file is renamed
 
 	// Read the data from the stream and write it to the file
 	slog.Info("Starting download for subtask", "subtaskID", subtaskID, "file", targetFile)
 	var received int64 = 0
+	var downloaded int64 = 0
 	currentState := pb.DownloadStatusType_PENDING
-	for !*quitFlag {
+	for ctx.Err() == nil {
 		resp, err := stream.Recv()
 		if err == io.EOF {
 			slog.Debug("EOF received.", "subtaskID", subtaskID)
 			break
 		}
 		if err != nil {
+			if ctx.Err() != nil {
+				// the stream was aborted by ctx
+				break
+			}
 			slog.Error("Error receiving data", "subtaskID", subtaskID, "error", err)
-			return err
+			if pb.AgentErrorReasonOf(err) == pb.AgentErrorReason_AGENT_BUSY {
+				// the slots of the agent are out of sync with the agent list, another agent takes the chunk
+				return fmt.Errorf("%w: agent %d: %s", agents.ErrAgentBusy, agentID, status.Convert(err).Message())
+			}
+			return subTask.originError(ctx, origin, downloadUrl, err)
 		}
 
 		status := resp.GetStatus()
@@ -138,9 +340,18 @@ func (subTask *subTaskInfo) downloadChunk(quitFlag *bool, addr string, agentID i
 		}
 		switch status {
 		case pb.DownloadStatusType_DOWNLOADING:
+			// the agent reports the bytes downloaded since its last report
 			bytesDownloaded := resp.DownloadedBytes
-			slog.Log(context.Background(), slog.LevelDebug-1, "Agent downloaded bytes", "subtaskID", subtaskID, "agentID", agentID, "bytes", bytesDownloaded)
-			subTask.progressChan <- [2]int{agentID, int(bytesDownloaded)}
+			downloaded += bytesDownloaded
+			if !subTask.wholeFile {
+				// a whole file is sent while it is downloaded, the same bytes are counted once received
+				watchdog.setProgress(downloaded)
+			}
+			slog.Log(context.Background(), slog.LevelDebug-1, "Agent downloaded bytes", "subtaskID", subtaskID, "agentID", agentID, "bytes", bytesDownloaded, "speculative", speculative)
+			if !speculative {
+				subTask.reportProgress(downloaded)
+				subTask.progressChan <- [2]int{agentID, int(bytesDownloaded)}
+			}
 
 		case pb.DownloadStatusType_TRANSFERRING:
 			// Write the data to the file
@@ -152,6 +363,11 @@ func (subTask *subTaskInfo) downloadChunk(quitFlag *bool, addr string, agentID i
 				return err
 			}
 			received += int64(n)
+			if subTask.wholeFile {
+				watchdog.setProgress(received)
+			} else {
+				watchdog.setProgress(downloaded + received)
+			}
 			slog.Debug("Data written to file", "subtaskID", subtaskID, "bytesWritten", n, "dataSize", dataSize, "totalReceived", received)
 
 		default:
@@ -160,14 +376,73 @@ func (subTask *subTaskInfo) downloadChunk(quitFlag *bool, addr string, agentID i
 		}
 	}
 
-	if *quitFlag {
-		slog.Info("Download stopped by quit flag", "subtaskID", subtaskID)
-		return fmt.Errorf("download stopped by quit flag")
+	if ctx.Err() != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, errChunkTimeout) || errors.Is(cause, errChunkTooSlow) {
+			slog.Warn("Download aborted, chunk limits violated", "subtaskID", subtaskID, "agentID", agentID, "cause", cause)
+			return fmt.Errorf("agent %d: %w", agentID, cause)
+		}
+		slog.Info("Download stopped, task is stopped", "subtaskID", subtaskID)
+		return fmt.Errorf("download stopped: %w", ctx.Err())
 	}
-	if received != downloadSize {
+	if downloadSize >= 0 && received != downloadSize {
 		slog.Error("Error: received bytes mismatch", "subtaskID", subtaskID, "received", received, "expected", downloadSize)
 		return fmt.Errorf("received %d bytes, expected %d bytes", received, downloadSize)
 	}
+	if err := file.Close(); err != nil {
+		slog.Error("Error closing file", "subtaskID", subtaskID, "error", err)
+		return err
+	}
+	if downloadSize < 0 {
+		// a whole-file download of unknown size, the size is known now
+		slog.Info("Whole file downloaded", "subtaskID", subtaskID, "size", received)
+		subTask.mtx.Lock()
+		subTask.downloadSize = received
+		subTask.mtx.Unlock()
+	}
+	won, err := subTask.saveChunk(partFile)
+	if err != nil {
+		slog.Error("Error renaming chunk file", "subtaskID", subtaskID, "error", err)
+		return err
+	}
+	if !won {
+		// not an error of the agent, the chunk is saved either way
+		slog.Info("Chunk already saved by another copy, dropping this one", "subtaskID", subtaskID, "agentID", agentID)
+		return nil
+	}
 	slog.Info("Download completed for subtask", "subtaskID", subtaskID, "file", targetFile)
 	return nil
 }
+
+// originError wraps the errors the agent reports about the origin, so they do not count against the agent.
+// When the origin rejected the URL, the URL is resolved again for the next attempt.
+// When the origin throttled the request, its host is paused, see originThrottle.
+// A rejection that resolving can not fix is permanent, the chunk is not retried.
+// A changed file is reported as errOriginChanged, retrying the chunk would mix two versions of the file,
+// unless the file changed on a mirror that can be dropped, the other mirrors still serve the old version.
+func (subTask *subTaskInfo) originError(ctx context.Context, origin *originURL, downloadUrl string, err error) error {
+	switch pb.AgentErrorReasonOf(err) {
+	case pb.AgentErrorReason_URL_REJECTED:
+		if _, resolveErr := origin.reresolve(ctx, downloadUrl); resolveErr != nil {
+			slog.Error("Failed to resolve the URL again", "subtaskID", subTask.id, "error", resolveErr)
+			err = fmt.Errorf("%w: %s", resolveErr, status.Convert(err).Message())
+		}
+	case pb.AgentErrorReason_RANGE_MISMATCH:
+	case pb.AgentErrorReason_ORIGIN_CHANGED:
+		err = fmt.Errorf("%w: %w", errOriginChanged, err)
+	case pb.AgentErrorReason_REQUEST_REJECTED:
+		err = fmt.Errorf("%w: %s", agents.ErrPermanent, status.Convert(err).Message())
+	case pb.AgentErrorReason_ORIGIN_UNAVAILABLE:
+		err = fmt.Errorf("%w: %s", errOriginOverloaded, status.Convert(err).Message())
+	case pb.AgentErrorReason_THROTTLED:
+		// every subtask downloading from the host waits, not only this one
+		subTask.mirrors.pause(origin, pb.RetryDelayOf(err))
+		err = fmt.Errorf("%w: %s", agents.ErrThrottled, status.Convert(err).Message())
+	default:
+		return err
+	}
+	// another mirror may still serve the file
+	if (errors.Is(err, errOriginChanged) || agents.IsPermanent(err)) && subTask.mirrors.drop(origin, err.Error()) {
+		return fmt.Errorf("%w: mirror %s dropped: %v", agents.ErrOrigin, origin.original, err)
+	}
+	return fmt.Errorf("%w: %w", agents.ErrOrigin, err)
+}
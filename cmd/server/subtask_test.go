@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"internal/agents"
+	"internal/pb"
+)
+
+func TestWholeFileDownload(t *testing.T) {
+	const content = "0123456789"
+	tests := []struct {
+		name         string
+		wholeFile    bool
+		size         int64 // size of the file known before the download, -1 if the origin did not send it
+		wantProgress int64 // bytes reported to the watchdog
+	}{
+		// the agent downloads the chunk, then sends it
+		{name: "chunk", size: 10, wantProgress: 20},
+		// the agent sends the file while it downloads it
+		{name: "whole file", wholeFile: true, size: 10, wantProgress: 10},
+		{name: "whole file of unknown size", wholeFile: true, size: -1, wantProgress: 10},
+	}
+
+	for _, test := range tests {
+		s := newTestDownloadServer(t, agents.DefaultRetryPolicy())
+		agentID := startTestAgent(t, s, newTestAgent(content, false))
+		conn, err := s.agentList.GetAgentByID(agentID).GetAgentInfo().Conn()
+		if err != nil {
+			t.Fatalf("%s: Conn: %v", test.name, err)
+		}
+		mirrors, origins := newTestMirrorSet("http://example.com/file")
+		task := newTaskInfo("http://example.com/file", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+		task.totalSize = test.size
+		target := filepath.Join(t.TempDir(), "chunk")
+		subTask := newSubTaskInfo(mirrors, task.id, 0, 0, test.size, target, make(chan [2]int, 10))
+		subTask.wholeFile = test.wholeFile
+		task.subtasks = append(task.subtasks, subTask)
+
+		ctx, watchdog, stop := chunkLimits{}.watch(context.Background())
+		err = subTask.downloadChunk(ctx, origins[0], conn, agentID, 1, target+".part", false, watchdog)
+		stop()
+		if err != nil {
+			t.Errorf("%s: downloadChunk: %v", test.name, err)
+			continue
+		}
+		if got := watchdog.progress.Load(); got != test.wantProgress {
+			t.Errorf("%s: %d bytes reported to the watchdog, want %d", test.name, got, test.wantProgress)
+		}
+		subTask.markCompleted()
+
+		// the size of the file is known once it is downloaded
+		var out bytes.Buffer
+		if err := assembleChunks(task, &out); err != nil || out.String() != content {
+			t.Errorf("%s: assembled %q, %v, want %q", test.name, out.String(), err, content)
+		}
+		if task.totalSize != int64(len(content)) || subTask.status().Size != int64(len(content)) {
+			t.Errorf("%s: file of %d bytes with a chunk of %d, want %d", test.name, task.totalSize, subTask.status().Size, len(content))
+		}
+	}
+}
+
+func TestSubTaskStatusWhileRunning(t *testing.T) {
+	tests := []struct {
+		name        string
+		agent       *testAgent
+		size        int64 // -1 for a whole file of unknown size
+		wantState   string
+		wantSize    int64
+		wantRetries int32
+	}{
+		{name: "retried chunk", agent: &testAgent{err: errors.New("disk full")}, size: 4, wantState: "FAILED", wantSize: 4, wantRetries: 3},
+		{name: "whole file of unknown size", agent: newTestAgent("0123456789", false), size: -1, wantState: "COMPLETED", wantSize: 10},
+	}
+
+	for _, test := range tests {
+		policy := agents.DefaultRetryPolicy()
+		policy.Attempts = 3
+		policy.BaseDelay = time.Millisecond
+		policy.MaxAgentErrors = 100 // the failing agent is not banned
+		s := newTestDownloadServer(t, policy)
+		if test.agent.requests == nil {
+			test.agent.requests = make(chan *pb.DownloadPartRequest, 100)
+		}
+		startTestAgent(t, s, test.agent)
+		mirrors, _ := newTestMirrorSet("http://example.com/file")
+		subTask := newSubTaskInfo(mirrors, 1, 0, 0, test.size, filepath.Join(t.TempDir(), "chunk"), make(chan [2]int, 100))
+		subTask.wholeFile = test.size < 0
+
+		// the status RPCs read the subtask while it runs
+		finished := make(chan int, 1)
+		go subTask.execute(s, context.Background(), finished)
+		deadline := time.After(5 * time.Second)
+		for polling := true; polling; {
+			select {
+			case <-finished:
+				polling = false
+			case <-deadline:
+				t.Fatalf("%s: the subtask did not finish", test.name)
+			default:
+				subTask.status()
+			}
+		}
+
+		status := subTask.status()
+		if status.State != test.wantState || status.Size != test.wantSize || status.Retries != test.wantRetries {
+			t.Errorf("%s: subtask %s with %d bytes and %d retries, want %s with %d bytes and %d retries",
+				test.name, status.State, status.Size, status.Retries, test.wantState, test.wantSize, test.wantRetries)
+		}
+	}
+}
+
+func TestSubTaskRetriesOnOtherAgents(t *testing.T) {
+	failing := func() *testAgent {
+		agent := newTestAgent("", false)
+		agent.err = errors.New("disk full")
+		return agent
+	}
+	tests := []struct {
+		name         string
+		agents       []*testAgent
+		wantState    string
+		wantRequests []int // requests every agent got
+	}{
+		// every attempt is a single request, on the agent the previous attempt did not fail on
+		{name: "failing agents", agents: []*testAgent{failing(), failing()}, wantState: "FAILED", wantRequests: []int{2, 2}},
+		{name: "another agent after a failure", agents: []*testAgent{failing(), newTestAgent("0123456789", false)}, wantState: "COMPLETED", wantRequests: []int{1, 1}},
+	}
+
+	for _, test := range tests {
+		policy := agents.DefaultRetryPolicy()
+		policy.Attempts = 4
+		policy.BaseDelay = time.Millisecond
+		policy.MaxAgentErrors = 100 // the failing agents are not banned
+		s := newTestDownloadServer(t, policy)
+		for _, agent := range test.agents {
+			startTestAgent(t, s, agent)
+		}
+		mirrors, _ := newTestMirrorSet("http://example.com/file")
+		subTask := newSubTaskInfo(mirrors, 1, 0, 0, 4, filepath.Join(t.TempDir(), "chunk"), make(chan [2]int, 100))
+
+		finished := make(chan int, 1)
+		go subTask.execute(s, context.Background(), finished)
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the subtask did not finish", test.name)
+		}
+
+		if status := subTask.status(); status.State != test.wantState {
+			t.Errorf("%s: subtask %s, want %s", test.name, status.State, test.wantState)
+		}
+		for i, agent := range test.agents {
+			if got := len(agent.requests); got != test.wantRequests[i] {
+				t.Errorf("%s: agent %d got %d requests, want %d", test.name, i, got, test.wantRequests[i])
+			}
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
 	"sync"
 
 	"internal/pb"
+	"internal/persistency"
 )
 
 type taskState int
@@ -15,50 +20,396 @@ const (
 	taskState_TRANSFERRING
 	taskState_COMPLETED
 	taskState_FAILED
+	taskState_CANCELLED
 )
 
+func (s taskState) String() string {
+	switch s {
+	case taskState_PENDING:
+		return "PENDING"
+	case taskState_DOWNLOADING:
+		return "DOWNLOADING"
+	case taskState_VALIDATING:
+		return "VALIDATING"
+	case taskState_TRANSFERRING:
+		return "TRANSFERRING"
+	case taskState_COMPLETED:
+		return "COMPLETED"
+	case taskState_FAILED:
+		return "FAILED"
+	case taskState_CANCELLED:
+		return "CANCELLED"
+	default:
+		return fmt.Sprintf("taskState(%d)", int(s))
+	}
+}
+
+// persistedState returns the state saved in the database for the task state.
+func (s taskState) persistedState() string {
+	switch s {
+	case taskState_PENDING:
+		return persistency.TaskStatePending
+	case taskState_COMPLETED:
+		return persistency.TaskStateCompleted
+	case taskState_FAILED:
+		return persistency.TaskStateFailed
+	case taskState_CANCELLED:
+		return persistency.TaskStateCancelled
+	default:
+		return persistency.TaskStateRunning
+	}
+}
+
+// subscriber is a requester stream attached to a task.
+// Several requesters of the same file share one task, each of them has its own subscriber.
+type subscriber struct {
+	id        int
+	requester string // address of the requester of the stream
+	stream    pb.DDSONService_DownloadServer
+	mtx       sync.Mutex    // grpc streams do not support concurrent Send
+	cancelled chan struct{} // closed when the requester cancels its download, see taskInfo.detachRequester
+}
+
+func (s *subscriber) send(status *pb.DownloadStatus) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.stream.Send(status)
+}
+
 type taskInfo struct {
-	idOfClient  int //  which client the task is from
-	id          int // task ID
+	idOfClient  int         //  which client the task is from
+	requester   string      // address of the requester that created the task
+	batchId     string      // the files of a batch are scheduled as one unit, empty if the task is not part of one
+	priority    pb.Priority // raised when a requester of a higher priority attaches to the task
+	promoted    bool        // moved to the front of the queue by an admin
+	id          int         // task ID
 	downloadUrl string
+	mirrors     []string // other URLs of the same file, the chunks are spread across downloadUrl and the mirrors
 	checksum    string
-	stream      pb.DDSONService_DownloadServer
+	totalSize   int64 // size of the file, known after the task starts
+
+	mtx              *sync.Mutex // Mutex to protect access to the task states
+	state            taskState
+	subtasks         []*subTaskInfo
+	subscribers      map[int]*subscriber
+	nextSubscriberId int
+	downloadedFile   string // path to the downloaded file, if any
 
-	mtx            *sync.Mutex // Mutex to protect access to the task states
-	state          taskState
-	subtasks       []*subTaskInfo
-	downloadedFile string // path to the downloaded file, if any
+	// the chunks are assembled in order into assembledFile while the task is downloading,
+	// requesters stream the first assembled bytes of it before the task completes.
+	assembledFile   string
+	assembled       int64         // number of bytes assembled so far
+	assembledNotify chan struct{} // closed and replaced whenever assembledFile or assembled changes
+	generation      int           // incremented when the task restarts, the assembled bytes of earlier generations are void
 
-	err      error
-	quitFlag bool // used to signal subtasks to stop processing
-	done     chan bool
+	speed int // bytes per second, updated with the progress sent to requesters
+
+	err    error
+	ctx    context.Context // cancelled to signal subtasks to stop processing
+	cancel context.CancelFunc
+	done   chan bool
 }
 
-func newTaskInfo(downloadUrl string, checksum string, stream pb.DDSONService_DownloadServer, taskId int, idOfClient int) *taskInfo {
+func newTaskInfo(downloadUrl string, mirrors []string, checksum string, requester string, batchId string, priority pb.Priority, taskId int, idOfClient int) *taskInfo {
 	mtx := &sync.Mutex{}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &taskInfo{
 		downloadUrl: downloadUrl,
+		mirrors:     mirrors,
 		checksum:    checksum,
-		stream:      stream,
+		requester:   requester,
+		batchId:     batchId,
+		priority:    priority,
 		id:          taskId,
 		idOfClient:  idOfClient,
 
-		state:    taskState_PENDING,
-		mtx:      mtx,
-		subtasks: make([]*subTaskInfo, 0),
-		err:      nil,
-		done:     make(chan bool),
+		state:       taskState_PENDING,
+		mtx:         mtx,
+		subtasks:    make([]*subTaskInfo, 0),
+		subscribers: make(map[int]*subscriber),
+		err:         nil,
+		ctx:         ctx,
+		cancel:      cancel,
+		done:        make(chan bool),
+
+		assembledNotify: make(chan struct{}),
+	}
+}
+
+// unit returns the key the task is scheduled under. The tasks of a batch share one unit,
+// so a batch gets the same share of the workers and agents as a single file.
+func (t *taskInfo) unit() string {
+	if t.batchId != "" {
+		return "batch:" + t.batchId
 	}
+	return fmt.Sprintf("task:%d", t.id)
 }
 
 // setError sets the error for the task and updates its state to FAILED
 func (t *taskInfo) setError(err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.state == taskState_CANCELLED {
+		// keep the cancellation reason, errors after cancellation are caused by it
+		return
+	}
 	t.err = err
-	t.quitFlag = true
 	t.state = taskState_FAILED
+	t.cancel()
+}
+
+// setCancelled marks the task as cancelled and stops its subtasks.
+// Busy agents abort their DownloadPart calls when the context of the calls is cancelled.
+func (t *taskInfo) setCancelled(reason string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.isFinishedNoLock() {
+		return
+	}
+	t.err = fmt.Errorf("task #%d cancelled: %s", t.id, reason)
+	t.state = taskState_CANCELLED
+	t.cancel()
 }
 
-// setState sets the state of the task and notifies any waiting goroutines
+// setState sets the state of the task.
+func (t *taskInfo) setState(state taskState) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.state = state
+}
+
+// getState returns the state of the task.
+func (t *taskInfo) getState() taskState {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.state
+}
+
+// getError returns the error the task failed or was cancelled with, nil otherwise.
+func (t *taskInfo) getError() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.err
+}
+
+// getTotalSize returns the size of the file, -1 while it is unknown.
+func (t *taskInfo) getTotalSize() int64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.totalSize
+}
+
+// isPending returns true if the task is waiting in the queue.
+func (t *taskInfo) isPending() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.state == taskState_PENDING
+}
+
+// getContext returns the context of the current run of the task, it is replaced when the task restarts.
+func (t *taskInfo) getContext() context.Context {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.ctx
+}
+
+// isStopped returns true if the task has failed or has been cancelled.
+func (t *taskInfo) isStopped() bool {
+	return t.getContext().Err() != nil
+}
+
+// markDone notifies the goroutines waiting for the task that it is finished.
 func (t *taskInfo) markDone() {
 	close(t.done)
 }
+
+// isFinished returns true if the task has completed or failed.
+func (t *taskInfo) isFinished() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.isFinishedNoLock()
+}
+
+func (t *taskInfo) isFinishedNoLock() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return t.state == taskState_COMPLETED || t.state == taskState_FAILED || t.state == taskState_CANCELLED
+	}
+}
+
+// attach adds a requester stream to the task, it will receive all following status updates.
+func (t *taskInfo) attach(stream pb.DDSONService_DownloadServer, requester string) *subscriber {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	sub := &subscriber{
+		id:        t.nextSubscriberId,
+		requester: requester,
+		stream:    stream,
+		cancelled: make(chan struct{}),
+	}
+	t.nextSubscriberId++
+	t.subscribers[sub.id] = sub
+	slog.Debug("Subscriber attached to task", "taskID", t.id, "subscriberID", sub.id, "subscribers", len(t.subscribers))
+	return sub
+}
+
+// detach removes a requester stream from the task. The task keeps running for the other requesters.
+// It returns the number of requesters still attached.
+func (t *taskInfo) detach(sub *subscriber) int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	delete(t.subscribers, sub.id)
+	slog.Debug("Subscriber detached from task", "taskID", t.id, "subscriberID", sub.id, "subscribers", len(t.subscribers))
+	return len(t.subscribers)
+}
+
+// detachRequester detaches the streams of the requester host from the task, their downloads end as cancelled.
+// The host is a requester of the task if it created the task or has a stream attached to it.
+// It returns false if the host is not a requester of the task, and the number of requesters still attached.
+func (t *taskInfo) detachRequester(host string) (bool, int) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	isRequester := requesterHost(t.requester) == host
+	for id, sub := range t.subscribers {
+		if requesterHost(sub.requester) != host {
+			continue
+		}
+		isRequester = true
+		delete(t.subscribers, id)
+		close(sub.cancelled)
+		slog.Debug("Subscriber cancelled its download", "taskID", t.id, "subscriberID", sub.id, "requester", sub.requester)
+	}
+	return isRequester, len(t.subscribers)
+}
+
+// broadcast sends the status to all attached requesters.
+// A requester that fails to receive the status is detached, it does not affect the task
+// unless it was the last one, in which case nobody is waiting for the file any more and the task is cancelled.
+func (t *taskInfo) broadcast(status *pb.DownloadStatus) {
+	t.mtx.Lock()
+	subscribers := make([]*subscriber, 0, len(t.subscribers))
+	for _, sub := range t.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	t.mtx.Unlock()
+
+	for _, sub := range subscribers {
+		if err := sub.send(status); err != nil {
+			slog.Warn("Failed to send status to subscriber, detaching", "taskID", t.id, "subscriberID", sub.id, "error", err)
+			if t.detach(sub) == 0 {
+				t.setCancelled("all requesters disconnected")
+			}
+		}
+	}
+}
+
+// setAssembledFile sets the path of the file the chunks are assembled into.
+// It is set again when the file is moved to the cache.
+func (t *taskInfo) setAssembledFile(path string) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.assembledFile = path
+	close(t.assembledNotify)
+	t.assembledNotify = make(chan struct{})
+}
+
+// advanceAssembled records that the first n bytes of the file are assembled.
+func (t *taskInfo) advanceAssembled(n int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.assembled = n
+	close(t.assembledNotify)
+	t.assembledNotify = make(chan struct{})
+}
+
+// assembledState returns the assembled file, the number of bytes assembled, the generation of the task,
+// and a channel that is closed on the next change of any of them.
+func (t *taskInfo) assembledState() (string, int64, int, <-chan struct{}) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.assembledFile, t.assembled, t.generation, t.assembledNotify
+}
+
+// restart resets a task that failed because the file changed on the origin, so it runs again from the probe.
+// Requesters stay attached, the ones that already received data are told to discard it.
+// It returns false if no requester is attached any more, the task is then left failed.
+func (t *taskInfo) restart() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if len(t.subscribers) == 0 {
+		return false
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.err = nil
+	t.state = taskState_PENDING
+	t.subtasks = make([]*subTaskInfo, 0)
+	t.assembledFile = ""
+	t.assembled = 0
+	t.speed = 0
+	t.generation++
+	close(t.assembledNotify)
+	t.assembledNotify = make(chan struct{})
+	return true
+}
+
+// setSpeed records the download speed of the task, for status reports.
+func (t *taskInfo) setSpeed(speed int) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.speed = speed
+}
+
+// status returns a snapshot of the task, with its subtasks if withSubtasks is set.
+// queuePosition is the position of a pending task in the queue, 0 if it is not pending.
+func (t *taskInfo) status(queuePosition int, withSubtasks bool) *pb.TaskStatus {
+	t.mtx.Lock()
+	status := &pb.TaskStatus{
+		Id:             int32(t.id),
+		Url:            t.downloadUrl,
+		Mirrors:        t.mirrors,
+		Checksum:       t.checksum,
+		Requester:      t.requester,
+		BatchId:        t.batchId,
+		State:          t.state.String(),
+		TotalSize:      t.totalSize,
+		AssembledBytes: t.assembled,
+		Speed:          int32(t.speed),
+		QueuePosition:  int32(queuePosition),
+		Requesters:     int32(len(t.subscribers)),
+		Priority:       strings.TrimPrefix(t.priority.String(), "PRIORITY_"),
+		Promoted:       t.promoted,
+	}
+	if t.err != nil {
+		status.Error = t.err.Error()
+	}
+	subtasks := t.subtasks
+	t.mtx.Unlock()
+
+	// the downloaded bytes are counted from the subtasks, agents do not report the progress of short chunks
+	for _, subTask := range subtasks {
+		subTaskStatus := subTask.status()
+		status.DownloadedBytes += subTaskStatus.GetDownloadedBytes()
+		if withSubtasks {
+			status.Subtasks = append(status.Subtasks, subTaskStatus)
+		}
+	}
+	return status
+}
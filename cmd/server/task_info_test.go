@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"internal/pb"
+)
+
+func TestTaskStopReason(t *testing.T) {
+	failure := errors.New("chunk failed")
+	tests := []struct {
+		name      string
+		stop      func(task *taskInfo)
+		wantState taskState
+		wantError string
+	}{
+		{
+			name:      "failed",
+			stop:      func(task *taskInfo) { task.setError(failure) },
+			wantState: taskState_FAILED,
+			wantError: "chunk failed",
+		},
+		{
+			name:      "cancelled",
+			stop:      func(task *taskInfo) { task.setCancelled("by request") },
+			wantState: taskState_CANCELLED,
+			wantError: "cancelled: by request",
+		},
+		{
+			name: "errors after the cancellation keep its reason",
+			stop: func(task *taskInfo) {
+				task.setCancelled("by request")
+				task.setError(failure)
+			},
+			wantState: taskState_CANCELLED,
+			wantError: "cancelled: by request",
+		},
+		{
+			name: "a failed task is not cancelled",
+			stop: func(task *taskInfo) {
+				task.setError(failure)
+				task.setCancelled("all requesters disconnected")
+			},
+			wantState: taskState_FAILED,
+			wantError: "chunk failed",
+		},
+	}
+
+	for _, test := range tests {
+		task := newTaskInfo("http://example.com/file", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+		test.stop(task)
+		if !task.isStopped() || !task.isFinished() {
+			t.Errorf("%s: task is not stopped", test.name)
+		}
+		if task.getState() != test.wantState || !strings.Contains(task.getError().Error(), test.wantError) {
+			t.Errorf("%s: task is %s with %v, want %s with %q", test.name, task.getState(), task.getError(), test.wantState, test.wantError)
+		}
+	}
+}
+
+func TestTaskStopConcurrently(t *testing.T) {
+	task := newTaskInfo("http://example.com/file", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+
+	// the assembler, the subtasks, CancelDownload and the requesters stop the task from their own goroutines
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			task.setError(errors.New("chunk failed"))
+		}()
+		go func() {
+			defer wg.Done()
+			task.setCancelled("by request")
+		}()
+	}
+	wg.Wait()
+	if state := task.getState(); state != taskState_FAILED && state != taskState_CANCELLED {
+		t.Fatalf("task is %s once stopped", state)
+	}
+}
+
+func TestDetachRequester(t *testing.T) {
+	tests := []struct {
+		name          string
+		attached      []string // requesters of the streams attached to the task, created by 10.0.0.1
+		host          string
+		wantRequester bool
+		wantRemaining int
+	}{
+		{name: "only requester", attached: []string{"10.0.0.1:40000"}, host: "10.0.0.1", wantRequester: true, wantRemaining: 0},
+		{name: "all streams of the requester", attached: []string{"10.0.0.1:40000", "10.0.0.1:40001"}, host: "10.0.0.1", wantRequester: true, wantRemaining: 0},
+		{name: "other requesters go on", attached: []string{"10.0.0.1:40000", "10.0.0.2:40000"}, host: "10.0.0.2", wantRequester: true, wantRemaining: 1},
+		{name: "creator without a stream", attached: []string{"10.0.0.2:40000"}, host: "10.0.0.1", wantRequester: true, wantRemaining: 1},
+		{name: "not a requester", attached: []string{"10.0.0.1:40000"}, host: "10.0.0.3", wantRequester: false, wantRemaining: 1},
+	}
+
+	for _, test := range tests {
+		task := newTaskInfo("http://example.com/file", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+		subscribers := make([]*subscriber, 0, len(test.attached))
+		for _, requester := range test.attached {
+			subscribers = append(subscribers, task.attach(nil, requester))
+		}
+
+		isRequester, remaining := task.detachRequester(test.host)
+		if isRequester != test.wantRequester || remaining != test.wantRemaining {
+			t.Errorf("%s: detachRequester(%q) = %v, %d, want %v, %d", test.name, test.host, isRequester, remaining, test.wantRequester, test.wantRemaining)
+		}
+		for _, sub := range subscribers {
+			select {
+			case <-sub.cancelled:
+				if requesterHost(sub.requester) != test.host {
+					t.Errorf("%s: the download of %s was cancelled by %s", test.name, sub.requester, test.host)
+				}
+			default:
+				if requesterHost(sub.requester) == test.host {
+					t.Errorf("%s: the download of %s was not cancelled", test.name, sub.requester)
+				}
+			}
+		}
+	}
+}
+
+func TestTaskRestart(t *testing.T) {
+	task := newTaskInfo("http://example.com/file", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, 1, 0)
+	if task.restart() {
+		t.Fatalf("a task nobody waits for was restarted")
+	}
+	task.attach(nil, "10.0.0.1:40000")
+	task.setError(errOriginChanged)
+	stopped := task.getContext()
+
+	// status reports and requesters read the task while the worker restarts it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			task.isStopped()
+			task.status(0, true)
+		}
+	}()
+	if !task.restart() {
+		t.Fatalf("a task with a requester was not restarted")
+	}
+	<-done
+
+	if task.isStopped() || task.getError() != nil || !task.isPending() {
+		t.Fatalf("restarted task is %s with %v, stopped %v", task.getState(), task.getError(), task.isStopped())
+	}
+	if stopped.Err() == nil {
+		t.Fatalf("the context of the failed run was replaced before it was cancelled")
+	}
+	if _, _, generation, _ := task.assembledState(); generation != 1 {
+		t.Fatalf("generation %d once restarted, want 1", generation)
+	}
+}
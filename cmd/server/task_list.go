@@ -1,61 +1,289 @@
 package main
 
 import (
-	"internal/pb"
+	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
+
+	"internal/pb"
+	"internal/persistency"
 )
 
 type taskList struct {
-	tasks  []*taskInfo
-	freeId int
-	mtx    *sync.Mutex
-	cond   *sync.Cond
+	tasks    []*taskInfo          // pending tasks, in FIFO order
+	running  map[int]*taskInfo    // tasks currently executed by a worker
+	inFlight map[string]*taskInfo // pending and running tasks, by inFlightKey
+	workers  int                  // number of tasks executed in parallel
+	freeId   int
+	p        *persistency.Persistency // tasks are saved so they survive a server restart
+	mtx      *sync.Mutex
+	cond     *sync.Cond
 }
 
-func newTaskList() *taskList {
+func newTaskList(workers int, p *persistency.Persistency) *taskList {
+	if workers < 1 {
+		workers = 1
+	}
 	mtx := &sync.Mutex{}
 	return &taskList{
-		tasks: make([]*taskInfo, 0),
-		mtx:   mtx,
-		cond:  sync.NewCond(mtx),
+		tasks:    make([]*taskInfo, 0),
+		running:  make(map[int]*taskInfo),
+		inFlight: make(map[string]*taskInfo),
+		workers:  workers,
+		freeId:   1, // 0 means no task in DownloadStatus
+		p:        p,
+		mtx:      mtx,
+		cond:     sync.NewCond(mtx),
 	}
 }
 
-func (t *taskList) addTask(downloadUrl string, checksum string, stream pb.DDSONService_DownloadServer, idOfClient int) *taskInfo {
+// restoreTasks loads the tasks that were pending or running when the server stopped, and queues them again.
+// They run without requesters, which can reattach by task ID. The chunks they completed are found in their staging directory.
+func (t *taskList) restoreTasks() error {
+	maxId, err := t.p.GetMaxTaskID()
+	if err != nil {
+		return err
+	}
+	tasks, err := t.p.GetUnfinishedTasks()
+	if err != nil {
+		return err
+	}
+
 	t.mtx.Lock()
+	if maxId >= t.freeId {
+		t.freeId = maxId + 1
+	}
+	for _, persisted := range tasks {
+		mirrors, err := t.p.GetTaskMirrors(int(persisted.Id))
+		if err != nil {
+			slog.Warn("Failed to load task mirrors, downloading from the URL only", "taskID", persisted.Id, "error", err)
+		}
+		// the batch ID is not persisted, restored tasks are scheduled on their own
+		// tasks saved before the priority was persisted have none, they run at the normal priority
+		priority := pb.Priority(pb.Priority_value[persisted.Priority])
+		task := newTaskInfo(persisted.URL, mirrors, persisted.Checksum, persisted.Requester, "", priority, int(persisted.Id), 0)
+		task.totalSize = persisted.TotalSize
+		t.tasks = append(t.tasks, task)
+		t.inFlight[inFlightKey(task.downloadUrl, task.checksum)] = task
+		slog.Info("Restored task", "taskID", task.id, "url", task.downloadUrl, "state", persisted.State)
+	}
+	t.mtx.Unlock()
+	t.cond.Broadcast()
+
+	slog.Info("Tasks restored", "count", len(tasks), "nextTaskID", t.freeId)
+	return nil
+}
+
+// inFlightKey identifies the download of a file, requests with the same key share one task.
+func inFlightKey(downloadUrl string, checksum string) string {
+	return downloadUrl + "\x00" + checksum
+}
+
+// addTask attaches the stream to the in-flight task downloading the same file,
+// or creates a new task if there is none.
+// An in-flight task gets the priority of the request if it is higher than its own.
+// It returns the task, the subscriber of the stream, and whether an existing task was reused.
+func (t *taskList) addTask(downloadUrl string, mirrors []string, checksum string, requester string, batchId string, priority pb.Priority, stream pb.DDSONService_DownloadServer, idOfClient int) (*taskInfo, *subscriber, bool) {
+	t.mtx.Lock()
+	key := inFlightKey(downloadUrl, checksum)
+	if task, exists := t.inFlight[key]; exists && !task.isFinished() {
+		if priorityRank(priority) > priorityRank(task.priority) {
+			slog.Info("Raising the priority of in-flight task", "taskID", task.id, "from", task.priority, "to", priority)
+			task.mtx.Lock()
+			task.priority = priority
+			task.mtx.Unlock()
+			if err := t.p.UpdateTaskPriority(task.id, priority.String()); err != nil {
+				slog.Warn("Failed to save task priority", "taskID", task.id, "error", err)
+			}
+		}
+		t.mtx.Unlock()
+		slog.Info("Attaching to in-flight task, it keeps its own mirrors", "taskID", task.id, "url", downloadUrl, "mirrors", len(task.mirrors))
+		return task, task.attach(stream, requester), true
+	}
+
 	newId := t.freeId
 	t.freeId++
 
-	task := newTaskInfo(downloadUrl, checksum, stream, newId, idOfClient)
+	task := newTaskInfo(downloadUrl, mirrors, checksum, requester, batchId, priority, newId, idOfClient)
+	if err := t.p.AddTask(newId, downloadUrl, mirrors, checksum, requester, priority.String()); err != nil {
+		slog.Error("Failed to save task, it will not survive a restart", "taskID", newId, "error", err)
+	}
+	sub := task.attach(stream, requester)
 	t.tasks = append(t.tasks, task)
+	t.inFlight[key] = task
 	t.mtx.Unlock()
 	t.cond.Broadcast() // Notify any waiting goroutines
 
-	return task
+	return task, sub, false
+}
+
+// attachTask attaches the stream of the requester to the pending or running task with the given ID.
+func (t *taskList) attachTask(taskId int, stream pb.DDSONService_DownloadServer, requester string) (*taskInfo, *subscriber, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	task := t.getTaskNoLock(taskId)
+	if task == nil || task.isFinished() {
+		return nil, nil, fmt.Errorf("task #%d is not pending or running", taskId)
+	}
+
+	slog.Info("Reattaching to task", "taskID", task.id, "url", task.downloadUrl)
+	return task, task.attach(stream, requester), nil
 }
 
-func (t *taskList) size() int {
+// getTask returns the pending or running task with the given ID, nil if there is none.
+func (t *taskList) getTask(taskId int) *taskInfo {
 	t.mtx.Lock()
 	defer t.mtx.Unlock()
-	return len(t.tasks)
+
+	return t.getTaskNoLock(taskId)
 }
 
+func (t *taskList) getTaskNoLock(taskId int) *taskInfo {
+	if task, exists := t.running[taskId]; exists {
+		return task
+	}
+	for _, task := range t.tasks {
+		if task.id == taskId {
+			return task
+		}
+	}
+	return nil
+}
+
+// cancelTask cancels a pending or running task.
+// A pending task is removed from the queue, a running task stops its subtasks and finishes with an error.
+func (t *taskList) cancelTask(taskId int, reason string) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for i, task := range t.tasks {
+		if task.id != taskId {
+			continue
+		}
+		slog.Info("Cancelling pending task", "taskID", taskId, "reason", reason)
+		t.tasks = append(t.tasks[:i], t.tasks[i+1:]...)
+		key := inFlightKey(task.downloadUrl, task.checksum)
+		if t.inFlight[key] == task {
+			delete(t.inFlight, key)
+		}
+		task.setCancelled(reason)
+		task.markDone()
+		t.persistState(task)
+		return nil
+	}
+
+	task, exists := t.running[taskId]
+	if !exists {
+		return fmt.Errorf("task #%d not found", taskId)
+	}
+	if task.isStopped() {
+		return fmt.Errorf("task #%d is already stopping", taskId)
+	}
+	slog.Info("Cancelling running task", "taskID", taskId, "reason", reason)
+	task.setCancelled(reason)
+	return nil
+}
+
+// promoteTask moves a pending task to the front of the queue, it starts before all the tasks that are not promoted.
+// The last promoted task goes first.
+func (t *taskList) promoteTask(taskId int) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for i, task := range t.tasks {
+		if task.id != taskId {
+			continue
+		}
+		slog.Info("Promoting pending task", "taskID", taskId, "position", i+1)
+		t.tasks = append([]*taskInfo{task}, slices.Delete(t.tasks, i, i+1)...)
+		task.mtx.Lock()
+		task.promoted = true
+		task.mtx.Unlock()
+		return nil
+	}
+
+	if _, exists := t.running[taskId]; exists {
+		return fmt.Errorf("task #%d is already running", taskId)
+	}
+	return fmt.Errorf("task #%d not found", taskId)
+}
+
+// snapshot returns the pending tasks in the order they are expected to start, and the running tasks by ID.
+func (t *taskList) snapshot() ([]*taskInfo, []*taskInfo) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	pending := t.scheduleOrderNoLock()
+	running := make([]*taskInfo, 0, len(t.running))
+	for _, task := range t.running {
+		running = append(running, task)
+	}
+	slices.SortFunc(running, func(a, b *taskInfo) int {
+		return a.id - b.id
+	})
+	return pending, running
+}
+
+// run starts the worker pool and blocks forever.
 func (t *taskList) run(server *server) error {
+	slog.Info("Starting task workers", "count", t.workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < t.workers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			t.worker(server, workerID)
+		}(i)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (t *taskList) worker(server *server, workerID int) {
 	for {
+		task := t.popTask(workerID)
+
+		slog.Info("Got a task to run", "workerID", workerID, "taskID", task.id, "clientID", task.idOfClient, "url", task.downloadUrl, "checksum", task.checksum)
+		executeTask(task, server)
+
 		t.mtx.Lock()
-		for len(t.tasks) == 0 {
-			slog.Info("task list empty, waiting...")
-			t.cond.Wait() // Wait for tasks to be added
+		delete(t.running, task.id)
+		key := inFlightKey(task.downloadUrl, task.checksum)
+		if t.inFlight[key] == task {
+			delete(t.inFlight, key)
 		}
-
-		// get the task on top
-		task := t.tasks[0]
-		t.tasks = t.tasks[1:] // Remove the task from the list
 		t.mtx.Unlock()
 
-		slog.Info("Got a task to run", "taskID", task.id, "clientID", task.idOfClient, "url", task.downloadUrl, "checksum", task.checksum)
+		t.persistState(task)
+		slog.Info("Worker finished task", "workerID", workerID, "taskID", task.id)
+	}
+}
+
+// popTask blocks until a task is available, then moves it from the queue to the running tasks.
+// The task to run is the first one of scheduleOrderNoLock.
+func (t *taskList) popTask(workerID int) *taskInfo {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
 
-		executeTask(task, server)
+	for len(t.tasks) == 0 {
+		slog.Info("task list empty, waiting...", "workerID", workerID)
+		t.cond.Wait() // Wait for tasks to be added
+	}
+
+	task := t.scheduleOrderNoLock()[0]
+	t.tasks = slices.DeleteFunc(t.tasks, func(pending *taskInfo) bool { return pending == task }) // Remove the task from the list
+	t.running[task.id] = task
+	return task
+}
+
+// persistState saves the current state of the task in the database.
+func (t *taskList) persistState(task *taskInfo) {
+	state, totalSize := task.getState(), task.getTotalSize()
+	err := t.p.UpdateTask(task.id, state.persistedState(), totalSize)
+	if err != nil {
+		slog.Warn("Failed to save task state", "taskID", task.id, "state", state, "error", err)
 	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"internal/pb"
+	"internal/persistency"
+)
+
+func newTestTaskList(t *testing.T, workers int) *taskList {
+	p, err := persistency.NewAndInitializePersistency(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAndInitializePersistency: %v", err)
+	}
+	return newTaskList(workers, p)
+}
+
+func TestTaskListWorkers(t *testing.T) {
+	tests := []struct {
+		workers int
+		want    int
+	}{
+		{workers: -1, want: 1},
+		{workers: 0, want: 1},
+		{workers: 3, want: 3},
+	}
+
+	for _, test := range tests {
+		if got := newTaskList(test.workers, nil).workers; got != test.want {
+			t.Errorf("newTaskList(%d) has %d workers, want %d", test.workers, got, test.want)
+		}
+	}
+}
+
+func TestPopTask(t *testing.T) {
+	list := newTestTaskList(t, 2)
+
+	// the workers wait for the queue
+	popped := make(chan *taskInfo)
+	for workerID := 0; workerID < 2; workerID++ {
+		go func() { popped <- list.popTask(workerID) }()
+	}
+	select {
+	case task := <-popped:
+		t.Fatalf("a worker got task #%d from an empty queue", task.id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	queued := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		task, _, _ := list.addTask(fmt.Sprintf("http://example.com/%d", i), nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, nil, 0)
+		queued[task.id] = true
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case task := <-popped:
+			if !queued[task.id] {
+				t.Fatalf("a worker got task #%d twice, or a task that was never queued", task.id)
+			}
+			delete(queued, task.id)
+		case <-time.After(time.Second):
+			t.Fatalf("%d workers still wait with %d tasks queued", 2-i, len(queued))
+		}
+	}
+	if len(list.tasks) != 0 || len(list.running) != 2 {
+		t.Fatalf("%d pending and %d running tasks once both workers got one, want 0 and 2", len(list.tasks), len(list.running))
+	}
+}
+
+func TestAddTaskCoalesces(t *testing.T) {
+	const url = "http://example.com/file"
+	tests := []struct {
+		name         string
+		url          string
+		checksum     string
+		priority     pb.Priority
+		finished     bool // the first task is finished before the request
+		wantAttached bool
+		wantPriority pb.Priority
+	}{
+		{name: "same file", url: url, priority: pb.Priority_PRIORITY_NORMAL, wantAttached: true, wantPriority: pb.Priority_PRIORITY_NORMAL},
+		{name: "higher priority raises the task", url: url, priority: pb.Priority_PRIORITY_HIGH, wantAttached: true, wantPriority: pb.Priority_PRIORITY_HIGH},
+		{name: "lower priority keeps the task", url: url, priority: pb.Priority_PRIORITY_LOW, wantAttached: true, wantPriority: pb.Priority_PRIORITY_NORMAL},
+		{name: "other checksum", url: url, checksum: "abc", priority: pb.Priority_PRIORITY_NORMAL, wantPriority: pb.Priority_PRIORITY_NORMAL},
+		{name: "other URL", url: url + ".sig", priority: pb.Priority_PRIORITY_NORMAL, wantPriority: pb.Priority_PRIORITY_NORMAL},
+		{name: "finished task", url: url, priority: pb.Priority_PRIORITY_NORMAL, finished: true, wantPriority: pb.Priority_PRIORITY_NORMAL},
+	}
+
+	for _, test := range tests {
+		list := newTestTaskList(t, 1)
+		first, _, attached := list.addTask(url, nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, nil, 0)
+		if attached {
+			t.Fatalf("%s: the first request attached to a task", test.name)
+		}
+		if test.finished {
+			first.setError(fmt.Errorf("failed"))
+		}
+
+		task, _, attached := list.addTask(test.url, nil, test.checksum, "10.0.0.2:40000", "", test.priority, nil, 0)
+		if attached != test.wantAttached || (task == first) != test.wantAttached {
+			t.Errorf("%s: attached = %v to task #%d, want %v", test.name, attached, task.id, test.wantAttached)
+		}
+		if task.priority != test.wantPriority {
+			t.Errorf("%s: task has priority %s, want %s", test.name, task.priority, test.wantPriority)
+		}
+		wantQueued := 2
+		if test.wantAttached {
+			wantQueued = 1
+		}
+		if len(list.tasks) != wantQueued {
+			t.Errorf("%s: %d tasks queued, want %d", test.name, len(list.tasks), wantQueued)
+		}
+		if test.wantAttached && len(first.subscribers) != 2 {
+			t.Errorf("%s: %d requesters attached to the task, want 2", test.name, len(first.subscribers))
+		}
+	}
+}
+
+func TestRestoreTasks(t *testing.T) {
+	list := newTestTaskList(t, 1)
+	low, _, _ := list.addTask("http://example.com/low", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_LOW, nil, 0)
+	raised, _, _ := list.addTask("http://example.com/raised", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, nil, 0)
+	list.addTask("http://example.com/raised", nil, "", "10.0.0.2:40000", "", pb.Priority_PRIORITY_HIGH, nil, 0)
+
+	// the server restarts
+	restored := newTaskList(1, list.p)
+	if err := restored.restoreTasks(); err != nil {
+		t.Fatalf("restoreTasks: %v", err)
+	}
+	want := map[int]pb.Priority{low.id: pb.Priority_PRIORITY_LOW, raised.id: pb.Priority_PRIORITY_HIGH}
+	if len(restored.tasks) != len(want) {
+		t.Fatalf("%d tasks restored, want %d", len(restored.tasks), len(want))
+	}
+	for _, task := range restored.tasks {
+		if task.priority != want[task.id] {
+			t.Errorf("task #%d restored with priority %s, want %s", task.id, task.priority, want[task.id])
+		}
+	}
+	if next, _, _ := restored.addTask("http://example.com/next", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_NORMAL, nil, 0); next.id <= raised.id {
+		t.Errorf("new task #%d reuses the ID of a restored task", next.id)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"slices"
+
+	"internal/pb"
+)
+
+// The queue is not FIFO: a pending task is scheduled by, in order,
+//   - promoted tasks first, see taskList.promoteTask
+//   - higher priority first
+//   - the requester with the fewest running tasks first, so one requester can not hold all the workers
+//   - the unit with the fewest running tasks of the requester first, so a single file does not wait behind a batch
+//   - the oldest task first
+//
+// Running tasks share the agents by requester, in proportion to the weight of the priority of their tasks,
+// see taskList.agentShare.
+
+// priorityRank orders the priorities, the highest rank goes first.
+func priorityRank(priority pb.Priority) int {
+	switch priority {
+	case pb.Priority_PRIORITY_LOW:
+		return 0
+	case pb.Priority_PRIORITY_HIGH:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// priorityWeight is the weight of a requester in the share of the agents, for the highest priority of its running tasks.
+func priorityWeight(priority pb.Priority) int {
+	return 1 << priorityRank(priority)
+}
+
+// requesterKey identifies the requester of a task for fair queuing.
+// Every stream of a requester comes from another port, so only the host is kept.
+func (t *taskInfo) requesterKey() string {
+	return requesterHost(t.requester)
+}
+
+// runningCounts is the number of running tasks of every requester and of every unit.
+type runningCounts struct {
+	requesters map[string]int
+	units      map[string]int
+}
+
+func (t *taskList) runningCountsNoLock() runningCounts {
+	counts := runningCounts{requesters: make(map[string]int), units: make(map[string]int)}
+	for _, task := range t.running {
+		counts.add(task)
+	}
+	return counts
+}
+
+func (c runningCounts) add(task *taskInfo) {
+	c.requesters[task.requesterKey()]++
+	c.units[task.unit()]++
+}
+
+// before returns true if a is scheduled before b, a being after b in the queue.
+// Promoted tasks keep their order in the queue.
+func (c runningCounts) before(a *taskInfo, b *taskInfo) bool {
+	if a.promoted != b.promoted {
+		return a.promoted
+	}
+	if a.promoted {
+		return false
+	}
+	if rankA, rankB := priorityRank(a.priority), priorityRank(b.priority); rankA != rankB {
+		return rankA > rankB
+	}
+	if runningA, runningB := c.requesters[a.requesterKey()], c.requesters[b.requesterKey()]; runningA != runningB {
+		return runningA < runningB
+	}
+	return c.units[a.unit()] < c.units[b.unit()]
+}
+
+// scheduleOrderNoLock returns the pending tasks in the order they start, if no running task finishes before.
+// Every task in the order counts as running for the tasks after it.
+func (t *taskList) scheduleOrderNoLock() []*taskInfo {
+	counts := t.runningCountsNoLock()
+	pending := slices.Clone(t.tasks)
+	order := make([]*taskInfo, 0, len(pending))
+	for len(pending) > 0 {
+		next := 0
+		for i := 1; i < len(pending); i++ {
+			if counts.before(pending[i], pending[next]) {
+				next = i
+			}
+		}
+		order = append(order, pending[next])
+		counts.add(pending[next])
+		pending = slices.Delete(pending, next, next+1)
+	}
+	return order
+}
+
+// agentShare returns the number of agent slots a running task may occupy at the same time, out of slotCount.
+// The agents are split between the requesters of the running tasks in proportion to their weight,
+// the share of a requester is split evenly between its units, see taskInfo.unit,
+// and the share of a unit between its running tasks.
+func (t *taskList) agentShare(slotCount int, task *taskInfo) int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	weights := make(map[string]int)
+	units := make(map[string]int) // running tasks of the units of the requester of task
+	for _, running := range t.running {
+		requester := running.requesterKey()
+		weights[requester] = max(weights[requester], priorityWeight(running.priority))
+		if requester == task.requesterKey() {
+			units[running.unit()]++
+		}
+	}
+	requester := task.requesterKey()
+	if _, exists := weights[requester]; !exists {
+		weights[requester] = priorityWeight(task.priority)
+	}
+	totalWeight := 0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+
+	requesterShare := max((slotCount*weights[requester]+totalWeight-1)/totalWeight, 1)
+	unitCount := max(len(units), 1)
+	unitShare := max((requesterShare+unitCount-1)/unitCount, 1)
+	tasksInUnit := max(units[task.unit()], 1)
+	return max((unitShare+tasksInUnit-1)/tasksInUnit, 1)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"internal/pb"
+)
+
+func TestScheduleOrder(t *testing.T) {
+	bot, dev := "10.0.0.1", "10.0.0.2"
+	newTask := func(id int, requester string, priority pb.Priority) *taskInfo {
+		return newTaskInfo(fmt.Sprintf("http://example.com/%d", id), nil, "", requester+":40000", "", priority, id, 0)
+	}
+
+	list := newTaskList(2, nil)
+	list.running[1] = newTask(1, bot, pb.Priority_PRIORITY_NORMAL)
+	list.tasks = []*taskInfo{
+		newTask(2, bot, pb.Priority_PRIORITY_NORMAL),
+		newTask(3, bot, pb.Priority_PRIORITY_NORMAL),
+		newTask(4, dev, pb.Priority_PRIORITY_NORMAL), // the bot already runs a task
+		newTask(5, bot, pb.Priority_PRIORITY_LOW),
+		newTask(6, bot, pb.Priority_PRIORITY_HIGH),
+	}
+	if err := list.promoteTask(3); err != nil {
+		t.Fatalf("promoteTask: %v", err)
+	}
+
+	want := []int{3, 6, 4, 2, 5}
+	order := list.scheduleOrderNoLock()
+	if len(order) != len(want) {
+		t.Fatalf("%d tasks scheduled, want %d", len(order), len(want))
+	}
+	for i, task := range order {
+		if task.id != want[i] {
+			t.Fatalf("task #%d at position %d, want #%d", task.id, i+1, want[i])
+		}
+	}
+}
+
+func TestAgentShare(t *testing.T) {
+	list := newTaskList(3, nil)
+	bot := newTaskInfo("http://example.com/bot", nil, "", "10.0.0.1:40000", "", pb.Priority_PRIORITY_LOW, 1, 0)
+	dev := newTaskInfo("http://example.com/dev", nil, "", "10.0.0.2:40000", "", pb.Priority_PRIORITY_HIGH, 2, 0)
+	list.running[bot.id] = bot
+	list.running[dev.id] = dev
+
+	// weights 1 and 4
+	if share := list.agentShare(10, bot); share != 2 {
+		t.Errorf("share of the low priority task = %d, want 2", share)
+	}
+	if share := list.agentShare(10, dev); share != 8 {
+		t.Errorf("share of the high priority task = %d, want 8", share)
+	}
+}
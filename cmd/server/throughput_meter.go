@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const THROUGHPUT_WINDOW = time.Minute // the recent throughput of the server is measured over this duration
+
+// throughputMeter measures the recent aggregate throughput of the server from the chunks downloaded by all agents.
+// Unlike the speed of a task, which is averaged since the task started, it follows the current load of the agents.
+type throughputMeter struct {
+	mtx     sync.Mutex
+	window  time.Duration
+	samples []throughputSample // chunks finished within the window, oldest first
+}
+
+type throughputSample struct {
+	start time.Time
+	end   time.Time
+	bytes int64
+}
+
+func newThroughputMeter(window time.Duration) *throughputMeter {
+	return &throughputMeter{window: window}
+}
+
+// add records a chunk of the given size that took duration to download, and has just finished.
+func (m *throughputMeter) add(bytes int64, duration time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := time.Now()
+	m.samples = append(m.samples, throughputSample{start: now.Add(-duration), end: now, bytes: bytes})
+	m.pruneNoLock(now)
+}
+
+// rate returns the bytes per second downloaded within the window, 0 if nothing was downloaded.
+// When the server was idle at the start of the window, the rate is measured from the start of the oldest chunk.
+func (m *throughputMeter) rate() int {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	now := time.Now()
+	m.pruneNoLock(now)
+	if len(m.samples) == 0 {
+		return 0
+	}
+
+	var bytes int64
+	since := now
+	for _, sample := range m.samples {
+		bytes += sample.bytes
+		if sample.start.Before(since) {
+			since = sample.start
+		}
+	}
+	elapsed := min(now.Sub(since), m.window)
+	if elapsed <= 0 {
+		return 0
+	}
+	return int(float64(bytes) / elapsed.Seconds())
+}
+
+func (m *throughputMeter) pruneNoLock(now time.Time) {
+	i := 0
+	for i < len(m.samples) && now.Sub(m.samples[i].end) > m.window {
+		i++
+	}
+	m.samples = m.samples[i:]
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThroughputMeter(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []throughputSample // chunks that finished before the test, relative to now
+		chunks  []int64            // chunks of one second that have just finished
+		want    int
+	}{
+		{name: "idle", want: 0},
+		{name: "one chunk", chunks: []int64{1000}, want: 1000},
+		{name: "chunks in parallel", chunks: []int64{1000, 3000}, want: 4000},
+		{
+			name:    "chunks out of the window are forgotten",
+			samples: []throughputSample{{start: time.Now().Add(-3 * time.Minute), end: time.Now().Add(-2 * time.Minute), bytes: 1 << 20}},
+			want:    0,
+		},
+		{
+			name:    "measured from the start of the oldest chunk",
+			samples: []throughputSample{{start: time.Now().Add(-10 * time.Second), end: time.Now().Add(-5 * time.Second), bytes: 4000}},
+			chunks:  []int64{1000},
+			want:    500,
+		},
+		{
+			name:    "measured over the window at most",
+			samples: []throughputSample{{start: time.Now().Add(-2 * time.Minute), end: time.Now().Add(-30 * time.Second), bytes: 5000}},
+			chunks:  []int64{1000},
+			want:    100,
+		},
+	}
+
+	for _, test := range tests {
+		meter := newThroughputMeter(time.Minute)
+		meter.samples = append(meter.samples, test.samples...)
+		for _, bytes := range test.chunks {
+			meter.add(bytes, time.Second)
+		}
+		// time goes on while the rate is measured, it is a little lower than the exact rate
+		if got := meter.rate(); got > test.want || got < test.want*99/100 {
+			t.Errorf("%s: rate = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
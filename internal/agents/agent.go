@@ -1,12 +1,35 @@
 package agents
 
-import "log/slog"
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// ErrOrigin marks the errors of the origin server that agents report, such as a rejected URL.
+// They do not count against the error budget of the agent, any other agent would get them too.
+var ErrOrigin = errors.New("origin error")
+
+// ErrAgentBusy marks the downloads an agent refused because all its slots were running one.
+// They do not count against the error budget of the agent, the task is retried on another agent.
+var ErrAgentBusy = errors.New("agent busy")
+
+// ErrThrottled marks the origin errors that ask to slow down, such as 429 Too Many Requests.
+// They are not retried on other agents, which would be throttled too, the caller waits for the origin first.
+var ErrThrottled = errors.New("throttled by the origin")
 
 type AgentInfo struct {
-	name    string
-	id      int
-	version string
-	addr    string
+	name     string
+	id       int
+	version  string
+	addr     string
+	identity string           // persistent identity of the agent across restarts, empty for agents that do not keep one
+	conn     *grpc.ClientConn // closed by Close but not cleared, Conn reports a closed connection as an error
 }
 
 func (ai *AgentInfo) GetName() string {
@@ -21,54 +44,112 @@ func (ai *AgentInfo) GetVersion() string {
 func (ai *AgentInfo) GetAddr() string {
 	return ai.addr
 }
+func (ai *AgentInfo) GetIdentity() string {
+	return ai.identity
+}
+
+// banKeys returns the keys an agent is banned by, its address, and its identity if it has one.
+func (ai *AgentInfo) banKeys() []string {
+	if ai.identity != "" {
+		return []string{ai.addr, ai.identity}
+	}
+	return []string{ai.addr}
+}
+
+// host returns the host of the agent address, without its port.
+func (ai *AgentInfo) host() string {
+	host, _, err := net.SplitHostPort(ai.addr)
+	if err != nil {
+		return ai.addr
+	}
+	return host
+}
 
 type Agent interface {
-	Close()
+	Close()                   // closes the connection to the agent, once it is removed from the agent list
 	GetAgentInfo() *AgentInfo // returns the agent info
 
-	RunTask(func(*AgentInfo) error)
+	RunTask(func(*AgentInfo) error) error // runs the task on the agent, counting its errors
 
 	GetErrorCount() int // returns the error count of the agent
+	GetSlots() int      // returns the number of tasks the agent runs at the same time
+	SetSlots(slots int) // changes the number of tasks the agent runs at the same time, at least one
 	Retire()            // marks the agent as retired, meaning it will not accept new tasks any more
 
-	setID(id int) // sets the ID of the agent, used internally
+	RecordDownload(bytes int64, duration time.Duration, firstByte time.Duration) // records a completed download, to measure the throughput and the time to the first byte
+	GetThroughput() int                                                          // returns the measured throughput in bytes per second, 0 if unknown
+	GetHealth() Health                                                           // returns a snapshot of the health record of the agent
+
+	setID(id int)                               // sets the ID of the agent, used internally
+	resumeFrom(previous Agent, withErrors bool) // takes over the health record and the error count of a previous instance of the agent, used internally
 }
 
 type AgentImpl struct {
 	agentInfo  *AgentInfo // contains the agent's information
 	errorCount int        // number of errors encountered by the agent
+	slots      int        // number of tasks the agent runs at the same time
+
+	mtx    sync.Mutex   // protects errorCount and slots
+	health healthRecord // how the agent did on its recent tasks, see SelectionStrategy
 }
 
-func NewAgent(name string, version string, addr string) *AgentImpl {
+// NewAgent returns the agent listening at addr, with its connection, see AgentInfo.Conn.
+// The agent runs up to slots tasks at the same time, at least one.
+// identity is the persistent identity of the agent, the agent list recognizes a returning agent by it. It may be empty.
+func NewAgent(name string, version string, addr string, identity string, slots int) (*AgentImpl, error) {
+	conn, err := dialAgent(addr)
+	if err != nil {
+		return nil, err
+	}
 	return &AgentImpl{
 		agentInfo: &AgentInfo{
-			name:    name,
-			id:      -1,
-			version: version,
-			addr:    addr,
+			name:     name,
+			id:       -1,
+			version:  version,
+			addr:     addr,
+			identity: identity,
+			conn:     conn,
 		},
 		errorCount: 0,
-	}
+		slots:      max(slots, 1),
+	}, nil
 }
 
+// Close closes the connection to the agent, the downloads still running on it fail.
 func (a *AgentImpl) Close() {
-	// Implement any cleanup logic if necessary
+	if conn := a.agentInfo.conn; conn != nil {
+		if err := conn.Close(); err != nil {
+			slog.Warn("Failed to close the connection to the agent", "agentID", a.agentInfo.id, "error", err)
+		}
+		slog.Debug("Agent connection closed", "agentID", a.agentInfo.id, "address", a.agentInfo.addr)
+	}
 }
 
 func (a *AgentImpl) GetAgentInfo() *AgentInfo {
 	return a.agentInfo
 }
 
-func (a *AgentImpl) RunTask(taskFunc func(agentInfo *AgentInfo) error) {
-	if err := taskFunc(a.GetAgentInfo()); err != nil {
-		a.errorCount++ // Increment error count if the task fails
-		// if the agent has encountered too many errors, retire it
-		if a.errorCount > 3 {
-			a.Retire()
+// RunTask runs the task on the agent. A failed task counts against the error budget of the agent,
+// unless it was cancelled by the caller, failed because of the origin, or the agent was busy. A successful task takes one error back.
+// The agent list retires agents that exceed the budget. The counted errors and the successes go into the health record too.
+func (a *AgentImpl) RunTask(taskFunc func(agentInfo *AgentInfo) error) error {
+	err := taskFunc(a.GetAgentInfo())
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err != nil {
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, ErrOrigin) && !errors.Is(err, ErrAgentBusy) {
+			a.errorCount++ // Increment error count if the task fails
+			a.health.recordResult(true)
+			slog.Debug("Agent error counted", "agentID", a.agentInfo.id, "errorCount", a.errorCount, "error", err)
+		}
+	} else {
+		if a.errorCount > 0 {
+			a.errorCount--
 		}
-	} else if a.errorCount > 0 {
-		a.errorCount--
+		a.health.recordResult(false)
 	}
+	return err
 }
 
 func (a *AgentImpl) Retire() {
@@ -79,10 +160,54 @@ func (a *AgentImpl) Retire() {
 }
 
 func (a *AgentImpl) GetErrorCount() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
 	return a.errorCount
 }
 
+func (a *AgentImpl) GetSlots() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.slots
+}
+
+func (a *AgentImpl) SetSlots(slots int) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.slots = max(slots, 1)
+}
+
 func (a *AgentImpl) setID(id int) {
 	a.agentInfo.id = id
 	slog.Debug("Agent ID set", "agentName", a.agentInfo.name, "agentID", id)
 }
+
+func (a *AgentImpl) resumeFrom(previous Agent, withErrors bool) {
+	prev, ok := previous.(*AgentImpl)
+	if !ok || prev == a {
+		return
+	}
+	a.health.restore(&prev.health)
+	if !withErrors {
+		return
+	}
+	prev.mtx.Lock()
+	errorCount := prev.errorCount
+	prev.mtx.Unlock()
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.errorCount = errorCount
+}
+
+func (a *AgentImpl) RecordDownload(bytes int64, duration time.Duration, firstByte time.Duration) {
+	a.health.recordDownload(bytes, duration, firstByte)
+}
+
+func (a *AgentImpl) GetThroughput() int {
+	return a.health.snapshot().Throughput
+}
+
+func (a *AgentImpl) GetHealth() Health {
+	return a.health.snapshot()
+}
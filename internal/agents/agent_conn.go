@@ -0,0 +1,51 @@
+package agents
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+)
+
+// AGENT_KEEPALIVE is how often the connection to an idle agent is checked.
+// Agents accept pings this often, see the keepalive enforcement policy of the agent.
+const AGENT_KEEPALIVE = 30 * time.Second
+
+// dialAgent opens the connection to the agent at addr, shared by all the downloads that run on the agent.
+// It connects in the background, and keeps checking the agent with pings, a dead agent is noticed between downloads too.
+func dialAgent(addr string) (*grpc.ClientConn, error) {
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                AGENT_KEEPALIVE,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to agent at %s: %w", addr, err)
+	}
+	conn.Connect()
+	return conn, nil
+}
+
+// Conn returns the connection to the agent, shared by all the downloads that run on it.
+// It fails if the agent was removed, or can not be reached. gRPC reconnects in the background meanwhile.
+func (ai *AgentInfo) Conn() (*grpc.ClientConn, error) {
+	if ai.conn == nil {
+		return nil, fmt.Errorf("agent %d has no connection", ai.id)
+	}
+	switch state := ai.conn.GetState(); state {
+	case connectivity.Shutdown:
+		return nil, fmt.Errorf("connection to agent %d is closed", ai.id)
+	case connectivity.TransientFailure:
+		return nil, fmt.Errorf("agent %d at %s is unreachable", ai.id, ai.addr)
+	case connectivity.Idle:
+		// idle after a long time without downloads, wake it up
+		ai.conn.Connect()
+	}
+	return ai.conn, nil
+}
@@ -0,0 +1,25 @@
+package agents
+
+import (
+	"testing"
+)
+
+func TestAgentConnClosedOnRemove(t *testing.T) {
+	list := NewAgentList(DefaultRetryPolicy(), leastLoaded{})
+	agent, err := NewAgent("a1", "0.0.1", "127.0.0.1:5601", "", 1)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	if _, err := list.AddAgent(agent); err != nil {
+		t.Fatalf("AddAgent: %v", err)
+	}
+
+	if agent.GetAgentInfo().conn == nil {
+		t.Fatalf("the agent has no connection")
+	}
+
+	list.RemoveAgent(agent)
+	if _, err := agent.GetAgentInfo().Conn(); err == nil {
+		t.Fatalf("the connection of a removed agent is still open")
+	}
+}
@@ -0,0 +1,106 @@
+package agents
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// healthWeight is the weight of the latest download in the moving averages of the health record.
+	healthWeight = 0.3
+	// HEALTH_FAILURE_WINDOW is how long a failure counts as recent.
+	HEALTH_FAILURE_WINDOW = 10 * time.Minute
+)
+
+// healthRecord is the rolling record of how an agent did on its recent tasks, the selection strategies rank agents by it.
+type healthRecord struct {
+	mtx        sync.Mutex
+	throughput float64       // moving average of the throughput, in bytes per second, 0 if not measured yet
+	firstByte  time.Duration // moving average of the time to the first byte of a download, 0 if not measured yet
+	errorRate  float64       // moving average of the failed tasks, from 0 to 1
+	failures   []time.Time   // failures within HEALTH_FAILURE_WINDOW, oldest first
+}
+
+// Health is a snapshot of the health record of an agent.
+type Health struct {
+	Throughput     int           // bytes per second, 0 if unknown
+	FirstByte      time.Duration // time to the first byte of a download, 0 if unknown
+	ErrorRate      float64       // fraction of the recent tasks that failed, from 0 to 1
+	RecentFailures int           // failures within HEALTH_FAILURE_WINDOW
+}
+
+// Score rates the health from 0 to 1, 1 for an agent that never failed.
+// Recent failures weigh more than the error rate, a flaky agent recovers once it stops failing.
+func (h Health) Score() float64 {
+	return (1 - h.ErrorRate) / float64(1+h.RecentFailures)
+}
+
+// recordDownload records a completed download of the given size.
+func (r *healthRecord) recordDownload(bytes int64, duration time.Duration, firstByte time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if bytes > 0 && duration > 0 {
+		speed := float64(bytes) / duration.Seconds()
+		if r.throughput == 0 {
+			r.throughput = speed
+		} else {
+			r.throughput = healthWeight*speed + (1-healthWeight)*r.throughput
+		}
+	}
+	if firstByte > 0 {
+		if r.firstByte == 0 {
+			r.firstByte = firstByte
+		} else {
+			r.firstByte = time.Duration(healthWeight*float64(firstByte) + (1-healthWeight)*float64(r.firstByte))
+		}
+	}
+}
+
+// recordResult records the result of a task that ran on the agent, failed is false on success.
+func (r *healthRecord) recordResult(failed bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	result := 0.0
+	now := time.Now()
+	if failed {
+		result = 1
+		r.failures = append(r.failures, now)
+	}
+	r.errorRate = healthWeight*result + (1-healthWeight)*r.errorRate
+	r.pruneNoLock(now)
+}
+
+// restore copies the record of a previous instance of the agent.
+func (r *healthRecord) restore(from *healthRecord) {
+	from.mtx.Lock()
+	throughput, firstByte, errorRate, failures := from.throughput, from.firstByte, from.errorRate, slices.Clone(from.failures)
+	from.mtx.Unlock()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.throughput, r.firstByte, r.errorRate, r.failures = throughput, firstByte, errorRate, failures
+}
+
+func (r *healthRecord) snapshot() Health {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.pruneNoLock(time.Now())
+	return Health{
+		Throughput:     int(r.throughput),
+		FirstByte:      r.firstByte,
+		ErrorRate:      r.errorRate,
+		RecentFailures: len(r.failures),
+	}
+}
+
+func (r *healthRecord) pruneNoLock(now time.Time) {
+	i := 0
+	for i < len(r.failures) && now.Sub(r.failures[i]) > HEALTH_FAILURE_WINDOW {
+		i++
+	}
+	r.failures = r.failures[i:]
+}
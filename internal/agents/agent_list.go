@@ -1,37 +1,63 @@
 package agents
 
 import (
+	"context"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 )
 
 type AgentList interface {
 	AddAgent(agent Agent) (int, error)
-	RemoveAgent(id int)
+	RemoveAgent(agent Agent) // removes the agent, unless it was already removed
 	GetAgentByID(id int) Agent
 	Count() int
-
-	RunTask(task func(*AgentInfo) error) error // runs a task on the agent list, blocking until a free agent is available
-
-	BanAgent(id int, reason string, until time.Time) // marks an agent as banned, preventing it from accepting new tasks until the specified time
+	Throughputs() []int // returns the measured throughput of every agent, 0 for agents not measured yet
+
+	RunTask(ctx context.Context, task func(*AgentInfo) error) error                          // runs a task once on the agent list, blocking until a free agent is available or ctx is done
+	RunTaskExcluding(ctx context.Context, excluded []int, task func(*AgentInfo) error) error // like RunTask, but never runs the task on the excluded agents
+	FreeCount() int                                                                          // returns the number of free slots of all agents
+	SlotCount() int                                                                          // returns the number of slots of all agents, the tasks they run at the same time
+	AgentStates() []AgentState                                                               // returns a snapshot of all agents, including the banned ones
+	AgentState(id int) (AgentState, bool)                                                    // returns a snapshot of a live agent, false if the agent is not in the list
+	StrategyName() string                                                                    // returns the name of the strategy picking the agent of every task
+
+	BanAgent(id int, reason string, until time.Time) // marks an agent as banned, preventing it from accepting new tasks until the specified time. An agent is banned by its address, and by its identity if it has one
+	DrainAgent(id int) bool                          // stops giving new tasks to an agent, the running ones go on. false if the agent does not exist
+	SetSlots(id int, slots int) bool                 // changes the number of tasks an agent runs at the same time. false if the agent does not exist
 }
 
+// AgentListImpl hands out the slots of the agents, an agent runs up to Agent.GetSlots tasks at the same time.
+// An agent is free while it has a free slot, and busy once all its slots run a task.
+// The strategy picks which of the free agents runs the next task. A draining agent gets no new task.
+// An agent with an identity that comes back, after a restart or a reconnection, gets its ID, health record and error count back.
+// The identity is not authenticated, only an agent coming back from the host of the last instance takes them over.
 type AgentListImpl struct {
 	freeAgents   map[int]Agent
 	busyAgents   map[int]Agent
-	bannedAgents map[string]time.Time // map to track banned agents by their address
+	running      map[int]int            // tasks running on every agent
+	draining     map[int]bool           // agents that get no new task, they leave once their tasks are done
+	bannedAgents map[string]bannedAgent // map to track banned agents by their address, and by their identity if they have one
+	known        map[string]*knownAgent // agents with an identity, live or gone, by identity
+	policy       RetryPolicy            // when an agent is banned
+	strategy     SelectionStrategy      // picks the agent of every task
 
 	nextID int
 	mtx    sync.Mutex // mutex to protect the agents map
 	cond   *sync.Cond // condition variable to signal when an agent is available
 }
 
-func NewAgentList() *AgentListImpl {
+func NewAgentList(policy RetryPolicy, strategy SelectionStrategy) *AgentListImpl {
 	agentList := &AgentListImpl{
 		freeAgents:   make(map[int]Agent),
 		busyAgents:   make(map[int]Agent),
-		bannedAgents: make(map[string]time.Time),
+		running:      make(map[int]int),
+		draining:     make(map[int]bool),
+		bannedAgents: make(map[string]bannedAgent),
+		known:        make(map[string]*knownAgent),
+		policy:       policy,
+		strategy:     strategy,
 	}
 	agentList.cond = sync.NewCond(&agentList.mtx)
 	return agentList
@@ -41,42 +67,89 @@ func (al *AgentListImpl) AddAgent(agent Agent) (int, error) {
 	al.mtx.Lock()
 	defer al.mtx.Unlock()
 
-	agentAddr := agent.GetAgentInfo().GetAddr()
+	info := agent.GetAgentInfo()
+	agentAddr := info.GetAddr()
 
-	isBanned, until := al.isAgentBannedNoLock(agentAddr)
-	if isBanned {
-		return 0, &AgentIsBannedError{
-			AgentAddr: agentAddr,
-			Until:     until,
+	for _, key := range info.banKeys() {
+		isBanned, until := al.isAgentBannedNoLock(key)
+		if isBanned {
+			return 0, &AgentIsBannedError{
+				AgentAddr: agentAddr,
+				Until:     until,
+			}
 		}
 	}
 
-	id := al.nextID
-	al.nextID++
+	al.pruneKnownNoLock()
+	identity := info.GetIdentity()
+	known, returning := al.known[identity]
+	if returning && known.live {
+		return 0, &AlreadyExistsError{ID: known.id, Identity: identity}
+	}
+	var id int
+	switch {
+	case returning && info.host() != known.agent.GetAgentInfo().host():
+		// anyone can claim an identity, an agent from another host starts over and the record of the identity is kept
+		id = al.nextID
+		al.nextID++
+		slog.Warn("Agent claims the identity of an agent from another host, registered as a new agent", "id", id, "identity", identity, "address", agentAddr, "knownAddress", known.agent.GetAgentInfo().GetAddr())
+	case returning:
+		id = known.id
+		agent.resumeFrom(known.agent, !known.banned)
+		slog.Info("Agent returned", "id", id, "identity", identity, "away", time.Since(known.left).Round(time.Second))
+		al.known[identity] = &knownAgent{id: id, agent: agent, live: true}
+	default:
+		id = al.nextID
+		al.nextID++
+		if identity != "" {
+			al.known[identity] = &knownAgent{id: id, agent: agent, live: true}
+		}
+	}
 	agent.setID(id)
 
 	al.freeAgents[id] = agent
-	al.cond.Signal() // Signal that a new agent has been added
+	al.cond.Broadcast() // Signal that a new agent has been added, each of its slots can take a waiting task
 	return id, nil
 }
 
-func (al *AgentListImpl) RemoveAgent(id int) {
+// RemoveAgent removes the agent, when it disconnects. A returning agent may already use its ID, it is not removed.
+func (al *AgentListImpl) RemoveAgent(agent Agent) {
 	al.mtx.Lock()
 	defer al.mtx.Unlock()
 
-	if _, exists := al.freeAgents[id]; exists {
-		delete(al.freeAgents, id)
-	} else if _, busyExists := al.busyAgents[id]; busyExists {
-		delete(al.busyAgents, id)
-	} else {
+	id := agent.GetAgentInfo().GetID()
+	if al.getAgentByIDNoLock(id) != agent {
+		return // already removed
+	}
+	al.removeAgentNoLock(id)
+}
+
+// removeAgentNoLock removes the agent from the list, and closes its connection.
+// The agent is remembered by its identity, if it has one.
+func (al *AgentListImpl) removeAgentNoLock(id int) {
+	agent := al.getAgentByIDNoLock(id)
+	if agent == nil {
 		return // Agent with this ID does not exist
 	}
+	if known, exists := al.known[agent.GetAgentInfo().GetIdentity()]; exists && known.agent == agent {
+		known.live = false
+		known.left = time.Now()
+	}
+	delete(al.freeAgents, id)
+	delete(al.busyAgents, id)
+	delete(al.running, id)
+	delete(al.draining, id)
+	agent.Close()
 }
 
 func (al *AgentListImpl) GetAgentByID(id int) Agent {
 	al.mtx.Lock()
 	defer al.mtx.Unlock()
 
+	return al.getAgentByIDNoLock(id)
+}
+
+func (al *AgentListImpl) getAgentByIDNoLock(id int) Agent {
 	agent, exists := al.freeAgents[id]
 	if exists {
 		return agent
@@ -96,100 +169,316 @@ func (al *AgentListImpl) Count() int {
 	return len(al.freeAgents) + len(al.busyAgents)
 }
 
+func (al *AgentListImpl) Throughputs() []int {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	throughputs := make([]int, 0, len(al.freeAgents)+len(al.busyAgents))
+	for _, agent := range al.freeAgents {
+		throughputs = append(throughputs, agent.GetThroughput())
+	}
+	for _, agent := range al.busyAgents {
+		throughputs = append(throughputs, agent.GetThroughput())
+	}
+	return throughputs
+}
+
 func (al *AgentListImpl) BanAgent(id int, reason string, until time.Time) {
 	al.mtx.Lock()
 	defer al.mtx.Unlock()
 
-	agent := al.GetAgentByID(id)
+	agent := al.getAgentByIDNoLock(id)
 	if agent == nil {
 		slog.Warn("Attempted to ban non-existent agent", "id", id, "reason", reason)
 		return
 	}
+	al.banAgentNoLock(agent, reason, until)
+}
+
+// banInstance bans the agent, if this instance of it is still in the list.
+// A returning agent takes over the ID of its previous instance, the tasks still running on the previous instance do not ban it.
+// It returns false if the instance is gone.
+func (al *AgentListImpl) banInstance(agent Agent, reason string, until time.Time) bool {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	if al.getAgentByIDNoLock(agent.GetAgentInfo().GetID()) != agent {
+		return false
+	}
+	al.banAgentNoLock(agent, reason, until)
+	return true
+}
 
+func (al *AgentListImpl) banAgentNoLock(agent Agent, reason string, until time.Time) {
+	id := agent.GetAgentInfo().GetID()
 	if until.IsZero() {
 		slog.Warn("Attempted to ban agent without a valid until time", "id", id, "reason", reason)
 		return
 	}
-	agentAddr := agent.GetAgentInfo().GetAddr()
-	al.bannedAgents[agentAddr] = until // Ban the agent by its address
-	slog.Info("Banned agent", "id", id, "address", agentAddr, "reason", reason, "until", until)
+	info := agent.GetAgentInfo()
+	keys := info.banKeys()
+	known, holder := al.known[info.GetIdentity()]
+	if holder && known.agent == agent {
+		known.banned = true // the ban settles its errors, the agent starts over once it returns
+	} else {
+		keys = keys[:1] // an agent from another host claiming the identity does not get the identity banned
+	}
+	for _, key := range keys {
+		al.bannedAgents[key] = bannedAgent{info: *info, until: until} // Ban the agent by its address and its identity
+	}
+	slog.Info("Banned agent", "id", id, "address", info.GetAddr(), "identity", info.GetIdentity(), "reason", reason, "until", until)
 
 	// Remove the agent from free and busy lists if it exists
-	al.RemoveAgent(id)
+	al.removeAgentNoLock(id)
 }
 
-func (al *AgentListImpl) RunTask(task func(*AgentInfo) error) error {
-	var err error
-	for i := 0; i < 3; i++ {
-		err = al.runTaskOnce(task)
+func (al *AgentListImpl) AgentStates() []AgentState {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
 
-		if err == nil {
-			slog.Info("Task executed successfully on agent", "attempt", i+1)
-			return nil
+	states := make([]AgentState, 0, len(al.freeAgents)+len(al.busyAgents)+len(al.bannedAgents))
+	for id, agent := range al.freeAgents {
+		states = append(states, newAgentState(agent, al.stateNoLock(id, AgentStateFree), al.running[id]))
+	}
+	for id, agent := range al.busyAgents {
+		states = append(states, newAgentState(agent, al.stateNoLock(id, AgentStateBusy), al.running[id]))
+	}
+	for key := range al.bannedAgents {
+		// an agent banned by both its address and its identity is listed once, by its address
+		if banned, until := al.isAgentBannedNoLock(key); banned && key == al.bannedAgents[key].info.addr {
+			info := al.bannedAgents[key].info
+			states = append(states, AgentState{
+				ID:          info.id,
+				Name:        info.name,
+				Addr:        info.addr,
+				Identity:    info.identity,
+				Version:     info.version,
+				State:       AgentStateBanned,
+				BannedUntil: until,
+			})
 		}
 	}
+	slices.SortFunc(states, func(a, b AgentState) int {
+		return a.ID - b.ID
+	})
+	return states
+}
 
-	slog.Error("Failed to execute task after retries", "error", err)
-	return err
+// AgentState returns the state of one agent, without building the snapshot of all agents. A banned agent is not in the list.
+func (al *AgentListImpl) AgentState(id int) (AgentState, bool) {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	agent := al.getAgentByIDNoLock(id)
+	if agent == nil {
+		return AgentState{}, false
+	}
+	state := AgentStateFree
+	if _, busy := al.busyAgents[id]; busy {
+		state = AgentStateBusy
+	}
+	return newAgentState(agent, al.stateNoLock(id, state), al.running[id]), true
 }
 
-func (al *AgentListImpl) getOneFreeAgent() Agent {
+func (al *AgentListImpl) stateNoLock(id int, state string) string {
+	if al.draining[id] {
+		return AgentStateDraining
+	}
+	return state
+}
+
+// FreeCount returns the number of free slots of all agents, the draining agents have none.
+func (al *AgentListImpl) FreeCount() int {
 	al.mtx.Lock()
 	defer al.mtx.Unlock()
 
-	for len(al.freeAgents) == 0 {
-		al.cond.Wait() // Wait until a free agent is available
+	free := 0
+	for id, agent := range al.freeAgents {
+		if !al.draining[id] {
+			free += agent.GetSlots() - al.running[id]
+		}
 	}
+	return free
+}
+
+// SlotCount returns the number of slots of all agents, except the draining ones.
+func (al *AgentListImpl) SlotCount() int {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	slots := 0
 	for id, agent := range al.freeAgents {
-		delete(al.freeAgents, id) // Remove from free agents
-		al.busyAgents[id] = agent // Add to busy agents
-		return agent              // Return the first available free agent
+		if !al.draining[id] {
+			slots += agent.GetSlots()
+		}
+	}
+	for id, agent := range al.busyAgents {
+		if !al.draining[id] {
+			slots += agent.GetSlots()
+		}
+	}
+	return slots
+}
+
+func (al *AgentListImpl) DrainAgent(id int) bool {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	if al.getAgentByIDNoLock(id) == nil {
+		return false
 	}
+	if !al.draining[id] {
+		al.draining[id] = true
+		slog.Info("Agent draining", "agentID", id, "running", al.running[id])
+	}
+	return true
+}
+
+// SetSlots changes the slots of the agent, it becomes busy or free again depending on its running tasks.
+func (al *AgentListImpl) SetSlots(id int, slots int) bool {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	agent := al.getAgentByIDNoLock(id)
+	if agent == nil {
+		return false
+	}
+	agent.SetSlots(slots)
+	if al.running[id] >= agent.GetSlots() {
+		delete(al.freeAgents, id)
+		al.busyAgents[id] = agent
+	} else {
+		delete(al.busyAgents, id)
+		al.freeAgents[id] = agent
+	}
+	slog.Info("Agent slots changed", "agentID", id, "slots", agent.GetSlots(), "running", al.running[id])
+	al.cond.Broadcast() // the new slots can take waiting tasks
+	return true
+}
 
-	return nil // No free agents available
+func (al *AgentListImpl) RunTask(ctx context.Context, task func(*AgentInfo) error) error {
+	return al.RunTaskExcluding(ctx, nil, task)
 }
 
-func (al *AgentListImpl) freeAgent(id int) {
+// RunTaskExcluding runs the task once, on a free agent that is not excluded.
+// The task is not retried on another agent, the caller owns the attempts and the backoff between them, see RetryPolicy.
+func (al *AgentListImpl) RunTaskExcluding(ctx context.Context, excluded []int, task func(*AgentInfo) error) error {
+	_, err := al.runTaskOnce(ctx, excluded, task)
+	return err
+}
+
+func (al *AgentListImpl) StrategyName() string {
+	return al.strategy.Name()
+}
+
+// getOneFreeAgent takes a slot of the free agent the strategy picks, waiting for one until ctx is done.
+func (al *AgentListImpl) getOneFreeAgent(ctx context.Context, excluded []int) (Agent, error) {
+	// the waiters are woken up when ctx is done, so a stopped task does not wait for an agent
+	stop := context.AfterFunc(ctx, func() {
+		al.mtx.Lock()
+		defer al.mtx.Unlock()
+		al.cond.Broadcast()
+	})
+	defer stop()
+
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		candidates := make([]Candidate, 0, len(al.freeAgents))
+		for id, agent := range al.freeAgents {
+			if slices.Contains(excluded, id) || al.draining[id] {
+				continue
+			}
+			candidates = append(candidates, Candidate{Agent: agent, Running: al.running[id], Health: agent.GetHealth()})
+		}
+		if len(candidates) > 0 {
+			// map order is random, sort so the strategies break ties the same way every time
+			slices.SortFunc(candidates, func(a, b Candidate) int {
+				return a.Agent.GetAgentInfo().GetID() - b.Agent.GetAgentInfo().GetID()
+			})
+			best := candidates[al.strategy.Select(candidates)].Agent
+			id := best.GetAgentInfo().GetID()
+			al.running[id]++
+			if al.running[id] >= best.GetSlots() {
+				delete(al.freeAgents, id) // Remove from free agents
+				al.busyAgents[id] = best  // Add to busy agents
+			}
+			return best, nil
+		}
+		al.cond.Wait() // Wait until a free agent is available
+	}
+}
+
+// freeAgent gives back the slot of the agent taken by getOneFreeAgent.
+// The slot of an instance no longer in the list is not given back, a returning agent with the same ID has its own slots.
+func (al *AgentListImpl) freeAgent(agent Agent) {
 	al.mtx.Lock()
 	defer al.mtx.Unlock()
 
-	if agent, exists := al.busyAgents[id]; exists {
+	id := agent.GetAgentInfo().GetID()
+	if al.getAgentByIDNoLock(id) != agent {
+		return
+	}
+	if al.running[id] > 0 {
+		al.running[id]--
+	}
+	if agent, exists := al.busyAgents[id]; exists && al.running[id] < agent.GetSlots() {
 		delete(al.busyAgents, id) // Remove from busy agents
 		al.freeAgents[id] = agent // Add to free agents
-		al.cond.Signal()          // Signal that an agent has been freed
 	}
+	al.cond.Broadcast() // Signal that a slot has been freed, waiters may exclude the agent
 }
 
-func (al *AgentListImpl) isAgentBannedNoLock(addr string) (bool, time.Time) {
-	until, exists := al.bannedAgents[addr]
+func (al *AgentListImpl) isAgentBannedNoLock(key string) (bool, time.Time) {
+	banned, exists := al.bannedAgents[key]
 	if !exists {
 		return false, time.Time{}
 	}
 
-	if time.Now().After(until) {
-		delete(al.bannedAgents, addr) // Remove the ban if the time has passed
+	if time.Now().After(banned.until) {
+		delete(al.bannedAgents, key) // Remove the ban if the time has passed
 		return false, time.Time{}
 	}
 
-	return true, until // Agent is still banned
+	return true, banned.until // Agent is still banned
 }
 
-func (al *AgentListImpl) runTaskOnce(task func(*AgentInfo) error) error {
-	agent := al.getOneFreeAgent()
+// pruneKnownNoLock forgets the agents gone for more than AGENT_HISTORY_RETENTION.
+func (al *AgentListImpl) pruneKnownNoLock() {
+	for identity, known := range al.known {
+		if !known.live && time.Since(known.left) > AGENT_HISTORY_RETENTION {
+			delete(al.known, identity)
+		}
+	}
+}
+
+// runTaskOnce runs the task on a free agent, and returns the ID of the agent with the error of the task.
+// It returns -1 if ctx is done before an agent is free.
+func (al *AgentListImpl) runTaskOnce(ctx context.Context, excluded []int, task func(*AgentInfo) error) (int, error) {
+	agent, err := al.getOneFreeAgent(ctx, excluded)
+	if err != nil {
+		return -1, err
+	}
 	agentInfo := agent.GetAgentInfo()
 	agentID := agentInfo.GetID()
-	defer al.freeAgent(agentID)
-	err := task(agentInfo)
+	// the agent may have left and come back with the same ID while the task ran, the slot and the ban apply to this instance only
+	defer al.freeAgent(agent)
+	err = agent.RunTask(task)
 
 	if err != nil {
-		if agent.GetErrorCount() > 3 {
-			slog.Warn("Agent encountered too many errors, retiring", "agentID", agentID, "errorCount", agent.GetErrorCount())
-			agent.Retire()                                                                        // Retire the agent if it has too many errors
-			al.BanAgent(agentID, "Retired due to too many errors", time.Now().Add(5*time.Minute)) // Ban for 5 minutes
+		if agent.GetErrorCount() > al.policy.MaxAgentErrors {
+			if al.banInstance(agent, "Retired due to too many errors", time.Now().Add(al.policy.AgentBan)) { // Ban for policy.AgentBan
+				slog.Warn("Agent encountered too many errors, retired", "agentID", agentID, "errorCount", agent.GetErrorCount())
+				agent.Retire() // Retire the agent if it has too many errors
+			}
 
 			// TODO: maybe we don't remove the agent. just BAN, and prevent if from accepting new tasks.
 		}
 	}
 
-	return err
+	return agentID, err
 }
@@ -0,0 +1,296 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAgentSlots(t *testing.T) {
+	list := NewAgentList(DefaultRetryPolicy(), leastLoaded{})
+	for i, slots := range []int{2, 1} {
+		agent, err := NewAgent("agent", "0.0.1", "127.0.0.1:5601", "", slots)
+		if err != nil {
+			t.Fatalf("NewAgent: %v", err)
+		}
+		if _, err := list.AddAgent(agent); err != nil {
+			t.Fatalf("AddAgent #%d: %v", i, err)
+		}
+	}
+	if list.Count() != 2 || list.SlotCount() != 3 || list.FreeCount() != 3 {
+		t.Fatalf("%d agents, %d slots, %d free, want 2, 3, 3", list.Count(), list.SlotCount(), list.FreeCount())
+	}
+
+	// the agent with the most free slots is used first
+	if agent, _ := list.getOneFreeAgent(context.Background(), nil); agent.GetSlots() != 2 {
+		t.Fatalf("the agent with 1 slot was used first")
+	}
+	list.getOneFreeAgent(context.Background(), nil)
+	list.getOneFreeAgent(context.Background(), nil)
+	if list.FreeCount() != 0 {
+		t.Fatalf("%d free slots once all are taken", list.FreeCount())
+	}
+	for _, state := range list.AgentStates() {
+		if state.State != AgentStateBusy || state.Running != state.Slots {
+			t.Fatalf("agent %d is %s with %d/%d slots running", state.ID, state.State, state.Running, state.Slots)
+		}
+	}
+
+	list.freeAgent(list.GetAgentByID(0))
+	if list.FreeCount() != 1 {
+		t.Fatalf("%d free slots once one is given back, want 1", list.FreeCount())
+	}
+	if agent, _ := list.getOneFreeAgent(context.Background(), nil); agent.GetAgentInfo().GetID() != 0 {
+		t.Fatalf("agent %d took the slot given back by agent 0", agent.GetAgentInfo().GetID())
+	}
+}
+
+func TestAgentDrainAndSetSlots(t *testing.T) {
+	list := NewAgentList(DefaultRetryPolicy(), leastLoaded{})
+	for i := 0; i < 2; i++ {
+		agent, err := NewAgent("agent", "0.0.1", "127.0.0.1:5601", "", 1)
+		if err != nil {
+			t.Fatalf("NewAgent: %v", err)
+		}
+		if _, err := list.AddAgent(agent); err != nil {
+			t.Fatalf("AddAgent #%d: %v", i, err)
+		}
+	}
+
+	if !list.DrainAgent(0) || list.DrainAgent(2) {
+		t.Fatalf("DrainAgent must only succeed for existing agents")
+	}
+	if list.SlotCount() != 1 || list.FreeCount() != 1 {
+		t.Fatalf("%d slots, %d free with a draining agent, want 1, 1", list.SlotCount(), list.FreeCount())
+	}
+	if agent, _ := list.getOneFreeAgent(context.Background(), nil); agent.GetAgentInfo().GetID() != 1 {
+		t.Fatalf("the draining agent got a task")
+	}
+
+	// agent 1 runs a task, two more slots make it free again
+	if !list.SetSlots(1, 3) || list.FreeCount() != 2 {
+		t.Fatalf("%d free slots once the agent running a task has 3 slots, want 2", list.FreeCount())
+	}
+	list.getOneFreeAgent(context.Background(), nil)
+	if !list.SetSlots(1, 1) || list.FreeCount() != 0 {
+		t.Fatalf("%d free slots once the agent running 2 tasks has 1 slot, want 0", list.FreeCount())
+	}
+	if state, ok := list.AgentState(1); !ok || state.State != AgentStateBusy || state.Running != 2 || state.Slots != 1 {
+		t.Fatalf("agent 1 is %+v, %v, want busy with 2 tasks running on 1 slot", state, ok)
+	}
+	list.freeAgent(list.GetAgentByID(1))
+	if list.FreeCount() != 0 {
+		t.Fatalf("the agent is free while it still runs as many tasks as its slots")
+	}
+	list.freeAgent(list.GetAgentByID(1))
+	if list.FreeCount() != 1 {
+		t.Fatalf("%d free slots once the agent finished its tasks, want 1", list.FreeCount())
+	}
+	for _, state := range list.AgentStates() {
+		if state.ID == 0 && state.State != AgentStateDraining {
+			t.Fatalf("agent 0 is %s, want %s", state.State, AgentStateDraining)
+		}
+	}
+	if state, ok := list.AgentState(0); !ok || state.State != AgentStateDraining {
+		t.Fatalf("AgentState(0) = %+v, %v, want %s", state, ok, AgentStateDraining)
+	}
+	if _, ok := list.AgentState(2); ok {
+		t.Fatalf("AgentState of an agent not in the list succeeded")
+	}
+}
+
+func TestAgentIdentity(t *testing.T) {
+	list := NewAgentList(DefaultRetryPolicy(), leastLoaded{})
+	newAgent := func(addr string, identity string) Agent {
+		agent, err := NewAgent("agent", "0.0.1", addr, identity, 1)
+		if err != nil {
+			t.Fatalf("NewAgent: %v", err)
+		}
+		t.Cleanup(agent.Close)
+		return agent
+	}
+
+	first := newAgent("127.0.0.1:5601", "id-1")
+	id, err := list.AddAgent(first)
+	if err != nil {
+		t.Fatalf("AddAgent: %v", err)
+	}
+	first.RecordDownload(1000, time.Second, 0)
+	first.RunTask(func(*AgentInfo) error { return errors.New("failed") })
+
+	// a second live agent claiming the identity is refused
+	var exists *AlreadyExistsError
+	if _, err := list.AddAgent(newAgent("127.0.0.1:5602", "id-1")); !errors.As(err, &exists) || exists.ID != id {
+		t.Fatalf("AddAgent of a live identity: %v, want AlreadyExistsError for agent %d", err, id)
+	}
+	if other, err := list.AddAgent(newAgent("127.0.0.1:5602", "id-2")); err != nil || other == id {
+		t.Fatalf("AddAgent of another identity: ID %d, %v", other, err)
+	}
+
+	// the agent comes back after a reconnection
+	list.RemoveAgent(first)
+	returning := newAgent("127.0.0.1:5603", "id-1")
+	if got, err := list.AddAgent(returning); err != nil || got != id {
+		t.Fatalf("returning agent got ID %d, %v, want %d", got, err, id)
+	}
+	if returning.GetThroughput() != 1000 || returning.GetErrorCount() != 1 {
+		t.Fatalf("returning agent has throughput %d and %d errors, want 1000 and 1", returning.GetThroughput(), returning.GetErrorCount())
+	}
+	// the stale instance does not remove the returning one
+	list.RemoveAgent(first)
+	if list.GetAgentByID(id) != returning {
+		t.Fatalf("removing the previous instance removed the returning agent")
+	}
+
+	// the ban follows both the identity and the address
+	list.BanAgent(id, "test", time.Now().Add(time.Minute))
+	var banned *AgentIsBannedError
+	if _, err := list.AddAgent(newAgent("127.0.0.1:5604", "id-1")); !errors.As(err, &banned) {
+		t.Fatalf("AddAgent of a banned identity: %v, want AgentIsBannedError", err)
+	}
+	if _, err := list.AddAgent(newAgent("127.0.0.1:5603", "id-3")); !errors.As(err, &banned) {
+		t.Fatalf("AddAgent of another identity at the banned address: %v, want AgentIsBannedError", err)
+	}
+	bans := 0
+	for _, state := range list.AgentStates() {
+		if state.State == AgentStateBanned {
+			bans++
+		}
+	}
+	if bans != 1 {
+		t.Fatalf("%d banned agents listed, want 1", bans)
+	}
+}
+
+func TestAgentIdentityTakeover(t *testing.T) {
+	list := NewAgentList(DefaultRetryPolicy(), leastLoaded{})
+	newAgent := func(addr string, identity string) Agent {
+		agent, err := NewAgent("agent", "0.0.1", addr, identity, 1)
+		if err != nil {
+			t.Fatalf("NewAgent: %v", err)
+		}
+		t.Cleanup(agent.Close)
+		return agent
+	}
+
+	first := newAgent("10.0.0.1:5601", "id-1")
+	id, err := list.AddAgent(first)
+	if err != nil {
+		t.Fatalf("AddAgent: %v", err)
+	}
+	first.RecordDownload(1000, time.Second, 0)
+	list.RemoveAgent(first)
+
+	// another host claiming the identity of the gone agent starts over
+	stranger := newAgent("10.0.0.9:5601", "id-1")
+	if got, err := list.AddAgent(stranger); err != nil || got == id {
+		t.Fatalf("agent from another host got ID %d, %v, want a new ID", got, err)
+	}
+	if stranger.GetThroughput() != 0 {
+		t.Fatalf("agent from another host took over the throughput %d", stranger.GetThroughput())
+	}
+
+	// banning it bans its address, not the identity it claimed
+	list.BanAgent(stranger.GetAgentInfo().GetID(), "test", time.Now().Add(time.Minute))
+	var banned *AgentIsBannedError
+	if _, err := list.AddAgent(newAgent("10.0.0.9:5601", "id-9")); !errors.As(err, &banned) {
+		t.Fatalf("AddAgent at the banned address: %v, want AgentIsBannedError", err)
+	}
+
+	// the agent gets its ID and history back from its own host
+	returning := newAgent("10.0.0.1:5602", "id-1")
+	if got, err := list.AddAgent(returning); err != nil || got != id {
+		t.Fatalf("returning agent got ID %d, %v, want %d", got, err, id)
+	}
+	if returning.GetThroughput() != 1000 {
+		t.Fatalf("returning agent has throughput %d, want 1000", returning.GetThroughput())
+	}
+}
+
+func TestRunTaskStopsWaiting(t *testing.T) {
+	list := NewAgentList(DefaultRetryPolicy(), leastLoaded{})
+	agent, err := NewAgent("agent", "0.0.1", "127.0.0.1:5601", "", 1)
+	if err != nil {
+		t.Fatalf("NewAgent: %v", err)
+	}
+	if _, err := list.AddAgent(agent); err != nil {
+		t.Fatalf("AddAgent: %v", err)
+	}
+
+	// the only agent is excluded, like the slow agent of a speculative copy
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- list.RunTaskExcluding(ctx, []int{0}, func(*AgentInfo) error { return nil })
+	}()
+	select {
+	case err := <-result:
+		t.Fatalf("the task ran with its only agent excluded: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("RunTaskExcluding = %v once stopped, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("RunTaskExcluding still waits for an agent once stopped")
+	}
+	if list.FreeCount() != 1 {
+		t.Fatalf("%d free slots once the waiting task stopped, want 1", list.FreeCount())
+	}
+}
+
+func TestStaleInstanceTask(t *testing.T) {
+	policy := DefaultRetryPolicy()
+	policy.MaxAgentErrors = 0 // the first error bans the agent
+	list := NewAgentList(policy, leastLoaded{})
+	newAgent := func(identity string) Agent {
+		agent, err := NewAgent("agent", "0.0.1", "127.0.0.1:5601", identity, 1)
+		if err != nil {
+			t.Fatalf("NewAgent: %v", err)
+		}
+		t.Cleanup(agent.Close)
+		return agent
+	}
+
+	previous := newAgent("id-1")
+	id, err := list.AddAgent(previous)
+	if err != nil {
+		t.Fatalf("AddAgent: %v", err)
+	}
+	started, finish := make(chan struct{}), make(chan error)
+	result := make(chan error)
+	go func() {
+		_, err := list.runTaskOnce(context.Background(), nil, func(*AgentInfo) error {
+			close(started)
+			return <-finish
+		})
+		result <- err
+	}()
+	<-started
+
+	// the agent reconnects while the task still runs on its previous instance, and takes a task
+	list.RemoveAgent(previous)
+	returning := newAgent("id-1")
+	if got, err := list.AddAgent(returning); err != nil || got != id {
+		t.Fatalf("returning agent got ID %d, %v, want %d", got, err, id)
+	}
+	if agent, err := list.getOneFreeAgent(context.Background(), nil); err != nil || agent != returning {
+		t.Fatalf("getOneFreeAgent = %v, %v, want the returning agent", agent, err)
+	}
+
+	// the task of the previous instance fails, it neither frees the slot nor bans the returning agent
+	finish <- errors.New("connection reset")
+	<-result
+	if list.GetAgentByID(id) != returning {
+		t.Fatalf("the failed task of the previous instance removed the returning agent")
+	}
+	for _, state := range list.AgentStates() {
+		if state.ID == id && (state.State != AgentStateBusy || state.Running != 1) {
+			t.Fatalf("returning agent is %s with %d tasks running, want %s with 1", state.State, state.Running, AgentStateBusy)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package agents
+
+import "time"
+
+// States of an agent in an AgentState.
+const (
+	AgentStateFree     = "FREE"
+	AgentStateBusy     = "BUSY"
+	AgentStateDraining = "DRAINING"
+	AgentStateBanned   = "BANNED"
+)
+
+// AgentState is a snapshot of an agent, for status reports.
+type AgentState struct {
+	ID          int
+	Name        string
+	Addr        string
+	Identity    string // persistent identity of the agent, empty if it has none
+	Version     string
+	State       string    // AgentStateFree, AgentStateBusy, AgentStateDraining or AgentStateBanned
+	ErrorCount  int       // errors counted against the agent
+	Throughput  int       // measured throughput in bytes per second, 0 if unknown
+	BannedUntil time.Time // zero unless the agent is banned
+	Slots       int       // tasks the agent runs at the same time
+	Running     int       // tasks running on the agent
+	Health      Health    // health record of the agent, zero if it is banned
+}
+
+// bannedAgent is the agent behind a banned identity or address, kept to report it until the ban expires.
+type bannedAgent struct {
+	info  AgentInfo
+	until time.Time
+}
+
+// AGENT_HISTORY_RETENTION is how long the agent list remembers an agent with an identity once it is gone.
+const AGENT_HISTORY_RETENTION = 24 * time.Hour
+
+// knownAgent is the last instance of an agent with an identity,
+// an agent returning from the same host takes over its ID and history.
+type knownAgent struct {
+	id     int
+	agent  Agent
+	live   bool      // the instance is in the list, another agent claiming the identity is refused
+	left   time.Time // when the instance left the list
+	banned bool      // the instance was banned, its errors are not taken over
+}
+
+func newAgentState(agent Agent, state string, running int) AgentState {
+	info := agent.GetAgentInfo()
+	return AgentState{
+		ID:         info.GetID(),
+		Name:       info.GetName(),
+		Addr:       info.GetAddr(),
+		Identity:   info.GetIdentity(),
+		Version:    info.GetVersion(),
+		State:      state,
+		ErrorCount: agent.GetErrorCount(),
+		Throughput: agent.GetThroughput(),
+		Slots:      agent.GetSlots(),
+		Running:    running,
+		Health:     agent.GetHealth(),
+	}
+}
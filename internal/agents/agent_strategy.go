@@ -0,0 +1,156 @@
+package agents
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+)
+
+// Names of the selection strategies, see NewSelectionStrategy.
+const (
+	StrategyLeastLoaded    = "least-loaded"
+	StrategyFastestFirst   = "fastest-first"
+	StrategyWeightedRandom = "weighted-random"
+)
+
+// minHealthScore keeps a little work for the agents with a bad health score under the weighted random strategy,
+// so they get a chance to show they recovered.
+const minHealthScore = 0.05
+
+// Candidate is an agent with a free slot that a task can run on.
+type Candidate struct {
+	Agent   Agent
+	Running int    // tasks running on the agent
+	Health  Health // snapshot of the health record of the agent
+}
+
+func (c Candidate) freeSlots() int {
+	return c.Agent.GetSlots() - c.Running
+}
+
+// load is the fraction of the slots of the agent running a task.
+func (c Candidate) load() float64 {
+	return float64(c.Running) / float64(c.Agent.GetSlots())
+}
+
+// SelectionStrategy picks the agent the next task runs on.
+type SelectionStrategy interface {
+	Name() string
+	// Select returns the index of the chosen candidate, candidates is never empty.
+	Select(candidates []Candidate) int
+}
+
+// SelectionStrategyNames returns the names of the strategies NewSelectionStrategy accepts.
+func SelectionStrategyNames() []string {
+	return []string{StrategyLeastLoaded, StrategyFastestFirst, StrategyWeightedRandom}
+}
+
+// NewSelectionStrategy returns the strategy with the given name:
+//   - least-loaded: the agent with the smallest share of its slots running a task, the healthiest first on a tie
+//   - fastest-first: the agent with the highest throughput weighted by its health score
+//   - weighted-random: a random agent, with a probability proportional to its throughput and health score
+func NewSelectionStrategy(name string) (SelectionStrategy, error) {
+	switch name {
+	case StrategyLeastLoaded:
+		return leastLoaded{}, nil
+	case StrategyFastestFirst:
+		return fastestFirst{}, nil
+	case StrategyWeightedRandom:
+		return weightedRandom{}, nil
+	}
+	return nil, fmt.Errorf("unknown agent selection strategy %q, expected one of %s", name, strings.Join(SelectionStrategyNames(), ", "))
+}
+
+type leastLoaded struct{}
+
+func (leastLoaded) Name() string { return StrategyLeastLoaded }
+
+func (leastLoaded) Select(candidates []Candidate) int {
+	best := 0
+	for i, c := range candidates[1:] {
+		b := candidates[best]
+		switch {
+		case c.load() != b.load():
+			if c.load() < b.load() {
+				best = i + 1
+			}
+		case c.freeSlots() != b.freeSlots():
+			if c.freeSlots() > b.freeSlots() {
+				best = i + 1
+			}
+		case c.Health.Score() > b.Health.Score():
+			best = i + 1
+		}
+	}
+	return best
+}
+
+type fastestFirst struct{}
+
+func (fastestFirst) Name() string { return StrategyFastestFirst }
+
+func (fastestFirst) Select(candidates []Candidate) int {
+	speeds := expectedSpeeds(candidates)
+	best := 0
+	for i := range candidates {
+		if speeds[i] > speeds[best] || (speeds[i] == speeds[best] && candidates[i].load() < candidates[best].load()) {
+			best = i
+		}
+	}
+	return best
+}
+
+type weightedRandom struct{}
+
+func (weightedRandom) Name() string { return StrategyWeightedRandom }
+
+func (weightedRandom) Select(candidates []Candidate) int {
+	weights := make([]float64, len(candidates))
+	total := 0.0
+	for i, c := range candidates {
+		weights[i] = float64(max(speedOf(c, medianThroughput(candidates)), 1)) * max(c.Health.Score(), minHealthScore)
+		total += weights[i]
+	}
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		if pick < weight {
+			return i
+		}
+		pick -= weight
+	}
+	return len(candidates) - 1
+}
+
+// expectedSpeeds returns the throughput of every candidate weighted by its health score.
+func expectedSpeeds(candidates []Candidate) []float64 {
+	median := medianThroughput(candidates)
+	speeds := make([]float64, len(candidates))
+	for i, c := range candidates {
+		speeds[i] = float64(speedOf(c, median)) * c.Health.Score()
+	}
+	return speeds
+}
+
+// speedOf returns the throughput of the candidate, the median throughput if it was not measured yet.
+func speedOf(c Candidate, median int) int {
+	if c.Health.Throughput > 0 {
+		return c.Health.Throughput
+	}
+	return median
+}
+
+// medianThroughput returns the median of the measured throughputs of the candidates, 0 if none was measured.
+func medianThroughput(candidates []Candidate) int {
+	measured := make([]int, 0, len(candidates))
+	for _, c := range candidates {
+		if c.Health.Throughput > 0 {
+			measured = append(measured, c.Health.Throughput)
+		}
+	}
+	if len(measured) == 0 {
+		return 0
+	}
+	slices.Sort(measured)
+	return measured[len(measured)/2]
+}
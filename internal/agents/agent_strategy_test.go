@@ -0,0 +1,54 @@
+package agents
+
+import (
+	"testing"
+)
+
+func TestSelectionStrategies(t *testing.T) {
+	newCandidate := func(slots int, running int, health Health) Candidate {
+		agent, err := NewAgent("agent", "0.0.1", "127.0.0.1:5601", "", slots)
+		if err != nil {
+			t.Fatalf("NewAgent: %v", err)
+		}
+		t.Cleanup(agent.Close)
+		return Candidate{Agent: agent, Running: running, Health: health}
+	}
+	candidates := []Candidate{
+		newCandidate(4, 2, Health{Throughput: 1000}),                                    // half loaded, slow
+		newCandidate(2, 0, Health{Throughput: 8000, ErrorRate: 0.5, RecentFailures: 3}), // idle, fast but failing
+		newCandidate(4, 1, Health{Throughput: 4000}),                                    // quarter loaded, fast
+		newCandidate(1, 0, Health{}),                                                    // idle, not measured yet
+	}
+
+	for _, test := range []struct {
+		strategy string
+		want     int
+	}{
+		{StrategyLeastLoaded, 1},  // idle, with the most free slots
+		{StrategyFastestFirst, 3}, // the failing agent scores 8000*0.5/4, the unmeasured one the median 4000, as fast and less loaded than candidate 2
+	} {
+		strategy, err := NewSelectionStrategy(test.strategy)
+		if err != nil {
+			t.Fatalf("NewSelectionStrategy(%q): %v", test.strategy, err)
+		}
+		if got := strategy.Select(candidates); got != test.want {
+			t.Errorf("%s picked candidate %d, want %d", test.strategy, got, test.want)
+		}
+	}
+
+	strategy, err := NewSelectionStrategy(StrategyWeightedRandom)
+	if err != nil {
+		t.Fatalf("NewSelectionStrategy(%q): %v", StrategyWeightedRandom, err)
+	}
+	picks := make([]int, len(candidates))
+	for i := 0; i < 10000; i++ {
+		picks[strategy.Select(candidates)]++
+	}
+	if picks[2] <= picks[0] || picks[2] <= picks[1] {
+		t.Errorf("%s picked the fast agent less often than the slow or failing ones: %v", StrategyWeightedRandom, picks)
+	}
+
+	if _, err := NewSelectionStrategy("round-robin"); err == nil {
+		t.Errorf("NewSelectionStrategy accepted an unknown strategy")
+	}
+}
@@ -5,13 +5,18 @@ import (
 	"time"
 )
 
-// AlreadyExistsError is returned when an agent with the same ID already exists in the agent list.
+// AlreadyExistsError is returned when an agent with the same ID already exists in the agent list,
+// such as a second live agent claiming the identity of an agent.
 type AlreadyExistsError struct {
-	ID int // ID of the agent that already exists
+	ID       int    // ID of the agent that already exists
+	Identity string // identity claimed by both agents, empty if the agents have none
 }
 
 // Error implements the error interface for AlreadyExistsError.
 func (e *AlreadyExistsError) Error() string {
+	if e.Identity != "" {
+		return fmt.Sprintf("agent with ID %d and identity %s already exists", e.ID, e.Identity)
+	}
 	return fmt.Sprintf("agent with ID %d already exists", e.ID)
 }
 
@@ -0,0 +1,71 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrPermanent marks the errors that no retry can fix, such as a file the origin does not have.
+// A download that fails with it gives up at once, on every agent.
+var ErrPermanent = errors.New("permanent error")
+
+// IsPermanent returns true if the error can not be fixed by a retry.
+func IsPermanent(err error) bool {
+	return errors.Is(err, ErrPermanent)
+}
+
+// RetryPolicy decides how the failed chunks of a task are retried, and when the agent list bans an agent.
+// Transient errors are retried with an exponential backoff, every attempt on one agent, permanent errors are not retried.
+type RetryPolicy struct {
+	Attempts       int           // attempts of a chunk before its task fails, including the first one
+	MaxAgentErrors int           // an agent with more errors than this is banned
+	AgentBan       time.Duration // how long an agent with too many errors is banned
+	BaseDelay      time.Duration // delay before the first retry, it doubles with every retry
+	MaxDelay       time.Duration // the delay never exceeds this
+	Jitter         float64       // fraction of the delay that is random, from 0 to 1, so retries of many chunks spread out
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:       4,
+		MaxAgentErrors: 3,
+		AgentBan:       5 * time.Minute,
+		BaseDelay:      time.Second,
+		MaxDelay:       30 * time.Second,
+		Jitter:         0.2,
+	}
+}
+
+// Backoff returns the delay before the given retry, starting at 1.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	if retry < 1 || p.BaseDelay <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 {
+		delay = min(delay, p.MaxDelay)
+	}
+	jitter := min(max(p.Jitter, 0), 1)
+	return time.Duration(float64(delay) * (1 - jitter*rand.Float64()))
+}
+
+// Wait sleeps for the backoff of the given retry. It returns the error of ctx if ctx is done first.
+func (p RetryPolicy) Wait(ctx context.Context, retry int) error {
+	delay := p.Backoff(retry)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,32 @@
+package agents
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.5}
+	tests := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, test := range tests {
+		for range 20 {
+			delay := policy.Backoff(test.retry)
+			if delay > test.max || delay < test.max/2 {
+				t.Fatalf("Backoff(%d) = %v, want between %v and %v", test.retry, delay, test.max/2, test.max)
+			}
+		}
+	}
+	if delay := policy.Backoff(0); delay != 0 {
+		t.Errorf("Backoff(0) = %v, want 0", delay)
+	}
+}
@@ -18,6 +18,10 @@ func LoadDatabase(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	// sqlite allows only one writer at a time. tasks are updated from many goroutines,
+	// so serialize the access instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
 	// Verify the connection is valid
 	if err := db.Ping(); err != nil {
 		log.Printf("Failed to ping database: %v", err)
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// CreateHostLimitTable creates the host_limits table if it does not exist.
+// It holds the connection limits the server learned for the origin hosts.
+//
+// Input:
+//
+//	db - a pointer to an open sql.DB connection.
+//
+// Returns:
+//
+//	error - non-nil if the table creation fails, otherwise nil.
+func CreateHostLimitTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS host_limits (
+		host TEXT PRIMARY KEY,
+		max_connections INTEGER NOT NULL,
+		updated DATETIME NOT NULL
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		log.Printf("Failed to create host limit table: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// SaveHostLimit inserts or replaces the connection limit of a host.
+//
+// Input:
+//
+//	db             - a pointer to an open sql.DB connection.
+//	host           - the host, with its port if the URL has one.
+//	maxConnections - the number of concurrent connections the host accepts.
+//
+// Returns:
+//
+//	error - non-nil if the insert fails, otherwise nil.
+func SaveHostLimit(db *sql.DB, host string, maxConnections int) error {
+	_, err := db.Exec(`
+	INSERT INTO host_limits (host, max_connections, updated)
+	VALUES (?, ?, ?)
+	ON CONFLICT(host) DO UPDATE SET max_connections = excluded.max_connections, updated = excluded.updated;`,
+		host, maxConnections, time.Now())
+	if err != nil {
+		log.Printf("Failed to save host limit: %v", err)
+		return err
+	}
+	return nil
+}
+
+// DeleteHostLimit deletes the connection limit of a host, if there is one.
+//
+// Input:
+//
+//	db   - a pointer to an open sql.DB connection.
+//	host - the host.
+//
+// Returns:
+//
+//	error - non-nil if the delete fails, otherwise nil.
+func DeleteHostLimit(db *sql.DB, host string) error {
+	_, err := db.Exec(`DELETE FROM host_limits WHERE host = ?;`, host)
+	if err != nil {
+		log.Printf("Failed to delete host limit: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetHostLimits retrieves the connection limits of all hosts.
+//
+// Input:
+//
+//	db - a pointer to an open sql.DB connection.
+//
+// Returns:
+//
+//	map[string]int - the limits, keyed by host.
+//	error          - non-nil if the query or scan fails, otherwise nil.
+func GetHostLimits(db *sql.DB) (map[string]int, error) {
+	rows, err := db.Query(`SELECT host, max_connections FROM host_limits;`)
+	if err != nil {
+		log.Printf("Failed to retrieve host limits: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := make(map[string]int)
+	for rows.Next() {
+		var host string
+		var maxConnections int
+		if err := rows.Scan(&host, &maxConnections); err != nil {
+			log.Printf("Failed to scan row: %v", err)
+			return nil, err
+		}
+		limits[host] = maxConnections
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating rows: %v", err)
+		return nil, err
+	}
+
+	return limits, nil
+}
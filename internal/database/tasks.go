@@ -0,0 +1,364 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// Task represents a download task queued or running on the server.
+type Task struct {
+	Id        int64     `db:"id"`
+	URL       string    `db:"url"`
+	Checksum  string    `db:"checksum"`
+	Requester string    `db:"requester"`
+	State     string    `db:"state"`
+	Priority  string    `db:"priority"`
+	TotalSize int64     `db:"total_size"`
+	Created   time.Time `db:"created"`
+	Updated   time.Time `db:"updated"`
+}
+
+// CreateTaskTables creates the tasks and task_mirrors tables if they do not exist.
+// The progress of a task is not kept in the database, the chunks it completed are the files of its staging directory.
+//
+// Input:
+//
+//	db - a pointer to an open sql.DB connection.
+//
+// Returns:
+//
+//	error - non-nil if the table creation fails, otherwise nil.
+func CreateTaskTables(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS tasks (
+		id INTEGER PRIMARY KEY,
+		url TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		requester TEXT NOT NULL,
+		state TEXT NOT NULL,
+		priority TEXT NOT NULL DEFAULT '',
+		total_size INTEGER NOT NULL,
+		created DATETIME NOT NULL,
+		updated DATETIME NOT NULL
+	);
+	DROP TABLE IF EXISTS subtasks;
+	CREATE TABLE IF NOT EXISTS task_mirrors (
+		task_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		PRIMARY KEY (task_id, position)
+	);`
+
+	_, err := db.Exec(query)
+	if err != nil {
+		log.Printf("Failed to create task tables: %v", err)
+		return err
+	}
+
+	// tasks tables created before the priority was saved have no priority column
+	err = addColumnIfMissing(db, "tasks", "priority", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		log.Printf("Failed to add the priority of tasks: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// addColumnIfMissing adds a column to a table created by an older version of the server.
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?;`, table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition + `;`)
+	return err
+}
+
+// InsertTask inserts a new Task into the database, using the ID assigned by the server.
+//
+// Input:
+//
+//	db   - a pointer to an open sql.DB connection.
+//	task - pointer to a Task struct to insert (Created and Updated will be set).
+//
+// Returns:
+//
+//	error - non-nil if the insert fails, otherwise nil.
+func InsertTask(db *sql.DB, task *Task) error {
+	query := `
+	INSERT INTO tasks (id, url, checksum, requester, state, priority, total_size, created, updated)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?);`
+
+	now := time.Now()
+	_, err := db.Exec(query, task.Id, task.URL, task.Checksum, task.Requester, task.State, task.Priority, task.TotalSize, now, now)
+	if err != nil {
+		log.Printf("Failed to insert task: %v", err)
+		return err
+	}
+
+	task.Created = now
+	task.Updated = now
+	return nil
+}
+
+// UpdateTask updates the state and total size of an existing Task.
+//
+// Input:
+//
+//	db   - a pointer to an open sql.DB connection.
+//	task - pointer to a Task struct with updated fields (must include valid Id).
+//
+// Returns:
+//
+//	error - non-nil if the update fails, otherwise nil.
+func UpdateTask(db *sql.DB, task *Task) error {
+	query := `
+	UPDATE tasks
+	SET state = ?, total_size = ?, updated = ?
+	WHERE id = ?;`
+
+	now := time.Now()
+	_, err := db.Exec(query, task.State, task.TotalSize, now, task.Id)
+	if err != nil {
+		log.Printf("Failed to update task: %v", err)
+		return err
+	}
+
+	task.Updated = now
+	return nil
+}
+
+// UpdateTaskPriority updates the priority of an existing Task.
+//
+// Input:
+//
+//	db       - a pointer to an open sql.DB connection.
+//	id       - the ID of the Task to update.
+//	priority - the new priority of the Task.
+//
+// Returns:
+//
+//	error - non-nil if the update fails, otherwise nil.
+func UpdateTaskPriority(db *sql.DB, id int64, priority string) error {
+	query := `
+	UPDATE tasks
+	SET priority = ?, updated = ?
+	WHERE id = ?;`
+
+	_, err := db.Exec(query, priority, time.Now(), id)
+	if err != nil {
+		log.Printf("Failed to update task priority: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetTask retrieves a Task by its ID.
+//
+// Input:
+//
+//	db - a pointer to an open sql.DB connection.
+//	id - the ID of the Task to retrieve.
+//
+// Returns:
+//
+//	*Task - pointer to the found Task, or nil if not found.
+//	error - non-nil if the query or scan fails, otherwise nil.
+func GetTask(db *sql.DB, id int64) (*Task, error) {
+	query := `
+	SELECT id, url, checksum, requester, state, priority, total_size, created, updated
+	FROM tasks
+	WHERE id = ?;`
+
+	row := db.QueryRow(query, id)
+
+	var task Task
+	err := row.Scan(&task.Id, &task.URL, &task.Checksum, &task.Requester, &task.State, &task.Priority, &task.TotalSize, &task.Created, &task.Updated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Printf("Failed to retrieve task: %v", err)
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+// GetTasksByState retrieves all Tasks in any of the given states, ordered by ID.
+//
+// Input:
+//
+//	db     - a pointer to an open sql.DB connection.
+//	states - the states to search for.
+//
+// Returns:
+//
+//	[]*Task - a slice of the Task records found.
+//	error   - non-nil if the query or scan fails, otherwise nil.
+func GetTasksByState(db *sql.DB, states ...string) ([]*Task, error) {
+	if len(states) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(states)), ", ")
+	query := `
+	SELECT id, url, checksum, requester, state, priority, total_size, created, updated
+	FROM tasks
+	WHERE state IN (` + placeholders + `)
+	ORDER BY id;`
+
+	args := make([]any, 0, len(states))
+	for _, state := range states {
+		args = append(args, state)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Failed to retrieve tasks: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+	for rows.Next() {
+		var task Task
+		err := rows.Scan(&task.Id, &task.URL, &task.Checksum, &task.Requester, &task.State, &task.Priority, &task.TotalSize, &task.Created, &task.Updated)
+		if err != nil {
+			log.Printf("Failed to scan row: %v", err)
+			return nil, err
+		}
+		tasks = append(tasks, &task)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating rows: %v", err)
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// GetMaxTaskID returns the largest task ID ever stored, or 0 if there is none.
+//
+// Input:
+//
+//	db - a pointer to an open sql.DB connection.
+//
+// Returns:
+//
+//	int64 - the largest task ID.
+//	error - non-nil if the query fails, otherwise nil.
+func GetMaxTaskID(db *sql.DB) (int64, error) {
+	query := `SELECT COALESCE(MAX(id), 0) FROM tasks;`
+
+	var id int64
+	err := db.QueryRow(query).Scan(&id)
+	if err != nil {
+		log.Printf("Failed to retrieve max task ID: %v", err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// DeleteTasksUpdatedBefore removes Tasks in any of the given states that have not been updated since the given time,
+// together with their mirrors.
+//
+// Input:
+//
+//	db     - a pointer to an open sql.DB connection.
+//	before - tasks updated before this time are deleted.
+//	states - the states of the tasks to delete.
+//
+// Returns:
+//
+//	error - non-nil if the deletion fails, otherwise nil.
+func DeleteTasksUpdatedBefore(db *sql.DB, before time.Time, states ...string) error {
+	for _, state := range states {
+		_, err := db.Exec(`
+		DELETE FROM task_mirrors
+		WHERE task_id IN (SELECT id FROM tasks WHERE state = ? AND updated < ?);`, state, before)
+		if err != nil {
+			log.Printf("Failed to delete task mirrors: %v", err)
+			return err
+		}
+
+		_, err = db.Exec(`
+		DELETE FROM tasks
+		WHERE state = ? AND updated < ?;`, state, before)
+		if err != nil {
+			log.Printf("Failed to delete tasks: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertTaskMirrors saves the mirror URLs of a Task, in the order they were requested.
+//
+// Input:
+//
+//	db      - a pointer to an open sql.DB connection.
+//	taskId  - the ID of the Task.
+//	mirrors - the URLs of the mirrors.
+//
+// Returns:
+//
+//	error - non-nil if the insert fails, otherwise nil.
+func InsertTaskMirrors(db *sql.DB, taskId int64, mirrors []string) error {
+	for i, mirror := range mirrors {
+		_, err := db.Exec(`
+		INSERT INTO task_mirrors (task_id, position, url)
+		VALUES (?, ?, ?);`, taskId, i, mirror)
+		if err != nil {
+			log.Printf("Failed to insert task mirror: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// GetTaskMirrors retrieves the mirror URLs of a Task, in the order they were requested.
+//
+// Input:
+//
+//	db     - a pointer to an open sql.DB connection.
+//	taskId - the ID of the Task.
+//
+// Returns:
+//
+//	[]string - the URLs of the mirrors, empty if the Task has none.
+//	error    - non-nil if the query or scan fails, otherwise nil.
+func GetTaskMirrors(db *sql.DB, taskId int64) ([]string, error) {
+	rows, err := db.Query(`
+	SELECT url
+	FROM task_mirrors
+	WHERE task_id = ?
+	ORDER BY position;`, taskId)
+	if err != nil {
+		log.Printf("Failed to retrieve task mirrors: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mirrors []string
+	for rows.Next() {
+		var mirror string
+		if err := rows.Scan(&mirror); err != nil {
+			log.Printf("Failed to scan row: %v", err)
+			return nil, err
+		}
+		mirrors = append(mirrors, mirror)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating rows: %v", err)
+		return nil, err
+	}
+
+	return mirrors, nil
+}
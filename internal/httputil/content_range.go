@@ -0,0 +1,42 @@
+package httputil
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseContentRange parses a Content-Range header of a 206 response, such as "bytes 0-499/1234".
+// It returns the first and last byte of the range, and the size of the file, -1 if the origin sends "*".
+func ParseContentRange(header string) (int64, int64, int64, error) {
+	unit, rest, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || unit != "bytes" {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	byteRange, size, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	first, last, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		// "bytes */1234" is only valid in a 416 response
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q: bad first byte", header)
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q: bad last byte", header)
+	}
+	totalSize := int64(-1)
+	if size != "*" {
+		totalSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || totalSize <= end {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q: bad size", header)
+		}
+	}
+	return start, end, totalSize, nil
+}
@@ -0,0 +1,45 @@
+package httputil_test
+
+import (
+	"testing"
+
+	"internal/httputil"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header    string
+		start     int64
+		end       int64
+		totalSize int64
+		wantErr   bool
+	}{
+		{header: "bytes 0-0/1234", start: 0, end: 0, totalSize: 1234},
+		{header: "bytes 100-199/200", start: 100, end: 199, totalSize: 200},
+		{header: " bytes 5-9/* ", start: 5, end: 9, totalSize: -1},
+		{header: "bytes */1234", wantErr: true},
+		{header: "items 0-1/2", wantErr: true},
+		{header: "bytes 10-5/20", wantErr: true},
+		{header: "bytes 0-19/20x", wantErr: true},
+		{header: "bytes 0-20/20", wantErr: true},
+		{header: "bytes -1-5/20", wantErr: true},
+		{header: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		start, end, totalSize, err := httputil.ParseContentRange(test.header)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseContentRange(%q) = %d, %d, %d, want an error", test.header, start, end, totalSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseContentRange(%q) returned error: %v", test.header, err)
+			continue
+		}
+		if start != test.start || end != test.end || totalSize != test.totalSize {
+			t.Errorf("ParseContentRange(%q) = %d, %d, %d, want %d, %d, %d", test.header, start, end, totalSize, test.start, test.end, test.totalSize)
+		}
+	}
+}
@@ -7,3 +7,7 @@ replace internal/common => ../common
 require github.com/bgentry/go-netrc v0.0.0-20140422174119-9fd32a8b3d3d
 
 require internal/common v0.0.0
+
+replace internal/httputil => .
+
+require internal/httputil v0.0.0
@@ -0,0 +1,34 @@
+package httputil
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsThrottlingStatus returns true if the origin asks the client to slow down:
+// 429 Too Many Requests, or 503 Service Unavailable which rate limiters send too.
+func IsThrottlingStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// ParseRetryAfter returns the delay asked by a Retry-After header, either delay-seconds or an HTTP date.
+// It returns 0 if the header is missing, invalid, or in the past.
+func ParseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if seconds <= 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	date, err := http.ParseTime(header)
+	if err != nil || !date.After(now) {
+		return 0
+	}
+	return date.Sub(now)
+}
@@ -0,0 +1,31 @@
+package httputil_test
+
+import (
+	"testing"
+	"time"
+
+	"internal/httputil"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{header: "120", want: 2 * time.Minute},
+		{header: " 5 ", want: 5 * time.Second},
+		{header: "0", want: 0},
+		{header: "-3", want: 0},
+		{header: "Fri, 01 Mar 2024 12:00:30 GMT", want: 30 * time.Second},
+		{header: "Fri, 01 Mar 2024 11:59:00 GMT", want: 0},
+		{header: "soon", want: 0},
+		{header: "", want: 0},
+	}
+
+	for _, test := range tests {
+		if got := httputil.ParseRetryAfter(test.header, now); got != test.want {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
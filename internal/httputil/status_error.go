@@ -0,0 +1,29 @@
+package httputil
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StatusError is returned when the origin answers with an unexpected HTTP status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // delay asked by the Retry-After header of a throttling status, 0 if none
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status: %s", e.Status)
+}
+
+// IsPermanentStatus returns true if the same request can not succeed later:
+// the client errors, except for the ones that ask to try again (408 Request Timeout, 425 Too Early, 429 Too Many Requests).
+// Server errors such as 503 Service Unavailable are transient.
+func IsPermanentStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return statusCode >= 400 && statusCode < 500
+}
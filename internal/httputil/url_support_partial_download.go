@@ -1,27 +1,78 @@
 package httputil
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"time"
 )
 
+// RemoteFileInfo describes a file on the origin server.
+type RemoteFileInfo struct {
+	URL             string // URL of the file after following redirects
+	SupportsPartial bool   // the origin accepts Range requests
+	TotalSize       int64  // size of the file in bytes, -1 if the origin does not send a Content-Length
+	ETag            string // ETag of the file, empty if the origin does not send one
+	LastModified    string // Last-Modified of the file, empty if the origin does not send one
+}
+
 func CheckPartialDownloadSupport(url string) (bool, int64, error) {
+	info, err := Probe(url)
+	if err != nil {
+		return false, 0, err
+	}
+	return info.SupportsPartial, info.TotalSize, nil
+}
+
+// Probe finds out whether the origin supports partial downloads, and what it knows about the file.
+// It sends a HEAD request first. Many origins reject HEAD, or honour ranges without sending Accept-Ranges,
+// so it falls back to a GET of the first byte of the file.
+// Redirects are followed, the final URL is returned in the info.
+func Probe(url string) (*RemoteFileInfo, error) {
+	return ProbeContext(context.Background(), url)
+}
+
+// ProbeContext is Probe, the requests are aborted when ctx is done.
+func ProbeContext(ctx context.Context, url string) (*RemoteFileInfo, error) {
 	if url == "" {
-		return false, 0, fmt.Errorf("invalid URL")
+		return nil, fmt.Errorf("invalid URL")
+	}
+
+	info, headErr := probeRequest(ctx, url, "HEAD")
+	if headErr == nil && info.SupportsPartial {
+		return info, nil
+	}
+	if headErr != nil {
+		log.Printf("HEAD request failed, trying a range request: %v", headErr)
+	}
+
+	rangeInfo, rangeErr := probeRequest(ctx, url, "GET")
+	if rangeErr != nil {
+		if headErr == nil {
+			// the origin answers HEAD, it just does not support ranges
+			return info, nil
+		}
+		return nil, fmt.Errorf("HEAD request: %v, range request: %w", headErr, rangeErr)
 	}
+	return rangeInfo, nil
+}
 
+// probeRequest sends a HEAD request, or a GET request of the first byte of the file, and returns what it learns about the file.
+func probeRequest(ctx context.Context, url string, method string) (*RemoteFileInfo, error) {
 	login, password, err := GetDataFromNetrc(url)
 	if err != nil {
 		log.Printf("Error getting credentials from .netrc: %v", err)
-		return false, 0, err
+		return nil, err
 	}
 
-	req, err := http.NewRequest("HEAD", url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
-		log.Printf("Error creating HEAD request: %v", err)
-		return false, 0, err
+		log.Printf("Error creating %s request: %v", method, err)
+		return nil, err
+	}
+	if method == "GET" {
+		req.Header.Set("Range", "bytes=0-0")
 	}
 	if login != "" && password != "" {
 		log.Printf("Using credentials from .netrc for URL: %s", url)
@@ -29,23 +80,49 @@ func CheckPartialDownloadSupport(url string) (bool, int64, error) {
 	}
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("Error making HEAD request: %v", err)
-		return false, 0, err
+		log.Printf("Error making %s request: %v", method, err)
+		return nil, err
 	}
+	// the body is not read, an origin that ignores the range closes the connection instead of sending the whole file
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
-		log.Printf("Unexpected HTTP status: %s", resp.Status)
-		return false, 0, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	info := &RemoteFileInfo{
+		URL:          resp.Request.URL.String(),
+		TotalSize:    -1,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
 	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		_, _, totalSize, err := ParseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			log.Printf("Error parsing Content-Range: %v", err)
+			return nil, err
+		}
+		info.SupportsPartial = true
+		info.TotalSize = totalSize
 
-	supportsPartial := resp.Header.Get("Accept-Ranges") == "bytes"
-	totalSize, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
-	if err != nil {
-		log.Printf("Error parsing Content-Length: %v", err)
-		return false, 0, err
+	case http.StatusOK:
+		// a GET answered with 200 ignored the range
+		info.SupportsPartial = method == "HEAD" && resp.Header.Get("Accept-Ranges") == "bytes"
+		info.TotalSize = resp.ContentLength
+
+	default:
+		log.Printf("Unexpected HTTP status: %s", resp.Status)
+		statusErr := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		if IsThrottlingStatus(resp.StatusCode) {
+			statusErr.RetryAfter = ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return nil, statusErr
+	}
+	if info.TotalSize < 0 {
+		// a partial download needs the size of the file to plan the ranges
+		info.SupportsPartial = false
+	}
+	if info.URL != url {
+		log.Printf("URL redirected to: %s", info.URL)
 	}
 
-	log.Printf("Supports partial download: %v, Total size: %d bytes", supportsPartial, totalSize)
-	return supportsPartial, totalSize, nil
+	log.Printf("%s: supports partial download: %v, Total size: %d bytes, ETag: %q", method, info.SupportsPartial, info.TotalSize, info.ETag)
+	return info, nil
 }
@@ -0,0 +1,74 @@
+package pb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// AgentErrorDomain is the domain of the ErrorInfo attached to the errors of agents.
+const AgentErrorDomain = "ddson.agent"
+
+// NewAgentError returns a gRPC status error that tells the server the reason of the failure.
+func NewAgentError(reason AgentErrorReason, format string, args ...any) error {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(format, args...))
+	withDetails, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: reason.String(),
+		Domain: AgentErrorDomain,
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+// NewThrottledError returns a THROTTLED agent error that carries the delay the origin asked to wait,
+// retryAfter is 0 if the origin did not send a Retry-After.
+func NewThrottledError(retryAfter time.Duration, format string, args ...any) error {
+	st := status.New(codes.FailedPrecondition, fmt.Sprintf(format, args...))
+	withDetails, err := st.WithDetails(
+		&errdetails.ErrorInfo{
+			Reason: AgentErrorReason_THROTTLED.String(),
+			Domain: AgentErrorDomain,
+		},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)},
+	)
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+// RetryDelayOf returns the retry delay attached to an error returned by an agent, 0 if there is none.
+func RetryDelayOf(err error) time.Duration {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return 0
+	}
+	for _, detail := range grpcErr.GRPCStatus().Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return max(info.GetRetryDelay().AsDuration(), 0)
+		}
+	}
+	return 0
+}
+
+// AgentErrorReasonOf returns the reason attached to an error returned by an agent,
+// AGENT_ERROR_UNSPECIFIED if there is none.
+func AgentErrorReasonOf(err error) AgentErrorReason {
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if !errors.As(err, &grpcErr) {
+		return AgentErrorReason_AGENT_ERROR_UNSPECIFIED
+	}
+	for _, detail := range grpcErr.GRPCStatus().Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.GetDomain() == AgentErrorDomain {
+			return AgentErrorReason(AgentErrorReason_value[info.GetReason()])
+		}
+	}
+	return AgentErrorReason_AGENT_ERROR_UNSPECIFIED
+}
@@ -37,6 +37,14 @@ func NewAndInitializePersistency(baseDir string) (*Persistency, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = database.CreateTaskTables(d)
+	if err != nil {
+		return nil, err
+	}
+	err = database.CreateHostLimitTable(d)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Persistency{
 		baseDir: baseDir,
@@ -0,0 +1,20 @@
+package persistency
+
+import (
+	"internal/database"
+)
+
+// SaveHostLimit saves the connection limit learned for an origin host.
+func (p *Persistency) SaveHostLimit(host string, maxConnections int) error {
+	return database.SaveHostLimit(p.db, host, maxConnections)
+}
+
+// RemoveHostLimit forgets the connection limit learned for an origin host.
+func (p *Persistency) RemoveHostLimit(host string) error {
+	return database.DeleteHostLimit(p.db, host)
+}
+
+// GetHostLimits returns the connection limits learned for the origin hosts, keyed by host.
+func (p *Persistency) GetHostLimits() (map[string]int, error) {
+	return database.GetHostLimits(p.db)
+}
@@ -0,0 +1,73 @@
+package persistency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+)
+
+const stagingDir = "staging"
+
+// StagingDir returns the directory where the chunks of a file are saved while it is downloaded, creating it if necessary.
+// The directory is keyed by the URL, the version and the size of the file, so a retried or resumed download of the same
+// version of the file finds the chunks that already succeeded, while a changed file gets a fresh directory.
+// The version is the ETag of the file, or its Last-Modified time for an origin without ETags.
+// It is keyed by the expected checksum too, like the tasks, so two tasks of the same URL never share their chunks.
+func (p *Persistency) StagingDir(url string, etag string, lastModified string, totalSize int64, checksum string) (string, error) {
+	version := etag
+	if version == "" {
+		version = lastModified
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%d\n%s", url, version, totalSize, checksum)))
+	dir := path.Join(p.baseDir, stagingDir, hex.EncodeToString(sum[:16]))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		slog.Error("Failed to create staging directory", "path", dir, "error", err)
+		return "", fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	// touch the directory, so CleanupStaging does not remove a directory in use
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil {
+		slog.Warn("Failed to update staging directory time", "path", dir, "error", err)
+	}
+	return dir, nil
+}
+
+// RemoveStagingDir removes a staging directory and all the chunks in it.
+func (p *Persistency) RemoveStagingDir(dir string) error {
+	return os.RemoveAll(dir)
+}
+
+// CleanupStaging removes staging directories that have not been used for more than maxLife.
+// They belong to downloads that failed and were never retried.
+func (p *Persistency) CleanupStaging(maxLife time.Duration) error {
+	entries, err := os.ReadDir(path.Join(p.baseDir, stagingDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if time.Since(info.ModTime()) < maxLife {
+			continue
+		}
+
+		dir := path.Join(p.baseDir, stagingDir, entry.Name())
+		slog.Info("Removing stale staging directory", "path", dir, "lastUsed", info.ModTime())
+		if err := os.RemoveAll(dir); err != nil {
+			slog.Warn("Failed to remove staging directory", "path", dir, "error", err)
+		}
+	}
+	return nil
+}
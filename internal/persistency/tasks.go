@@ -0,0 +1,75 @@
+package persistency
+
+import (
+	"log/slog"
+	"time"
+
+	"internal/database"
+)
+
+// Task states persisted in the database.
+// Tasks in TaskStatePending or TaskStateRunning are resumed when the server restarts.
+const (
+	TaskStatePending   = "PENDING"
+	TaskStateRunning   = "RUNNING"
+	TaskStateCompleted = "COMPLETED"
+	TaskStateFailed    = "FAILED"
+	TaskStateCancelled = "CANCELLED"
+)
+
+// AddTask saves a new task in the database, with the mirrors of its URL.
+func (p *Persistency) AddTask(taskId int, url string, mirrors []string, checksum string, requester string, priority string) error {
+	err := database.InsertTask(p.db, &database.Task{
+		Id:        int64(taskId),
+		URL:       url,
+		Checksum:  checksum,
+		Requester: requester,
+		State:     TaskStatePending,
+		Priority:  priority,
+	})
+	if err != nil {
+		return err
+	}
+	return database.InsertTaskMirrors(p.db, int64(taskId), mirrors)
+}
+
+// GetTaskMirrors returns the mirrors of the URL of a task.
+func (p *Persistency) GetTaskMirrors(taskId int) ([]string, error) {
+	return database.GetTaskMirrors(p.db, int64(taskId))
+}
+
+// UpdateTask saves the state and the total size of a task.
+func (p *Persistency) UpdateTask(taskId int, state string, totalSize int64) error {
+	return database.UpdateTask(p.db, &database.Task{
+		Id:        int64(taskId),
+		State:     state,
+		TotalSize: totalSize,
+	})
+}
+
+// UpdateTaskPriority saves the priority of a task, raised by a request for the same file.
+func (p *Persistency) UpdateTaskPriority(taskId int, priority string) error {
+	return database.UpdateTaskPriority(p.db, int64(taskId), priority)
+}
+
+// GetTask returns the task with the given ID, or nil if it does not exist.
+func (p *Persistency) GetTask(taskId int) (*database.Task, error) {
+	return database.GetTask(p.db, int64(taskId))
+}
+
+// GetUnfinishedTasks returns the pending and running tasks, in the order they were created.
+func (p *Persistency) GetUnfinishedTasks() ([]*database.Task, error) {
+	return database.GetTasksByState(p.db, TaskStatePending, TaskStateRunning)
+}
+
+// GetMaxTaskID returns the largest task ID ever used, so new tasks never reuse an ID.
+func (p *Persistency) GetMaxTaskID() (int, error) {
+	id, err := database.GetMaxTaskID(p.db)
+	return int(id), err
+}
+
+// CleanupTasks removes finished tasks that have not been updated for more than maxLife.
+func (p *Persistency) CleanupTasks(maxLife time.Duration) error {
+	slog.Debug("Cleaning up finished tasks", "maxLife", maxLife)
+	return database.DeleteTasksUpdatedBefore(p.db, time.Now().Add(-maxLife), TaskStateCompleted, TaskStateFailed, TaskStateCancelled)
+}